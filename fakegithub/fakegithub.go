@@ -0,0 +1,274 @@
+// Package fakegithub serves just enough of the GitHub API from a directory of
+// fixtures for kubevalidator to process webhooks end to end without a
+// network connection, recording the check runs it posts.
+//
+// A fixture directory contains:
+//
+//	repo/               the files in the repository, served at every ref
+//	pulls/<number>.json the response of the Pull Request files API for a
+//	                    PR. PRs without one list every file in repo/ as
+//	                    added at HEAD.
+package fakegithub
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/github"
+)
+
+// Server is a fake GitHub API backed by a fixture directory
+type Server struct {
+	// Dir is the fixture directory
+	Dir string
+
+	server *httptest.Server
+
+	mu        sync.Mutex
+	checkRuns []*github.CheckRun
+}
+
+// New starts a Server serving the fixtures in dir
+func New(dir string) *Server {
+	s := &Server{Dir: dir}
+	s.server = httptest.NewServer(s)
+	return s
+}
+
+// URL returns the base URL of the fake API
+func (s *Server) URL() string {
+	return s.server.URL + "/"
+}
+
+// Client returns a client for the fake API
+func (s *Server) Client() *github.Client {
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(s.URL())
+	client.UploadURL, _ = url.Parse(s.URL())
+	return client
+}
+
+// Close shuts the Server down
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// CheckRuns returns the check runs created so far with every update applied.
+// Annotations added by each update are appended to those already added, as
+// they are by GitHub. Timestamps aren't recorded so that check runs can be
+// compared with golden files.
+func (s *Server) CheckRuns() []*github.CheckRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	checkRuns := make([]*github.CheckRun, len(s.checkRuns))
+	copy(checkRuns, s.checkRuns)
+	return checkRuns
+}
+
+// ServeHTTP routes requests for /repos/:owner/:repo/...
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(parts) < 4 || parts[0] != "repos" {
+		notFound(w)
+		return
+	}
+	owner, repo, rest := parts[1], parts[2], parts[3:]
+
+	switch {
+	case rest[0] == "contents" && r.Method == http.MethodGet:
+		s.contents(w, path.Join(rest[1:]...))
+	case rest[0] == "git" && len(rest) == 3 && rest[1] == "trees" && r.Method == http.MethodGet:
+		s.tree(w, rest[2])
+	case rest[0] == "pulls" && len(rest) == 3 && rest[2] == "files" && r.Method == http.MethodGet:
+		s.pullRequestFiles(w, owner, repo, rest[1])
+	case rest[0] == "check-runs" && len(rest) == 1 && r.Method == http.MethodPost:
+		s.createCheckRun(w, r)
+	case rest[0] == "check-runs" && len(rest) == 2 && r.Method == http.MethodPatch:
+		s.updateCheckRun(w, r, rest[1])
+	default:
+		notFound(w)
+	}
+}
+
+func notFound(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNotFound)
+	fmt.Fprint(w, `{"message": "Not Found"}`)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// blobSHA returns the SHA git would give b
+func blobSHA(b []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(b))
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (s *Server) repoPath(name string) string {
+	return filepath.Join(s.Dir, "repo", filepath.FromSlash(name))
+}
+
+func (s *Server) contents(w http.ResponseWriter, name string) {
+	b, err := ioutil.ReadFile(s.repoPath(name))
+	if err != nil {
+		notFound(w)
+		return
+	}
+	writeJSON(w, &github.RepositoryContent{
+		Type:     github.String("file"),
+		Encoding: github.String("base64"),
+		Size:     github.Int(len(b)),
+		Name:     github.String(path.Base(name)),
+		Path:     github.String(name),
+		SHA:      github.String(blobSHA(b)),
+		Content:  github.String(base64.StdEncoding.EncodeToString(b)),
+	})
+}
+
+// files lists every file in repo/ with its blob SHA
+func (s *Server) files() ([]github.TreeEntry, error) {
+	root := filepath.Join(s.Dir, "repo")
+	var entries []github.TreeEntry
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || p == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		entry := github.TreeEntry{Path: github.String(filepath.ToSlash(rel))}
+		if info.IsDir() {
+			entry.Type = github.String("tree")
+		} else {
+			b, err := ioutil.ReadFile(p)
+			if err != nil {
+				return err
+			}
+			entry.Type = github.String("blob")
+			entry.SHA = github.String(blobSHA(b))
+			entry.Size = github.Int(len(b))
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	return entries, err
+}
+
+func (s *Server) tree(w http.ResponseWriter, ref string) {
+	entries, err := s.files()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, &github.Tree{
+		SHA:       github.String(ref),
+		Entries:   entries,
+		Truncated: github.Bool(false),
+	})
+}
+
+func (s *Server) pullRequestFiles(w http.ResponseWriter, owner string, repo string, number string) {
+	if _, err := strconv.Atoi(number); err != nil {
+		notFound(w)
+		return
+	}
+	if b, err := ioutil.ReadFile(filepath.Join(s.Dir, "pulls", number+".json")); err == nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+		return
+	}
+
+	entries, err := s.files()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var files []*github.CommitFile
+	for _, entry := range entries {
+		if entry.GetType() != "blob" {
+			continue
+		}
+		files = append(files, &github.CommitFile{
+			SHA:      entry.SHA,
+			Filename: entry.Path,
+			Status:   github.String("added"),
+			BlobURL:  github.String(fmt.Sprintf("https://github.com/%s/%s/blob/HEAD/%s", owner, repo, entry.GetPath())),
+		})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].GetFilename() < files[j].GetFilename() })
+	writeJSON(w, files)
+}
+
+func (s *Server) createCheckRun(w http.ResponseWriter, r *http.Request) {
+	checkRun := &github.CheckRun{}
+	if err := json.NewDecoder(r.Body).Decode(checkRun); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	checkRun.ID = github.Int64(int64(len(s.checkRuns) + 1))
+	checkRun.StartedAt = nil
+	checkRun.CompletedAt = nil
+	s.checkRuns = append(s.checkRuns, checkRun)
+	writeJSON(w, checkRun)
+}
+
+func (s *Server) updateCheckRun(w http.ResponseWriter, r *http.Request, id string) {
+	update := &github.CheckRun{}
+	if err := json.NewDecoder(r.Body).Decode(update); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, err := strconv.Atoi(id)
+	if err != nil || i < 1 || i > len(s.checkRuns) {
+		notFound(w)
+		return
+	}
+	checkRun := s.checkRuns[i-1]
+	if update.Name != nil {
+		checkRun.Name = update.Name
+	}
+	if update.Status != nil {
+		checkRun.Status = update.Status
+	}
+	if update.Conclusion != nil {
+		checkRun.Conclusion = update.Conclusion
+	}
+	if update.Output != nil {
+		if checkRun.Output == nil {
+			checkRun.Output = &github.CheckRunOutput{}
+		}
+		if update.Output.Title != nil {
+			checkRun.Output.Title = update.Output.Title
+		}
+		if update.Output.Summary != nil {
+			checkRun.Output.Summary = update.Output.Summary
+		}
+		checkRun.Output.Annotations = append(checkRun.Output.Annotations, update.Output.Annotations...)
+	}
+	writeJSON(w, checkRun)
+}
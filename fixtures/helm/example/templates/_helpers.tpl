@@ -0,0 +1,8 @@
+{{- define "example.fullname" -}}
+{{ .Release.Name }}-{{ .Chart.Name }}
+{{- end -}}
+
+{{- define "example.labels" -}}
+app: {{ include "example.fullname" . }}
+chart: {{ .Chart.Name }}-{{ .Chart.Version }}
+{{- end -}}
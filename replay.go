@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/google/go-github/github"
+	"github.com/spf13/pflag"
+	"github.com/urcomputeringpal/kubevalidator/fakegithub"
+	"github.com/urcomputeringpal/kubevalidator/validator"
+)
+
+const replayUsage = `Usage: kubevalidator replay [flags] payload.json
+
+Processes a recorded webhook payload against a fake GitHub which serves
+files from the fixture directory given by --fixtures, then prints the check
+runs kubevalidator created as JSON. The fixture directory contains:
+
+  repo/               the files in the repository
+  pulls/<number>.json the response of the Pull Request files API for a PR,
+                      which defaults to listing every file in repo/ as added
+
+`
+
+// runReplay implements the replay subcommand and returns the process's exit
+// code.
+func runReplay(args []string) int {
+	flags := pflag.NewFlagSet("replay", pflag.ContinueOnError)
+	event := flags.String("event", "check_suite", "the X-GitHub-Event the payload was delivered with")
+	fixtures := flags.String("fixtures", ".", "serve the repository and PR files from this directory")
+	schemaLocation := flags.String("schema-location", "", "load schemas from this URL when a schema doesn't configure one")
+	schemaCacheDir := flags.String("schema-cache-dir", "", "cache schemas fetched over the network in this directory")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, replayUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		if err == pflag.ErrHelp {
+			return 0
+		}
+		return 2
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return 2
+	}
+
+	payload, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kubevalidator replay: %s\n", err)
+		return 2
+	}
+	parsed, err := github.ParseWebHook(*event, payload)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kubevalidator replay: couldn't parse %s: %s\n", flags.Arg(0), err)
+		return 2
+	}
+
+	// Fixtures are local and trusted, so schemas may be loaded from anywhere
+	validator.DefaultSchemaStore.AllowLocal = true
+	validator.DefaultSchemaStore.AllowRemote = true
+	validator.DefaultSchemaStore.DefaultLocation = *schemaLocation
+	validator.DefaultSchemaStore.CacheDir = *schemaCacheDir
+
+	fake := fakegithub.New(*fixtures)
+	defer fake.Close()
+
+	ctx := context.Background()
+	appID := 1
+	c := &validator.Context{
+		Event:  parsed,
+		Github: fake.Client(),
+		Ctx:    &ctx,
+		AppID:  &appID,
+	}
+	_, processErr := c.Process()
+
+	b, err := json.MarshalIndent(fake.CheckRuns(), "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	fmt.Fprintln(os.Stdout, string(b))
+
+	if processErr != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", processErr)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bradleyfalzon/ghinstallation"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"github.com/urcomputeringpal/kubevalidator/validator"
+)
+
+const serveUsage = `Usage: kubevalidator serve [flags]
+
+Receives webhooks from GitHub and annotates check runs with the results of
+validating the Kubernetes YAML changed by Pull Requests. This is what
+kubevalidator does when no command is given.
+
+Every flag can also be set with an environment variable named after it, like
+APP_ID for --app-id, or in the YAML file named by --config-file using the
+flag's name as the key. Flags take precedence over environment variables,
+which take precedence over the file.
+
+`
+
+// runServe implements the serve subcommand and returns the process's exit
+// code.
+func runServe(args []string) int {
+	s, err := newServer(args)
+	if err == pflag.ErrHelp {
+		return 0
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "kubevalidator serve: %s\n", err)
+		return 2
+	}
+
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	go cancelOnInterrupt(ctx, cancelFunc)
+
+	if err := s.Run(ctx); err != nil && err != http.ErrServerClosed {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// newServer builds a Server from flags, the environment and an optional
+// configuration file, reporting every invalid option at once
+func newServer(args []string) (*validator.Server, error) {
+	flags := pflag.NewFlagSet("serve", pflag.ContinueOnError)
+	flags.String("config-file", "", "read options from this YAML file")
+	flags.Int("port", 8080, "serve webhooks on this port")
+	flags.String("webhook-secret", "", "the GitHub App's webhook secret")
+	flags.Int("app-id", 0, "the GitHub App's ID")
+	flags.String("private-key", "", "the GitHub App's PEM encoded private key")
+	flags.String("private-key-file", "", "read the GitHub App's private key from this file")
+	flags.String("github-url", "https://api.github.com/", "the URL of the GitHub API, like https://github.example.com/api/v3/ for GitHub Enterprise Server")
+	flags.String("github-upload-url", "", "the URL of the GitHub uploads API (default derived from --github-url)")
+	flags.Int("workers", 4, "process this many webhooks at once")
+	flags.Int("queue-size", 100, "let this many webhooks wait to be processed before rejecting deliveries")
+	flags.String("schema-location", "", "load schemas from this URL when a schema doesn't configure one")
+	flags.String("allowed-schema-locations", "", "comma separated URLs repositories may load schemas from in addition to --schema-location, kubernetesjsonschema.dev and forks of kubernetes-json-schema")
+	flags.String("schema-cache-dir", "", "cache schemas fetched over the network in this directory")
+	flags.Duration("dedupe-ttl", 10*time.Minute, "skip redelivered webhooks and check suites for this long")
+	flags.String("dedupe-dir", "", "share skipped webhooks and check suites with other instances using this directory")
+	flags.Duration("drain-timeout", 20*time.Second, "wait this long for accepted webhooks to be processed when shutting down")
+	flags.String("log-level", "info", "log entries at this level or above: debug, info, warn or error")
+	flags.String("log-format", "logfmt", "write logs as logfmt or json")
+	flags.String("metrics-address", "", "serve /metrics on this address rather than alongside webhooks, like :9090")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, serveUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return nil, fmt.Errorf("unexpected arguments %s", strings.Join(flags.Args(), " "))
+	}
+
+	v := viper.New()
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+	if err := v.BindPFlags(flags); err != nil {
+		return nil, err
+	}
+	if configFile := v.GetString("config-file"); configFile != "" {
+		v.SetConfigFile(configFile)
+		if err := v.ReadInConfig(); err != nil {
+			return nil, fmt.Errorf("couldn't read %s: %s", configFile, err)
+		}
+	}
+
+	o := &options{v: v}
+	s := &validator.Server{
+		Port:           o.int("port", 1),
+		WebhookSecret:  o.required("webhook-secret"),
+		AppID:          o.int("app-id", 1),
+		BaseURL:        o.url("github-url"),
+		UploadURL:      o.url("github-upload-url"),
+		Workers:        o.int("workers", 1),
+		QueueSize:      o.int("queue-size", 1),
+		DrainTimeout:   o.duration("drain-timeout"),
+		MetricsAddress: o.address("metrics-address"),
+	}
+	if s.Port > 65535 {
+		o.invalid("port", "must be 65535 or less")
+	}
+	s.PrivateKey = o.privateKey(s.AppID)
+
+	if schemaLocation := o.url("schema-location"); schemaLocation != "" {
+		validator.DefaultSchemaStore.DefaultLocation = schemaLocation
+	}
+	validator.DefaultSchemaStore.AllowedLocations = o.urls("allowed-schema-locations")
+	validator.DefaultSchemaStore.CacheDir = v.GetString("schema-cache-dir")
+
+	dedupeTTL := o.duration("dedupe-ttl")
+	s.Dedupe = &validator.MemoryDedupeStore{TTL: dedupeTTL}
+	if dedupeDir := v.GetString("dedupe-dir"); dedupeDir != "" {
+		s.Dedupe = &validator.FileDedupeStore{Dir: dedupeDir, TTL: dedupeTTL}
+	}
+
+	logLevel, err := validator.ParseLevel(v.GetString("log-level"))
+	if err != nil {
+		o.invalid("log-level", err.Error())
+	}
+	logFormat := v.GetString("log-format")
+	if logFormat != "logfmt" && logFormat != "json" {
+		o.invalid("log-format", fmt.Sprintf("must be logfmt or json, not %q", logFormat))
+	}
+
+	if len(o.problems) > 0 {
+		return nil, fmt.Errorf("invalid configuration:\n  %s", strings.Join(o.problems, "\n  "))
+	}
+
+	validator.DefaultLogger = validator.NewLogger(os.Stderr, logLevel, logFormat)
+	s.Log = validator.DefaultLogger
+	return s, nil
+}
+
+// options reads and validates values from viper, collecting a problem for
+// each invalid one
+type options struct {
+	v        *viper.Viper
+	problems []string
+}
+
+func (o *options) invalid(key string, problem string) {
+	o.problems = append(o.problems, fmt.Sprintf("--%s (%s): %s", key, envName(key), problem))
+}
+
+func envName(key string) string {
+	return strings.ToUpper(strings.Replace(key, "-", "_", -1))
+}
+
+func (o *options) required(key string) string {
+	value := o.v.GetString(key)
+	if value == "" {
+		o.invalid(key, "is required")
+	}
+	return value
+}
+
+func (o *options) int(key string, min int) int {
+	value := o.v.GetString(key)
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		o.invalid(key, fmt.Sprintf("must be a number, not %q", value))
+		return 0
+	}
+	if i < min {
+		o.invalid(key, fmt.Sprintf("must be at least %d", min))
+	}
+	return i
+}
+
+func (o *options) duration(key string) time.Duration {
+	value := o.v.GetString(key)
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		o.invalid(key, fmt.Sprintf("must be a duration like 10s or 5m, not %q", value))
+		return 0
+	}
+	if d < 0 {
+		o.invalid(key, "mustn't be negative")
+	}
+	return d
+}
+
+func (o *options) url(key string) string {
+	value := o.v.GetString(key)
+	if value == "" {
+		return ""
+	}
+	u, err := url.Parse(value)
+	if err != nil || u.Scheme == "" || (u.Host == "" && u.Scheme != "file") {
+		o.invalid(key, fmt.Sprintf("must be an absolute URL, not %q", value))
+	}
+	return value
+}
+
+func (o *options) urls(key string) []string {
+	var urls []string
+	for _, value := range strings.Split(o.v.GetString(key), ",") {
+		value = strings.TrimSpace(value)
+		if value == "" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			o.invalid(key, fmt.Sprintf("must be http(s) URLs, not %q", value))
+			continue
+		}
+		urls = append(urls, value)
+	}
+	return urls
+}
+
+func (o *options) address(key string) string {
+	value := o.v.GetString(key)
+	if value == "" {
+		return ""
+	}
+	if _, _, err := net.SplitHostPort(value); err != nil {
+		o.invalid(key, fmt.Sprintf("must be an address like :9090, not %q", value))
+	}
+	return value
+}
+
+// privateKey returns the inline private key, falling back to reading
+// private-key-file, and checks that it can be used to authenticate as the
+// App
+func (o *options) privateKey(appID int) []byte {
+	key := []byte(o.v.GetString("private-key"))
+	if len(key) == 0 {
+		file := o.v.GetString("private-key-file")
+		if file == "" {
+			o.invalid("private-key", "is required unless --private-key-file is given")
+			return nil
+		}
+		b, err := ioutil.ReadFile(file)
+		if err != nil {
+			o.invalid("private-key-file", err.Error())
+			return nil
+		}
+		key = b
+	}
+	if _, err := ghinstallation.NewAppsTransport(http.DefaultTransport, appID, key); err != nil {
+		o.invalid("private-key", err.Error())
+		return nil
+	}
+	return key
+}
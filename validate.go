@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/go-github/github"
+	"github.com/urcomputeringpal/kubevalidator/validator"
+)
+
+const validateUsage = `Usage: kubevalidator validate [--base ref] [--head ref] [dir]
+
+Validates the Kubernetes YAML in a local checkout using the configuration in
+[dir]/.github/kubevalidator.yaml, printing any errors kubevalidator would
+annotate a Pull Request with. dir defaults to the current directory.
+
+By default every file in the working tree is considered. When --base or
+--head are given, files are instead read from git and only those changed
+between base and head are validated, unless the configuration sets
+scope: all.
+
+`
+
+// runValidate implements the validate subcommand and returns the process's
+// exit code.
+func runValidate(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	base := flags.String("base", "", "only validate files changed since this ref")
+	head := flags.String("head", "", "read files from this ref rather than the working tree")
+	schemaLocation := flags.String("schema-location", "", "load schemas from this URL when a schema doesn't configure one")
+	schemaCacheDir := flags.String("schema-cache-dir", "", "cache schemas fetched over the network in this directory")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, validateUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	dir := "."
+	switch flags.NArg() {
+	case 0:
+	case 1:
+		dir = flags.Arg(0)
+	default:
+		flags.Usage()
+		return 2
+	}
+
+	// The configuration comes from the user's own checkout, so there's no
+	// harm in letting it read schemas from their disk or anywhere else
+	validator.DefaultSchemaStore.AllowLocal = true
+	validator.DefaultSchemaStore.AllowRemote = true
+	validator.DefaultSchemaStore.DefaultLocation = *schemaLocation
+	validator.DefaultSchemaStore.CacheDir = *schemaCacheDir
+
+	var source validator.Source
+	if *base != "" || *head != "" {
+		source = &validator.GitSource{Dir: dir, Base: *base, Head: *head}
+	} else {
+		source = &validator.DirectorySource{Dir: dir}
+	}
+
+	candidates, annotations, err := validator.ValidateSource(source)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%+v\n", err)
+		return 2
+	}
+
+	for _, annotation := range annotations {
+		printAnnotation(os.Stdout, annotation)
+	}
+	failures := annotations.Failures()
+	fmt.Fprintf(os.Stdout, "%d files checked, %d errors\n", len(candidates), failures)
+
+	if failures > 0 {
+		return 1
+	}
+	return 0
+}
+
+// printAnnotation writes a CheckRunAnnotation in the file:line:column: format
+// used by compilers and most editors.
+func printAnnotation(w io.Writer, a *github.CheckRunAnnotation) {
+	if a.StartColumn != nil {
+		fmt.Fprintf(w, "%s:%d:%d: %s: ", a.GetPath(), a.GetStartLine(), a.GetStartColumn(), a.GetAnnotationLevel())
+	} else {
+		fmt.Fprintf(w, "%s:%d: %s: ", a.GetPath(), a.GetStartLine(), a.GetAnnotationLevel())
+	}
+	if a.GetTitle() != "" {
+		fmt.Fprintf(w, "%s: ", a.GetTitle())
+	}
+	fmt.Fprintln(w, a.GetMessage())
+}
@@ -1,8 +1,6 @@
 package validator
 
 import (
-	"fmt"
-
 	"github.com/google/go-github/github"
 )
 
@@ -16,7 +14,32 @@ func (a Annotations) Swap(i, j int) {
 	*a[i], *a[j] = *a[j], *a[i]
 }
 func (a Annotations) Less(i, j int) bool {
-	one := fmt.Sprintf("%d:%s", a[i].GetStartLine(), a[i].GetMessage())
-	two := fmt.Sprintf("%d:%s", a[j].GetStartLine(), a[j].GetMessage())
-	return one < two
+	if a[i].GetStartLine() != a[j].GetStartLine() {
+		return a[i].GetStartLine() < a[j].GetStartLine()
+	}
+	return a[i].GetMessage() < a[j].GetMessage()
+}
+
+// Failures counts the annotations with the failure level
+func (a Annotations) Failures() int {
+	failures := 0
+	for _, annotation := range a {
+		if annotation.GetAnnotationLevel() == "failure" {
+			failures++
+		}
+	}
+	return failures
+}
+
+// batches splits the annotations into slices of at most size annotations
+func (a Annotations) batches(size int) []Annotations {
+	var batches []Annotations
+	for len(a) > size {
+		batches = append(batches, a[:size])
+		a = a[size:]
+	}
+	if len(a) > 0 {
+		batches = append(batches, a)
+	}
+	return batches
 }
@@ -1,32 +1,34 @@
 package validator
 
 import (
-	"bufio"
 	"bytes"
 	"fmt"
 	"sort"
 	"strings"
 
 	"github.com/google/go-github/github"
-	multierror "github.com/hashicorp/go-multierror"
-	"github.com/instrumenta/kubeval/kubeval"
-	yamlpatch "github.com/krishicks/yaml-patch"
-	difflib "github.com/pmezard/go-difflib/difflib"
 	"github.com/xeipuuv/gojsonschema"
-	"sourcegraph.com/sourcegraph/go-diff/diff"
 )
 
 // Candidate reprensets a file to be validated
 type Candidate struct {
 	bytes   *[]byte
-	context *Context
-	file    *github.CommitFile
+	source  Source
+	file    *File
 	schemas []*KubeValidatorConfigSchema
+	crds    customResourceSchemas
+
+	// origin locates annotations on Candidates built from other files
+	origin origin
 }
 
-const (
-	placeholderString = "AAA___KUBEVALIDATOR___PLACEHOLDER___AAA"
-)
+// origin moves the annotations of Candidates built from other files, like
+// rendered Helm templates and kustomize overlays, to the files they came from
+type origin interface {
+	// annotate moves annotation, which describes e in the resource result or
+	// the whole resource if e is nil, to the file it came from
+	annotate(annotation *github.CheckRunAnnotation, result ValidationResult, e gojsonschema.ResultError)
+}
 
 var (
 	defaultSchema = &KubeValidatorConfigSchema{
@@ -37,12 +39,12 @@ var (
 )
 
 // NewCandidate initializes a validation Candidate
-func NewCandidate(context *Context, file *github.CommitFile, schemas []*KubeValidatorConfigSchema) *Candidate {
+func NewCandidate(source Source, file *File, schemas []*KubeValidatorConfigSchema) *Candidate {
 	if len(schemas) == 0 {
 		schemas = append(schemas, defaultSchema)
 	}
 	return &Candidate{
-		context: context,
+		source:  source,
 		file:    file,
 		schemas: schemas,
 	}
@@ -52,14 +54,19 @@ func (c *Candidate) setBytes(b *[]byte) {
 	c.bytes = b
 }
 
-// LoadBytes hydrates bytes from GitHub and returns a CheckRunAnnotation if
-// an error is encountered
+// LoadBytes hydrates bytes from the Candidate's Source and returns a
+// CheckRunAnnotation if an error is encountered. Candidates built from other
+// files already have their bytes.
 func (c *Candidate) LoadBytes() *github.CheckRunAnnotation {
-	b, err := c.context.bytesForFilename(c.context.Event.(*github.CheckSuiteEvent), c.file.GetFilename())
+	if c.bytes != nil {
+		return nil
+	}
+	b, err := c.source.ReadFile(c.file.GetFilename())
 	if err != nil {
+		annotationsAdded.inc("failure", "load")
 		return &github.CheckRunAnnotation{
-			Path:            c.file.Filename,
-			BlobHRef:        c.file.BlobURL,
+			Path:            c.path(),
+			BlobHRef:        c.blobHRef(),
 			StartLine:       github.Int(1),
 			EndLine:         github.Int(1),
 			AnnotationLevel: github.String("failure"),
@@ -68,10 +75,24 @@ func (c *Candidate) LoadBytes() *github.CheckRunAnnotation {
 		}
 	}
 
-	c.bytes = b
+	c.bytes = &b
 	return nil
 }
 
+// path returns the Candidate's filename for use in a CheckRunAnnotation
+func (c *Candidate) path() *string {
+	return github.String(c.file.GetFilename())
+}
+
+// blobHRef returns the Candidate's blob URL for use in a CheckRunAnnotation,
+// omitting it when there isn't one
+func (c *Candidate) blobHRef() *string {
+	if c.file.GetBlobURL() == "" {
+		return nil
+	}
+	return github.String(c.file.GetBlobURL())
+}
+
 // MarkdownListItem returns a string that represents the Candidate designed for
 // use in a Markdown List
 func (c *Candidate) MarkdownListItem() string {
@@ -82,20 +103,8 @@ func (c *Candidate) MarkdownListItem() string {
 func (c *Candidate) Validate() Annotations {
 	var annotations Annotations
 	for _, schema := range c.schemas {
-		kubeval.SchemaLocation = schema.SchemaLocation()
-
-		// TODO move more of this into KubeValidatorConfigSchema
-		if schema.Version != "" {
-			kubeval.Version = schema.Version
-		}
-
-		// TODO configurable
-		kubeval.Strict = true
-		if schema.ConfigType == "openstack" {
-			kubeval.OpenShift = true
-		} else {
-			kubeval.OpenShift = false
-		}
+		validator := NewValidator(schema, DefaultSchemaStore)
+		validator.CustomResources = c.crds
 
 		var schemaName string
 		if schema.Name != "" {
@@ -107,9 +116,10 @@ func (c *Candidate) Validate() Annotations {
 		}
 
 		if c.bytes == nil {
+			annotationsAdded.inc("failure", "load")
 			annotations = append(annotations, &github.CheckRunAnnotation{
-				Path:            c.file.Filename,
-				BlobHRef:        c.file.BlobURL,
+				Path:            c.path(),
+				BlobHRef:        c.blobHRef(),
 				StartLine:       github.Int(1),
 				EndLine:         github.Int(1),
 				AnnotationLevel: github.String("failure"),
@@ -119,42 +129,31 @@ func (c *Candidate) Validate() Annotations {
 			continue
 		}
 
-		results, err := kubeval.Validate(*c.bytes, c.file.GetFilename())
+		results := validator.Validate(*c.bytes, c.file.GetFilename())
 
-		if err != nil {
-			if merr, ok := err.(*multierror.Error); ok {
-				merr.ErrorFormat = abbreviatedErrorFormat
-			}
-			var title *string
-			var message *string
-			if len(results) > 0 {
-				title = github.String(fmt.Sprintf("Internal error when validating %s against %s schemas from %s", results[0].Kind, schemaName, schema.SchemaLocation()))
-				message = github.String(fmt.Sprintf("This may indicate an incorrect 'apiVersion' or 'kind' field, a missing upstream schema version, or an intermittent error. Details:\n\n%s", err))
-			} else {
-				title = github.String(fmt.Sprintf("Internal error when validating against %s schemas from %s", schemaName, schema.SchemaLocation()))
-				message = github.String(fmt.Sprintf("%s", err))
+		for _, result := range results {
+			if result.Err != nil {
+				if annotation := c.resultErrorAnnotation(schema, schemaName, validator, result); annotation != nil {
+					if c.origin != nil {
+						c.origin.annotate(annotation, result, nil)
+					}
+					annotations = append(annotations, annotation)
+				}
+				continue
 			}
-			annotations = append(annotations, &github.CheckRunAnnotation{
-				Path:            c.file.Filename,
-				BlobHRef:        c.file.BlobURL,
-				StartLine:       github.Int(1),
-				EndLine:         github.Int(1),
-				AnnotationLevel: github.String("failure"),
-				Title:           title,
-				Message:         message,
-			})
-			continue
-		}
 
-		for _, result := range results {
 			for _, error := range result.Errors {
 				startLine := 1
 				endLine := 1
-				if schema.LineNumbers == true {
-					switch error.Type() {
-					default:
-						// fmt.Println(error.Type())
-						startLine, endLine = detectLineNumbersDefault(c.bytes, error)
+				var startColumn, endColumn *int
+				if schema.LineNumbersEnabled() && result.positions != nil {
+					if s, _ := result.positions.locate(error); s.start.line > 0 {
+						startLine, endLine = s.start.line, s.end.line
+						// GitHub only accepts columns for annotations on a
+						// single line
+						if startLine == endLine {
+							startColumn, endColumn = github.Int(s.start.column), github.Int(s.end.column)
+						}
 					}
 				}
 
@@ -173,16 +172,28 @@ func (c *Candidate) Validate() Annotations {
 					message = github.String(fmt.Sprintf("%s; see https://kubernetes.io/docs/reference/generated/kubernetes-api/v%s/#%s-%s for more details", error.String(), strings.Join(versionComponents[:2], "."), strings.ToLower(result.Kind), apiVersionString))
 				}
 
-				annotations = append(annotations, &github.CheckRunAnnotation{
-					Path:            c.file.Filename,
-					BlobHRef:        c.file.BlobURL,
+				level := "failure"
+				if error.Type() == "additional_property_not_allowed" && schema.ignoresAdditionalProperty(additionalPropertyPath(error)) {
+					level = "notice"
+				}
+				annotationsAdded.inc(level, error.Type())
+
+				annotation := &github.CheckRunAnnotation{
+					Path:            c.path(),
+					BlobHRef:        c.blobHRef(),
 					StartLine:       &startLine,
 					EndLine:         &endLine,
-					AnnotationLevel: github.String("failure"),
+					StartColumn:     startColumn,
+					EndColumn:       endColumn,
+					AnnotationLevel: github.String(level),
 					Title:           github.String(fmt.Sprintf("Error validating %s against %s schema", result.Kind, schemaName)),
 					Message:         message,
 					RawDetails:      github.String(resultErrorDetailString(error)),
-				})
+				}
+				if c.origin != nil {
+					c.origin.annotate(annotation, result, error)
+				}
+				annotations = append(annotations, annotation)
 			}
 		}
 	}
@@ -190,76 +201,57 @@ func (c *Candidate) Validate() Annotations {
 	return annotations
 }
 
-func detectLineNumbersDefault(b *[]byte, e gojsonschema.ResultError) (int, int) {
-	var dotted string
-	rootContext := strings.TrimPrefix(e.Context().String(), "(root).")
-	dotted = fmt.Sprintf(".%s", rootContext)
-	path := yamlpatch.OpPath(strings.Replace(dotted, ".", "/", -1))
-	// log.Println(e.String())
-	// log.Println(e.Type())
-	// log.Println(path)
-	var patch yamlpatch.Patch
-	var s interface{}
-	s = placeholderString
-	value := yamlpatch.NewNode(&s)
-	operation := yamlpatch.Operation{
-		Op:    "replace",
-		Path:  path,
-		Value: value,
-	}
-	patch = append(patch, operation)
-	patchedBytes, err := patch.Apply(*b)
-	if err != nil {
-		return 1, 1
-	}
-
-	difflibDiff := difflib.UnifiedDiff{
-		A:        difflib.SplitLines(string(*b)),
-		B:        difflib.SplitLines(string(patchedBytes)),
-		FromFile: "Original",
-		ToFile:   "Current",
-		Context:  0,
+// resultErrorAnnotation describes a resource that couldn't be validated,
+// distinguishing problems with the resource itself from missing schemas and
+// failures to load them. It's annotated on the first line of the resource's
+// document, and is nil if the problem should be ignored.
+func (c *Candidate) resultErrorAnnotation(schema *KubeValidatorConfigSchema, schemaName string, validator *Validator, result ValidationResult) *github.CheckRunAnnotation {
+	var level, kind, title, message string
+	switch err := result.Err.(type) {
+	case *invalidResourceError:
+		level = "failure"
+		kind = "invalid_resource"
+		title = "Invalid Kubernetes resource"
+		message = fmt.Sprintf("kubevalidator couldn't determine which schema to validate this resource against. Check its 'apiVersion' and 'kind' fields. Details:\n\n%s", err)
+	case *missingSchemaError:
+		level = schema.MissingSchemasLevel()
+		if level == "skip" {
+			return nil
+		}
+		kind = "missing_schema"
+		title = fmt.Sprintf("No %s schema for %s %s in %s", schemaName, result.APIVersion, result.Kind, validator.Location)
+		message = fmt.Sprintf("This may indicate an incorrect 'apiVersion' or 'kind' field or a missing upstream schema version. Set missingSchemas to warning or skip to allow resources without schemas. Details:\n\n%s", err)
+	default:
+		level = "failure"
+		kind = "schema_load"
+		title = fmt.Sprintf("Error loading %s schema for %s %s from %s", schemaName, result.APIVersion, result.Kind, validator.Location)
+		message = fmt.Sprintf("This is likely an intermittent error, re-run this check to try again. Details:\n\n%s", err)
 	}
-	unifiedDiffString, err := difflib.GetUnifiedDiffString(difflibDiff)
-	if err != nil {
-		return 1, 1
+	annotationsAdded.inc(level, kind)
+	line := 1
+	if schema.LineNumbersEnabled() && result.Line > 0 {
+		line = result.Line
 	}
-
-	// log.Println(unifiedDiffString)
-	fileDiff, err := diff.ParseFileDiff([]byte(unifiedDiffString))
-	if err != nil {
-		return 1, 1
+	return &github.CheckRunAnnotation{
+		Path:            c.path(),
+		BlobHRef:        c.blobHRef(),
+		StartLine:       github.Int(line),
+		EndLine:         github.Int(line),
+		AnnotationLevel: github.String(level),
+		Title:           github.String(title),
+		Message:         github.String(message),
 	}
+}
 
-	for _, hunk := range fileDiff.Hunks {
-		scanner := bufio.NewScanner(bytes.NewReader(hunk.Body))
-
-		line := 1
-		found := false
-		for scanner.Scan() {
-			if strings.Contains(scanner.Text(), placeholderString) {
-				found = true
-				continue
-			}
-			line++
-		}
-		if found {
-			// log.Printf("%+v", hunk)
-			startLine := int(hunk.NewStartLine)
-			endLine := int(hunk.NewStartLine + hunk.NewLines)
-			// log.Printf("start: %d end: %d", startLine, endLine)
-
-			// if e.Type() == "additional_property_not_allowed" {
-			// 	return line, line+1
-			// }
-			return startLine, endLine
-		}
-
-		if err := scanner.Err(); err != nil {
-			continue
-		}
+// additionalPropertyPath returns the dotted path of the property an
+// additional_property_not_allowed error was reported for
+func additionalPropertyPath(e gojsonschema.ResultError) string {
+	property := fmt.Sprintf("%v", e.Details()["property"])
+	parent := strings.TrimPrefix(e.Context().String(), "(root)")
+	if parent == "" {
+		return property
 	}
-	return 1, 1
+	return fmt.Sprintf("%s.%s", strings.TrimPrefix(parent, "."), property)
 }
 
 func resultErrorDetailString(e gojsonschema.ResultError) string {
@@ -276,17 +268,3 @@ func resultErrorDetailString(e gojsonschema.ResultError) string {
 
 	return buffer.String()
 }
-
-// Like ListFormatFunc but shorter
-func abbreviatedErrorFormat(es []error) string {
-	if len(es) == 1 {
-		return es[0].Error()
-	}
-
-	points := make([]string, len(es))
-	for i, err := range es {
-		points[i] = fmt.Sprintf("* %s", err)
-	}
-
-	return strings.Join(points, "\n\t")
-}
@@ -1,6 +1,7 @@
 package validator
 
 import (
+	"fmt"
 	"io/ioutil"
 	"path/filepath"
 	"sort"
@@ -11,12 +12,12 @@ import (
 )
 
 func TestAnnotationsForValidCandidate(t *testing.T) {
+	defer useFixtureSchemas()()
+
 	candidate := NewCandidate(
-		&Context{
-			Event: &github.CheckSuiteEvent{},
-		}, &github.CommitFile{
-			Filename: github.String("fixtures/deployment.yaml"),
-		}, nil)
+		nil, &File{
+			Filename: "fixtures/deployment.yaml",
+		}, []*KubeValidatorConfigSchema{{}})
 
 	filePath, _ := filepath.Abs("../fixtures/deployment.yaml")
 	fileContents, _ := ioutil.ReadFile(filePath)
@@ -29,13 +30,13 @@ func TestAnnotationsForValidCandidate(t *testing.T) {
 }
 
 func TestAnnotationsForInvalidCandidate(t *testing.T) {
+	defer useFixtureSchemas()()
+
 	candidate := NewCandidate(
-		&Context{
-			Event: &github.CheckSuiteEvent{},
-		}, &github.CommitFile{
-			BlobURL:  github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			Filename: github.String("deployment.yaml"),
-		}, nil)
+		nil, &File{
+			BlobURL:  "https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml",
+			Filename: "deployment.yaml",
+		}, []*KubeValidatorConfigSchema{{}})
 
 	filePath, _ := filepath.Abs("../fixtures/invalid.yaml")
 	fileContents, _ := ioutil.ReadFile(filePath)
@@ -46,8 +47,10 @@ func TestAnnotationsForInvalidCandidate(t *testing.T) {
 		{
 			Path:            github.String("deployment.yaml"),
 			BlobHRef:        github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			StartLine:       github.Int(1),
-			EndLine:         github.Int(1),
+			StartLine:       github.Int(6),
+			EndLine:         github.Int(6),
+			StartColumn:     github.Int(1),
+			EndColumn:       github.Int(4),
 			AnnotationLevel: github.String("failure"),
 			Title:           github.String("Error validating Deployment against master schema"),
 			Message:         github.String("selector: selector is required"),
@@ -56,22 +59,26 @@ func TestAnnotationsForInvalidCandidate(t *testing.T) {
 		{
 			Path:            github.String("deployment.yaml"),
 			BlobHRef:        github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			StartLine:       github.Int(1),
-			EndLine:         github.Int(1),
+			StartLine:       github.Int(6),
+			EndLine:         github.Int(6),
+			StartColumn:     github.Int(1),
+			EndColumn:       github.Int(4),
 			AnnotationLevel: github.String("failure"),
 			Title:           github.String("Error validating Deployment against master schema"),
-			Message:         github.String("spec.replicas: Invalid type. Expected: integer, given: string"),
-			RawDetails:      github.String("* context: (root).spec.replicas\n* expected: integer\n* field: spec.replicas\n* given: string\n"),
+			Message:         github.String("template: template is required"),
+			RawDetails:      github.String("* context: (root).spec\n* field: template\n* property: template\n"),
 		},
 		{
 			Path:            github.String("deployment.yaml"),
 			BlobHRef:        github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			StartLine:       github.Int(1),
-			EndLine:         github.Int(1),
+			StartLine:       github.Int(7),
+			EndLine:         github.Int(7),
+			StartColumn:     github.Int(3),
+			EndColumn:       github.Int(16),
 			AnnotationLevel: github.String("failure"),
 			Title:           github.String("Error validating Deployment against master schema"),
-			Message:         github.String("template: template is required"),
-			RawDetails:      github.String("* context: (root).spec\n* field: template\n* property: template\n"),
+			Message:         github.String("spec.replicas: Invalid type. Expected: integer, given: string"),
+			RawDetails:      github.String("* context: (root).spec.replicas\n* expected: integer\n* field: spec.replicas\n* given: string\n"),
 		}}
 
 	if len(annotations) != len(want) {
@@ -86,17 +93,17 @@ func TestAnnotationsForInvalidCandidate(t *testing.T) {
 }
 
 func TestAnnotationsForCandidateWithMultipleFailures(t *testing.T) {
+	defer useFixtureSchemas()()
+
 	schema := &KubeValidatorConfigSchema{
 		Version: "1.13.0",
 	}
 	var schemas []*KubeValidatorConfigSchema
 	schemas = append(schemas, schema)
 	candidate := NewCandidate(
-		&Context{
-			Event: &github.CheckSuiteEvent{},
-		}, &github.CommitFile{
-			BlobURL:  github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			Filename: github.String("deployment.yaml"),
+		nil, &File{
+			BlobURL:  "https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml",
+			Filename: "deployment.yaml",
 		}, schemas)
 
 	filePath, _ := filepath.Abs("../fixtures/invalid/deployment/multiple.yaml")
@@ -109,8 +116,10 @@ func TestAnnotationsForCandidateWithMultipleFailures(t *testing.T) {
 		{
 			Path:            github.String("deployment.yaml"),
 			BlobHRef:        github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			StartLine:       github.Int(1),
-			EndLine:         github.Int(1),
+			StartLine:       github.Int(8),
+			EndLine:         github.Int(8),
+			StartColumn:     github.Int(3),
+			EndColumn:       github.Int(26),
 			AnnotationLevel: github.String("failure"),
 			Title:           github.String("Error validating Deployment against 1.13.0 schema"),
 			Message:         github.String("extra: Additional property extra is not allowed; see https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.13/#deployment-v1-apps for more details"),
@@ -119,8 +128,10 @@ func TestAnnotationsForCandidateWithMultipleFailures(t *testing.T) {
 		{
 			Path:            github.String("deployment.yaml"),
 			BlobHRef:        github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			StartLine:       github.Int(1),
-			EndLine:         github.Int(1),
+			StartLine:       github.Int(9),
+			EndLine:         github.Int(9),
+			StartColumn:     github.Int(3),
+			EndColumn:       github.Int(21),
 			AnnotationLevel: github.String("failure"),
 			Title:           github.String("Error validating Deployment against 1.13.0 schema"),
 			Message:         github.String("spec.replicas: Invalid type. Expected: integer, given: string; see https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.13/#deployment-v1-apps for more details"),
@@ -129,8 +140,10 @@ func TestAnnotationsForCandidateWithMultipleFailures(t *testing.T) {
 		{
 			Path:            github.String("deployment.yaml"),
 			BlobHRef:        github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			StartLine:       github.Int(1),
-			EndLine:         github.Int(1),
+			StartLine:       github.Int(23),
+			EndLine:         github.Int(23),
+			StartColumn:     github.Int(11),
+			EndColumn:       github.Int(42),
 			AnnotationLevel: github.String("failure"),
 			Title:           github.String("Error validating Deployment against 1.13.0 schema"),
 			Message:         github.String("extra-container: Additional property extra-container is not allowed; see https://kubernetes.io/docs/reference/generated/kubernetes-api/v1.13/#deployment-v1-apps for more details"),
@@ -153,17 +166,17 @@ func TestAnnotationsForCandidateWithMultipleFailures(t *testing.T) {
 }
 
 func TestAnnotationsWithCustomSchemaSuccess(t *testing.T) {
+	defer useFixtureSchemas()()
+
 	schema := &KubeValidatorConfigSchema{
 		Version: "1.13.0",
 	}
 	var schemas []*KubeValidatorConfigSchema
 	schemas = append(schemas, schema)
 	candidate := NewCandidate(
-		&Context{
-			Event: &github.CheckSuiteEvent{},
-		}, &github.CommitFile{
-			BlobURL:  github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			Filename: github.String("deployment.yaml"),
+		nil, &File{
+			BlobURL:  "https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml",
+			Filename: "deployment.yaml",
 		}, schemas)
 
 	filePath, _ := filepath.Abs("../fixtures/deployment.yaml")
@@ -177,17 +190,17 @@ func TestAnnotationsWithCustomSchemaSuccess(t *testing.T) {
 }
 
 func TestAnnotationsWithCustomSchemaFailure(t *testing.T) {
+	defer useFixtureSchemas()()
+
 	schema := &KubeValidatorConfigSchema{
 		Version: "1.99.1",
 	}
 	var schemas []*KubeValidatorConfigSchema
 	schemas = append(schemas, schema)
 	candidate := NewCandidate(
-		&Context{
-			Event: &github.CheckSuiteEvent{},
-		}, &github.CommitFile{
-			BlobURL:  github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			Filename: github.String("deployment.yaml"),
+		nil, &File{
+			BlobURL:  "https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml",
+			Filename: "deployment.yaml",
 		}, schemas)
 
 	filePath, _ := filepath.Abs("../fixtures/deployment.yaml")
@@ -201,8 +214,8 @@ func TestAnnotationsWithCustomSchemaFailure(t *testing.T) {
 		StartLine:       github.Int(1),
 		EndLine:         github.Int(1),
 		AnnotationLevel: github.String("failure"),
-		Title:           github.String("Internal error when validating Deployment against 1.99.1 schemas from https://kubernetesjsonschema.dev"),
-		Message:         github.String("This may indicate an incorrect 'apiVersion' or 'kind' field, a missing upstream schema version, or an intermittent error. Details:\n\nProblem loading schema from the network at https://kubernetesjsonschema.dev/v1.99.1-standalone-strict/deployment-apps-v1.json: Could not read schema from HTTP, response status is 404 Not Found"),
+		Title:           github.String(fmt.Sprintf("No 1.99.1 schema for apps/v1 Deployment in %s", fixtureSchemaLocation())),
+		Message:         github.String(fmt.Sprintf("This may indicate an incorrect 'apiVersion' or 'kind' field or a missing upstream schema version. Set missingSchemas to warning or skip to allow resources without schemas. Details:\n\nNo schema found at %s/v1.99.1-standalone-strict/deployment-apps-v1.json: file does not exist", fixtureSchemaLocation())),
 	}}
 
 	if len(annotations) != len(want) {
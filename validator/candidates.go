@@ -1,6 +1,14 @@
 package validator
 
-import "sort"
+import (
+	"sort"
+	"sync"
+)
+
+// validationWorkers bounds the number of Candidates validated concurrently.
+// Validation mostly waits on schemas to be fetched, so this is set higher than
+// the number of CPUs on a typical machine.
+const validationWorkers = 8
 
 // Candidates is an array of pointers to Candidates
 type Candidates []*Candidate
@@ -18,11 +26,35 @@ func (c *Candidates) LoadBytes() Annotations {
 	return a
 }
 
-// Validate runs kubeval on all candidates
+// Validate runs kubeval on all candidates, validating up to
+// validationWorkers of them at once
 func (c *Candidates) Validate() Annotations {
+	candidates := *c
+	results := make([]Annotations, len(candidates))
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	workers := validationWorkers
+	if len(candidates) < workers {
+		workers = len(candidates)
+	}
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i] = candidates[i].Validate()
+			}
+		}()
+	}
+	for i := range candidates {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
 	var a Annotations
-	for _, candidate := range *c {
-		annotations := candidate.Validate()
+	for _, annotations := range results {
 		if annotations != nil {
 			a = append(a, annotations...)
 		}
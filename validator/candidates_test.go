@@ -20,13 +20,13 @@ import (
 )
 
 func TestAnnotationsForInvalidCandidates(t *testing.T) {
+	defer useFixtureSchemas()()
+
 	var candidates Candidates
 	candidate := NewCandidate(
-		&Context{
-			Event: &github.CheckSuiteEvent{},
-		}, &github.CommitFile{
-			Filename: github.String("/deployment.yaml"),
-		}, nil)
+		nil, &File{
+			Filename: "/deployment.yaml",
+		}, []*KubeValidatorConfigSchema{{}})
 
 	filePath, _ := filepath.Abs("../fixtures/deployment.yaml")
 	fileContents, _ := ioutil.ReadFile(filePath)
@@ -34,12 +34,10 @@ func TestAnnotationsForInvalidCandidates(t *testing.T) {
 	candidates = append(candidates, candidate)
 
 	candidate2 := NewCandidate(
-		&Context{
-			Event: &github.CheckSuiteEvent{},
-		}, &github.CommitFile{
-			Filename: github.String("deployment.yaml"),
-			BlobURL:  github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-		}, nil)
+		nil, &File{
+			Filename: "deployment.yaml",
+			BlobURL:  "https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml",
+		}, []*KubeValidatorConfigSchema{{}})
 
 	filePath2, _ := filepath.Abs("../fixtures/invalid.yaml")
 	fileContents2, _ := ioutil.ReadFile(filePath2)
@@ -52,8 +50,10 @@ func TestAnnotationsForInvalidCandidates(t *testing.T) {
 		{
 			Path:            github.String("deployment.yaml"),
 			BlobHRef:        github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			StartLine:       github.Int(1),
-			EndLine:         github.Int(1),
+			StartLine:       github.Int(6),
+			EndLine:         github.Int(6),
+			StartColumn:     github.Int(1),
+			EndColumn:       github.Int(4),
 			AnnotationLevel: github.String("failure"),
 			Title:           github.String("Error validating Deployment against master schema"),
 			Message:         github.String("selector: selector is required"),
@@ -62,22 +62,26 @@ func TestAnnotationsForInvalidCandidates(t *testing.T) {
 		{
 			Path:            github.String("deployment.yaml"),
 			BlobHRef:        github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			StartLine:       github.Int(1),
-			EndLine:         github.Int(1),
+			StartLine:       github.Int(6),
+			EndLine:         github.Int(6),
+			StartColumn:     github.Int(1),
+			EndColumn:       github.Int(4),
 			AnnotationLevel: github.String("failure"),
 			Title:           github.String("Error validating Deployment against master schema"),
-			Message:         github.String("spec.replicas: Invalid type. Expected: integer, given: string"),
-			RawDetails:      github.String("* context: (root).spec.replicas\n* expected: integer\n* field: spec.replicas\n* given: string\n"),
+			Message:         github.String("template: template is required"),
+			RawDetails:      github.String("* context: (root).spec\n* field: template\n* property: template\n"),
 		},
 		{
 			Path:            github.String("deployment.yaml"),
 			BlobHRef:        github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			StartLine:       github.Int(1),
-			EndLine:         github.Int(1),
+			StartLine:       github.Int(7),
+			EndLine:         github.Int(7),
+			StartColumn:     github.Int(3),
+			EndColumn:       github.Int(16),
 			AnnotationLevel: github.String("failure"),
 			Title:           github.String("Error validating Deployment against master schema"),
-			Message:         github.String("template: template is required"),
-			RawDetails:      github.String("* context: (root).spec\n* field: template\n* property: template\n"),
+			Message:         github.String("spec.replicas: Invalid type. Expected: integer, given: string"),
+			RawDetails:      github.String("* context: (root).spec.replicas\n* expected: integer\n* field: spec.replicas\n* given: string\n"),
 		}}
 
 	if len(annotations) != len(want) {
@@ -92,6 +96,8 @@ func TestAnnotationsForInvalidCandidates(t *testing.T) {
 }
 
 func TestLoadingCandidatesBytesFromGitHub(t *testing.T) {
+	defer useFixtureSchemas()()
+
 	client, mux, _, teardown := setup()
 	filePath, _ := filepath.Abs("../fixtures/invalid/deployment/multiple.yaml")
 	fileContents, _ := ioutil.ReadFile(filePath)
@@ -116,23 +122,15 @@ func TestLoadingCandidatesBytesFromGitHub(t *testing.T) {
 	schemas = append(schemas, schema)
 
 	candidate := NewCandidate(
-		&Context{
-			Ctx: &ctx,
-			Event: &github.CheckSuiteEvent{
-				CheckSuite: &github.CheckSuite{
-					HeadSHA: github.String("master"),
-				},
-				Repo: &github.Repository{
-					Name: github.String("o"),
-					Owner: &github.User{
-						Login: github.String("r"),
-					},
-				},
-			},
-			Github: client,
-		}, &github.CommitFile{
-			BlobURL:  github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			Filename: github.String("deployment.yaml"),
+		&GitHubSource{
+			Client: client,
+			Ctx:    ctx,
+			Owner:  "r",
+			Repo:   "o",
+			Ref:    "master",
+		}, &File{
+			BlobURL:  "https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml",
+			Filename: "deployment.yaml",
 		}, schemas)
 
 	var annotations Annotations
@@ -148,8 +146,10 @@ func TestLoadingCandidatesBytesFromGitHub(t *testing.T) {
 		{
 			Path:            github.String("deployment.yaml"),
 			BlobHRef:        github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			StartLine:       github.Int(1),
-			EndLine:         github.Int(1),
+			StartLine:       github.Int(8),
+			EndLine:         github.Int(8),
+			StartColumn:     github.Int(3),
+			EndColumn:       github.Int(26),
 			AnnotationLevel: github.String("failure"),
 			Title:           github.String("Error validating Deployment against master schema"),
 			Message:         github.String("extra: Additional property extra is not allowed"),
@@ -158,8 +158,10 @@ func TestLoadingCandidatesBytesFromGitHub(t *testing.T) {
 		{
 			Path:            github.String("deployment.yaml"),
 			BlobHRef:        github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			StartLine:       github.Int(1),
-			EndLine:         github.Int(1),
+			StartLine:       github.Int(9),
+			EndLine:         github.Int(9),
+			StartColumn:     github.Int(3),
+			EndColumn:       github.Int(21),
 			AnnotationLevel: github.String("failure"),
 			Title:           github.String("Error validating Deployment against master schema"),
 			Message:         github.String("spec.replicas: Invalid type. Expected: integer, given: string"),
@@ -168,8 +170,10 @@ func TestLoadingCandidatesBytesFromGitHub(t *testing.T) {
 		{
 			Path:            github.String("deployment.yaml"),
 			BlobHRef:        github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-			StartLine:       github.Int(1),
-			EndLine:         github.Int(1),
+			StartLine:       github.Int(23),
+			EndLine:         github.Int(23),
+			StartColumn:     github.Int(11),
+			EndColumn:       github.Int(42),
 			AnnotationLevel: github.String("failure"),
 			Title:           github.String("Error validating Deployment against master schema"),
 			Message:         github.String("extra-container: Additional property extra-container is not allowed"),
@@ -188,10 +192,17 @@ func TestLoadingCandidatesBytesFromGitHub(t *testing.T) {
 	return
 }
 
+// TestLineNumbers validates each file in fixtures/line-numbers, whose first
+// line lists where its annotations are expected as start-end lines or
+// line:column-line:column ranges
 func TestLineNumbers(t *testing.T) {
 	client, mux, _, teardown := setup()
 	defer teardown()
 
+	defaultLocation := DefaultSchemaStore.DefaultLocation
+	DefaultSchemaStore.DefaultLocation = fixtureSchemaLocation()
+	defer func() { DefaultSchemaStore.DefaultLocation = defaultLocation }()
+
 	filepath.Walk("../fixtures/line-numbers", func(path string, info os.FileInfo, err error) error {
 		if !info.IsDir() {
 
@@ -213,30 +224,19 @@ func TestLineNumbers(t *testing.T) {
 
 			ctx := context.Background()
 
-			schema := &KubeValidatorConfigSchema{
-				LineNumbers: true,
-			}
 			var schemas []*KubeValidatorConfigSchema
-			schemas = append(schemas, schema)
+			schemas = append(schemas, &KubeValidatorConfigSchema{})
 
 			candidate := NewCandidate(
-				&Context{
-					Ctx: &ctx,
-					Event: &github.CheckSuiteEvent{
-						CheckSuite: &github.CheckSuite{
-							HeadSHA: github.String("master"),
-						},
-						Repo: &github.Repository{
-							Name: github.String("o"),
-							Owner: &github.User{
-								Login: github.String("r"),
-							},
-						},
-					},
-					Github: client,
-				}, &github.CommitFile{
-					BlobURL:  github.String("https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml"),
-					Filename: github.String(fileBase),
+				&GitHubSource{
+					Client: client,
+					Ctx:    ctx,
+					Owner:  "r",
+					Repo:   "o",
+					Ref:    "master",
+				}, &File{
+					BlobURL:  "https://github.com/octocat/Hello-World/blob/837db83be4137ca555d9a5598d0a1ea2987ecfee/deployment.yaml",
+					Filename: fileBase,
 				}, schemas)
 
 			var annotations Annotations
@@ -265,11 +265,14 @@ func TestLineNumbers(t *testing.T) {
 			}
 
 			for i, val := range matches[1:] {
-				ln := strings.Split(val, "-")
-				startLine, _ := strconv.Atoi(ln[0])
-				endLine, _ := strconv.Atoi(ln[1])
-				if annotations[i].GetStartLine() != startLine || annotations[i].GetEndLine() != endLine {
-					t.Errorf("%s[%d]: (%s) expected annotation on lines %d-%d, got %d-%d", path, i, annotations[i].GetMessage(), startLine, endLine, annotations[i].GetStartLine(), annotations[i].GetEndLine())
+				got := fmt.Sprintf("%d-%d", annotations[i].GetStartLine(), annotations[i].GetEndLine())
+				if strings.Contains(val, ":") {
+					got = fmt.Sprintf("%d:%d-%d:%d", annotations[i].GetStartLine(), annotations[i].GetStartColumn(), annotations[i].GetEndLine(), annotations[i].GetEndColumn())
+				} else if annotations[i].StartColumn != nil || annotations[i].EndColumn != nil {
+					t.Errorf("%s[%d]: (%s) expected no columns on an annotation spanning lines %s", path, i, annotations[i].GetMessage(), got)
+				}
+				if got != val {
+					t.Errorf("%s[%d]: (%s) expected annotation at %s, got %s", path, i, annotations[i].GetMessage(), val, got)
 				}
 			}
 
@@ -277,3 +280,48 @@ func TestLineNumbers(t *testing.T) {
 		return nil
 	})
 }
+
+func TestCandidatesWithDifferentSchemasValidateConcurrently(t *testing.T) {
+	DefaultSchemaStore.AllowLocal = true
+	defer func() { DefaultSchemaStore.AllowLocal = false }()
+
+	missingLocation := fmt.Sprintf("%s/missing", fixtureSchemaLocation())
+	fileContents, _ := ioutil.ReadFile("../fixtures/invalid.yaml")
+
+	var candidates Candidates
+	for i := 0; i < 4*validationWorkers; i++ {
+		location := fixtureSchemaLocation()
+		if i%2 == 1 {
+			location = missingLocation
+		}
+		candidate := NewCandidate(nil, &File{
+			Filename: fmt.Sprintf("%d.yaml", i),
+		}, []*KubeValidatorConfigSchema{{Location: location}})
+		candidate.setBytes(&fileContents)
+		candidates = append(candidates, candidate)
+	}
+
+	annotations := candidates.Validate()
+
+	counts := make(map[string]int)
+	for _, annotation := range annotations {
+		counts[annotation.GetPath()]++
+		i, _ := strconv.Atoi(strings.TrimSuffix(annotation.GetPath(), ".yaml"))
+		missing := strings.HasPrefix(annotation.GetTitle(), "No master schema")
+		if i%2 == 1 && !missing {
+			t.Errorf("%s: expected a missing schema error, got %s", annotation.GetPath(), annotation.GetTitle())
+		}
+		if i%2 == 0 && missing {
+			t.Errorf("%s: expected a validation error, got %s", annotation.GetPath(), annotation.GetTitle())
+		}
+	}
+	for i := range candidates {
+		want := 3
+		if i%2 == 1 {
+			want = 1
+		}
+		if got := counts[fmt.Sprintf("%d.yaml", i)]; got != want {
+			t.Errorf("%d.yaml: expected %d annotations, got %d", i, want, got)
+		}
+	}
+}
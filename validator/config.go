@@ -3,42 +3,91 @@ package validator
 import (
 	"fmt"
 	"regexp"
+	"strings"
 
 	"github.com/bmatcuk/doublestar"
 	"github.com/google/go-github/github"
 	"github.com/instrumenta/kubeval/kubeval"
+	yaml "gopkg.in/yaml.v2"
 )
 
+// schemaForkPattern matches the locations of forks of kubernetes-json-schema
+var schemaForkPattern = regexp.MustCompile(`^https://raw\.githubusercontent\.com/[a-zA-Z][a-zA-Z\-]{0,38}/kubernetes-json-schema/master$`)
+
+// schemaVersionPattern matches the versions schemas are published for. The
+// patch version is optional as some OpenShift versions leave it out.
+var schemaVersionPattern = regexp.MustCompile(`^(master|\d+\.\d+(\.\d+)?)$`)
+
 // KubeValidatorConfig maps globs of Kubernetes config to schemas which validate
 // them.
 type KubeValidatorConfig struct {
 	APIVersion string                   `yaml:"apiversion"`
 	Kind       string                   `yaml:"kind"`
 	Spec       *KubeValidatorConfigSpec `yaml:"spec"`
+
+	crds customResourceSchemas
 }
 
 // KubeValidatorConfigSpec contains a list of manifests
 type KubeValidatorConfigSpec struct {
-	Manifests []*KubeValidatorConfigManifest `yaml:"manifests"`
+	// Scope is changed (the default) to validate the files changed by a
+	// check suite's Pull Requests, or all to validate every file in the
+	// repository, including on check suites for pushes without any
+	Scope string `yaml:"scope,omitempty"`
+
+	Manifests []*KubeValidatorConfigManifest  `yaml:"manifests"`
+	CRDs      []*KubeValidatorConfigCRD       `yaml:"crds,omitempty"`
+	Kustomize []*KubeValidatorConfigKustomize `yaml:"kustomize,omitempty"`
 }
 
-// KubeValidatorConfigManifest contains a glob and a list of schema
+// KubeValidatorConfigManifest contains a glob or a Helm chart and a list of
+// schema
 type KubeValidatorConfigManifest struct {
-	Glob    string                       `yaml:"glob"`
+	Glob    string                       `yaml:"glob,omitempty"`
+	Helm    *KubeValidatorConfigHelm     `yaml:"helm,omitempty"`
 	Schemas []*KubeValidatorConfigSchema `yaml:"schemas,omitempty"`
 }
 
+// KubeValidatorConfigCRD contains a glob matching files containing
+// CustomResourceDefinitions whose schemas are used to validate custom
+// resources
+type KubeValidatorConfigCRD struct {
+	Glob string `yaml:"glob"`
+}
+
 // KubeValidatorConfigSchema contains options for kubeval
 type KubeValidatorConfigSchema struct {
 	Name       string `yaml:"name,omitempty"`
 	SchemaFork string `yaml:"schemaFork,omitempty"`
 
-	Version     string `yaml:"version,omitempty"`
-	ConfigType  string `yaml:"type,omitempty"`
-	LineNumbers bool   `yaml:"lineNumbers,omitempty"`
+	// Location overrides SchemaFork with the URL of a copy of
+	// kubernetes-json-schema. file:// URLs may point at a directory or a
+	// tarball. Only locations DefaultSchemaStore allows are valid.
+	Location string `yaml:"schemaLocation,omitempty"`
+
+	// MissingSchemas sets the level of the annotation added when a resource
+	// has no schema: skip, warning or failure (the default)
+	MissingSchemas string `yaml:"missingSchemas,omitempty"`
+
+	// Strict prohibits properties which aren't in the schema. Defaults to
+	// true.
+	Strict *bool `yaml:"strict,omitempty"`
+
+	// IgnoreAdditionalProperties lists the dotted paths of properties which
+	// are reported as notices rather than failures when Strict is set. A *
+	// matches any single key or array index, and a path also covers every
+	// property beneath it.
+	IgnoreAdditionalProperties []string `yaml:"ignoreAdditionalProperties,omitempty"`
+
+	Version    string `yaml:"version,omitempty"`
+	ConfigType string `yaml:"type,omitempty"`
+
+	// LineNumbers annotates errors on the lines and columns they occur at
+	// rather than the first line of the file. Defaults to true.
+	LineNumbers *bool `yaml:"lineNumbers,omitempty"`
 }
 
-func (config *KubeValidatorConfig) matchingCandidates(context *Context, files []*github.CommitFile) []*Candidate {
+func (config *KubeValidatorConfig) matchingCandidates(source Source, files []*File) []*Candidate {
 	var candidates []*Candidate
 
 	for _, file := range files {
@@ -46,7 +95,8 @@ func (config *KubeValidatorConfig) matchingCandidates(context *Context, files []
 			spec := *config.Spec
 			for _, manifestConfig := range spec.Manifests {
 				if matched, _ := doublestar.Match(manifestConfig.Glob, file.GetFilename()); matched {
-					candidate := NewCandidate(context, file, manifestConfig.Schemas)
+					candidate := NewCandidate(source, file, manifestConfig.Schemas)
+					candidate.crds = config.crds
 					candidates = append(candidates, candidate)
 				}
 			}
@@ -56,15 +106,105 @@ func (config *KubeValidatorConfig) matchingCandidates(context *Context, files []
 	return candidates
 }
 
+// ScopeAll returns whether every file in the repository is validated rather
+// than only the changed files
+func (config *KubeValidatorConfig) ScopeAll() bool {
+	return config.Spec != nil && config.Spec.Scope == "all"
+}
+
+// files lists the files in scope at source
+func (config *KubeValidatorConfig) files(source Source) ([]*File, error) {
+	if config.ScopeAll() {
+		return source.Files()
+	}
+	return source.ChangedFiles()
+}
+
+// builtCandidates returns Candidates for the output of the Helm charts and
+// kustomize overlays built from any of the changed files, along with
+// CheckRunAnnotations describing any that couldn't be built
+func (config *KubeValidatorConfig) builtCandidates(source Source, changed []*File) (Candidates, Annotations) {
+	candidates, annotations := config.helmCandidates(source, changed)
+	kustomizeCandidates, kustomizeAnnotations := config.kustomizeCandidates(source, changed)
+	return append(candidates, kustomizeCandidates...), append(annotations, kustomizeAnnotations...)
+}
+
+// loadConfig reads the configuration from source, returning a
+// CheckRunAnnotation describing the problem if it isn't usable and an error if
+// it couldn't be read at all
+func loadConfig(source Source) (*KubeValidatorConfig, *github.CheckRunAnnotation, error) {
+	// TODO also support .github/kubevalidator.yml
+	configBytes, err := source.ReadFile(configPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	config, annotation := configOrAnnotation(configBytes, source.BlobURL(configPath))
+	return config, annotation, nil
+}
+
+// configOrAnnotation unmarshals the contents of a configuration file,
+// returning a CheckRunAnnotation describing the problem if it isn't usable
+func configOrAnnotation(b []byte, blobHRef string) (*KubeValidatorConfig, *github.CheckRunAnnotation) {
+	var href *string
+	if blobHRef != "" {
+		href = &blobHRef
+	}
+	config := &KubeValidatorConfig{}
+	err := yaml.Unmarshal(b, config)
+	if err != nil {
+		annotationsAdded.inc("failure", "config")
+		return nil, &github.CheckRunAnnotation{
+			Path:            github.String(configPath),
+			BlobHRef:        href,
+			StartLine:       github.Int(1),
+			EndLine:         github.Int(1),
+			AnnotationLevel: github.String("failure"),
+			Title:           github.String("Unmarshaling error"),
+			Message:         github.String(fmt.Sprintf("%+v", err)),
+		}
+	}
+	if !config.Valid() {
+		annotationsAdded.inc("failure", "config")
+		return nil, &github.CheckRunAnnotation{
+			Path:            github.String(configPath),
+			BlobHRef:        href,
+			StartLine:       github.Int(1),
+			EndLine:         github.Int(1),
+			AnnotationLevel: github.String("failure"),
+			Message:         github.String("Schema validation error"),
+		}
+	}
+	return config, nil
+}
+
 // Valid returns a boolean indicatating whether or not the config is well formed
 // TODO replace me with an actual schema
 func (config *KubeValidatorConfig) Valid() bool {
-	re := regexp.MustCompile(`(?mi)^[a-z][a-z\-]{0,38}$`)
 	if config.Spec != nil {
 		spec := *config.Spec
+		switch spec.Scope {
+		case "", "changed", "all":
+		default:
+			return false
+		}
 		for _, manifest := range spec.Manifests {
+			if manifest.Helm != nil && (manifest.Glob != "" || manifest.Helm.Chart == "") {
+				return false
+			}
 			for _, schema := range manifest.Schemas {
-				if schema.SchemaFork != "" && !re.MatchString(schema.SchemaFork) {
+				if !schema.valid() {
+					return false
+				}
+			}
+		}
+		for _, kustomize := range spec.Kustomize {
+			for _, overlay := range kustomize.Overlays {
+				if overlay == "" {
+					return false
+				}
+			}
+			for _, schema := range kustomize.Schemas {
+				if !schema.valid() {
 					return false
 				}
 			}
@@ -73,11 +213,90 @@ func (config *KubeValidatorConfig) Valid() bool {
 	return true
 }
 
-// SchemaLocation composes SchemaFork with a base url
+// valid returns whether the schema's options are well formed
+func (schema *KubeValidatorConfigSchema) valid() bool {
+	re := regexp.MustCompile(`(?mi)^[a-z][a-z\-]{0,38}$`)
+	if schema.SchemaFork != "" && !re.MatchString(schema.SchemaFork) {
+		return false
+	}
+	if schema.Version != "" && !schemaVersionPattern.MatchString(schema.Version) {
+		return false
+	}
+	switch schema.MissingSchemas {
+	case "", "skip", "warning", "failure":
+	default:
+		return false
+	}
+	for _, path := range schema.IgnoreAdditionalProperties {
+		if path == "" {
+			return false
+		}
+	}
+	if schema.Location != "" {
+		if !DefaultSchemaStore.Allowed(schema.Location) {
+			return false
+		}
+	}
+	return true
+}
+
+// SchemaLocation composes SchemaFork with a base url unless Location is set
 func (schema *KubeValidatorConfigSchema) SchemaLocation() string {
+	if schema.Location != "" {
+		return schema.Location
+	}
 	schemaFork := schema.SchemaFork
 	if schemaFork == "" {
 		return kubeval.DefaultSchemaLocation
 	}
 	return fmt.Sprintf("https://raw.githubusercontent.com/%s/kubernetes-json-schema/master", schemaFork)
 }
+
+// MissingSchemasLevel returns the level of the annotation added for resources
+// without a schema, or skip if none should be added
+func (schema *KubeValidatorConfigSchema) MissingSchemasLevel() string {
+	if schema.MissingSchemas == "" {
+		return "failure"
+	}
+	return schema.MissingSchemas
+}
+
+// StrictMode returns whether properties which aren't in the schema are
+// prohibited
+func (schema *KubeValidatorConfigSchema) StrictMode() bool {
+	if schema.Strict == nil {
+		return true
+	}
+	return *schema.Strict
+}
+
+// LineNumbersEnabled returns whether errors are annotated where they occur
+func (schema *KubeValidatorConfigSchema) LineNumbersEnabled() bool {
+	if schema.LineNumbers == nil {
+		return true
+	}
+	return *schema.LineNumbers
+}
+
+// ignoresAdditionalProperty returns whether the property at path, or one of
+// its parents, is listed in IgnoreAdditionalProperties
+func (schema *KubeValidatorConfigSchema) ignoresAdditionalProperty(path string) bool {
+	segments := strings.Split(path, ".")
+	for _, ignored := range schema.IgnoreAdditionalProperties {
+		patterns := strings.Split(ignored, ".")
+		if len(patterns) > len(segments) {
+			continue
+		}
+		matched := true
+		for i, pattern := range patterns {
+			if pattern != "*" && pattern != segments[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
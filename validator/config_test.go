@@ -5,7 +5,6 @@ import (
 	"path/filepath"
 	"testing"
 
-	"github.com/google/go-github/github"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -25,14 +24,14 @@ func TestValidConfigMatchesCandidates(t *testing.T) {
 		return
 	}
 
-	var files []*github.CommitFile
-	files = append(files, &github.CommitFile{
-		Filename: github.String("fixtures/deployment.yaml"),
+	var files []*File
+	files = append(files, &File{
+		Filename: "fixtures/deployment.yaml",
 	})
-	files = append(files, &github.CommitFile{
-		Filename: github.String("README.md"),
+	files = append(files, &File{
+		Filename: "README.md",
 	})
-	candidates := config.matchingCandidates(&Context{}, files)
+	candidates := config.matchingCandidates(nil, files)
 	if len(candidates) != 1 {
 		t.Errorf("Expected 1 match, got %d", len(candidates))
 	}
@@ -40,12 +39,12 @@ func TestValidConfigMatchesCandidates(t *testing.T) {
 
 func TestEmptyConfigMatchesNothing(t *testing.T) {
 	config := &KubeValidatorConfig{}
-	var files []*github.CommitFile
-	file := &github.CommitFile{
-		Filename: github.String("important.yaml"),
+	var files []*File
+	file := &File{
+		Filename: "important.yaml",
 	}
 	files = append(files, file)
-	candidates := config.matchingCandidates(&Context{}, files)
+	candidates := config.matchingCandidates(nil, files)
 	if len(candidates) != 0 {
 		t.Errorf("found unexpected candidates! %v", candidates)
 	}
@@ -66,3 +65,106 @@ func TestInvalidConfigIsNotValid(t *testing.T) {
 		return
 	}
 }
+
+func TestSchemasAreStrictByDefault(t *testing.T) {
+	config := &KubeValidatorConfig{}
+	err := yaml.Unmarshal([]byte("spec:\n  manifests:\n  - glob: '*.yaml'\n    schemas:\n    - version: master\n    - strict: false\n"), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schemas := config.Spec.Manifests[0].Schemas
+	if !schemas[0].StrictMode() {
+		t.Error("Expected schemas to be strict by default")
+	}
+	if schemas[1].StrictMode() {
+		t.Error("Expected strict: false to disable strict mode")
+	}
+}
+
+func TestIgnoresAdditionalProperties(t *testing.T) {
+	schema := &KubeValidatorConfigSchema{
+		IgnoreAdditionalProperties: []string{
+			"metadata.extra",
+			"spec.template.spec.containers.*.extra",
+		},
+	}
+	cases := map[string]bool{
+		"metadata.extra":                         true,
+		"metadata.extra.nested":                  true,
+		"metadata.other":                         false,
+		"extra":                                  false,
+		"spec.template.spec.containers.0.extra":  true,
+		"spec.template.spec.containers.12.extra": true,
+		"spec.template.spec.containers.0.other":  false,
+		"spec.template.spec.containers":          false,
+	}
+	for path, want := range cases {
+		if got := schema.ignoresAdditionalProperty(path); got != want {
+			t.Errorf("%s: expected %t, got %t", path, want, got)
+		}
+	}
+}
+
+func TestScope(t *testing.T) {
+	for scope, valid := range map[string]bool{"": true, "changed": true, "all": true, "everything": false} {
+		config := &KubeValidatorConfig{Spec: &KubeValidatorConfigSpec{Scope: scope}}
+		if config.Valid() != valid {
+			t.Errorf("Expected scope %q to be valid: %t", scope, valid)
+		}
+		if config.ScopeAll() != (scope == "all") {
+			t.Errorf("Expected ScopeAll to be %t for scope %q", scope == "all", scope)
+		}
+	}
+}
+
+func TestSchemaVersionsMustBeVersions(t *testing.T) {
+	cases := map[string]bool{
+		"":                      true,
+		"master":                true,
+		"1.13.0":                true,
+		"3.10":                  true,
+		"v1.13.0":               false,
+		"1.13.0/../..":          false,
+		"../../../../tmp/x":     false,
+		"master-standalone/../": false,
+	}
+	for version, valid := range cases {
+		config := &KubeValidatorConfig{Spec: &KubeValidatorConfigSpec{
+			Manifests: []*KubeValidatorConfigManifest{{
+				Glob:    "*.yaml",
+				Schemas: []*KubeValidatorConfigSchema{{Version: version}},
+			}},
+		}}
+		if config.Valid() != valid {
+			t.Errorf("Expected version %q to be valid: %t", version, valid)
+		}
+	}
+}
+
+func TestSchemaLocationsMustBeAllowed(t *testing.T) {
+	DefaultSchemaStore.AllowedLocations = []string{"https://schemas.example.com/kubernetes"}
+	defer func() { DefaultSchemaStore.AllowedLocations = nil }()
+
+	cases := map[string]bool{
+		"https://kubernetesjsonschema.dev":                  true,
+		"https://schemas.example.com/kubernetes":            true,
+		"https://schemas.example.com/kubernetes/v2":         true,
+		"https://schemas.example.com/other":                 false,
+		"http://169.254.169.254/latest/meta-data":           false,
+		"http://schemas.example.com/kubernetes":             false,
+		"file:///etc":                                       false,
+		"ftp://schemas.example.com/kubernetes":              false,
+		"https://schemas.example.com/kubernetes.evil.com/x": false,
+	}
+	for location, valid := range cases {
+		config := &KubeValidatorConfig{Spec: &KubeValidatorConfigSpec{
+			Manifests: []*KubeValidatorConfigManifest{{
+				Glob:    "*.yaml",
+				Schemas: []*KubeValidatorConfigSchema{{Location: location}},
+			}},
+		}}
+		if config.Valid() != valid {
+			t.Errorf("Expected schemaLocation %s to be valid: %t", location, valid)
+		}
+	}
+}
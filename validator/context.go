@@ -2,12 +2,12 @@ package validator
 
 import (
 	"context"
-	"log"
+	"crypto/sha256"
+	"fmt"
 	"reflect"
 	"time"
 
 	"github.com/google/go-github/github"
-	"github.com/pkg/errors"
 )
 
 // Context contains an event payload an a configured client
@@ -17,121 +17,260 @@ type Context struct {
 	Ctx       *context.Context
 	AppID     *int
 	AppGitHub *github.Client
+
+	// Dedupe is used to skip check suites which have already been validated
+	Dedupe DedupeStore
+
+	// CheckRunID is the ID of the check run in progress, if any
+	CheckRunID int64
+
+	// Log is stamped with details of the event being processed
+	Log *Logger
 }
 
-// Process handles webhook events kinda like Probot does
-func (c *Context) Process() bool {
+// logger returns the Context's Logger, falling back to DefaultLogger
+func (c *Context) logger() *Logger {
+	if c.Log == nil {
+		return DefaultLogger
+	}
+	return c.Log
+}
+
+// Process handles webhook events kinda like Probot does, returning whether
+// the event was acted on. Errors are either a *RetryableError or a
+// *PermanentError.
+func (c *Context) Process() (bool, error) {
 	switch e := c.Event.(type) {
 	case *github.CheckSuiteEvent:
-		c.ProcessCheckSuite(c.Event.(*github.CheckSuiteEvent))
-		return true
+		return c.ProcessCheckSuite(e)
 	case *github.PullRequestEvent:
-		return c.ProcessPrEvent(c.Event.(*github.PullRequestEvent))
+		return c.ProcessPrEvent(e)
 	case *github.CheckRunEvent:
-		return c.ProcessCheckRunEvent(c.Event.(*github.CheckRunEvent))
-	case *github.InstallationEvent:
+		return c.ProcessCheckRunEvent(e)
+	case *github.InstallationEvent, *github.InstallationRepositoriesEvent:
 		err := c.LogInstallationCount()
 		if err != nil {
-			log.Printf("%+v\n", err)
-			return false
+			return false, err
 		}
-		return true
-	case *github.InstallationRepositoriesEvent:
-		err := c.LogInstallationCount()
-		if err != nil {
-			log.Printf("%+v\n", err)
-			return false
-		}
-		return true
+		return true, nil
 	default:
-		log.Printf("ignoring %s\n", reflect.TypeOf(e).String())
+		c.logger().Debug("Ignoring event", "event", reflect.TypeOf(e).String())
+		return false, unsupportedEventError(e)
+	}
+}
+
+// Supported returns whether Process handles event
+func Supported(event interface{}) bool {
+	switch event.(type) {
+	case *github.CheckSuiteEvent, *github.PullRequestEvent, *github.CheckRunEvent, *github.InstallationEvent, *github.InstallationRepositoriesEvent:
+		return true
 	}
 	return false
 }
 
 // ProcessCheckSuite validates the Kubernetes YAML that has changed on checks
-// associated with PRs.
-func (c *Context) ProcessCheckSuite(e *github.CheckSuiteEvent) {
-	if *e.Action == "created" || *e.Action == "requested" || *e.Action == "rerequested" {
-		createCheckRunErr := c.createInitialCheckRun(e)
-		if createCheckRunErr != nil {
-			// TODO return a 500 to signal that retry is preferred
-			log.Println(errors.Wrap(createCheckRunErr, "Couldn't create check run"))
-			return
+// associated with PRs, or all of it when the configuration sets scope: all.
+// When it returns a *RetryableError the check run is
+// left in progress so that it's picked up again when the suite is retried.
+//
+// Suites for a head SHA which has already been validated with the same
+// configuration within the TTL of Dedupe are skipped, unless a user asked for
+// them to be re-run.
+func (c *Context) ProcessCheckSuite(e *github.CheckSuiteEvent) (processed bool, err error) {
+	if *e.Action != "created" && *e.Action != "requested" && *e.Action != "rerequested" {
+		return false, nil
+	}
+
+	start := time.Now()
+	defer func() {
+		switch {
+		case IsRetryable(err):
+			checkSuiteDuration.since(start, "retryable_error")
+		case err != nil:
+			checkSuiteDuration.since(start, "permanent_error")
+		case processed:
+			checkSuiteDuration.since(start, "processed")
+		default:
+			checkSuiteDuration.since(start, "skipped")
 		}
+	}()
 
-		checkRunStart := time.Now()
-		var annotations []*github.CheckRunAnnotation
-		var candidates Candidates
+	source := c.source(e)
+	configBytes, configErr := source.ReadFile(configPath)
+	if configErr != nil {
+		if err := githubError(configErr, "Couldn't load configuration"); IsRetryable(err) {
+			return false, err
+		}
+	}
 
-		config, configAnnotation, err := c.kubeValidatorConfigOrAnnotation(e)
-		if err != nil {
-			c.createConfigMissingCheckRun(&checkRunStart, e)
-			return
+	// Re-runs are only deduplicated by delivery, as users ask for them when
+	// the last run's result was wrong, like when schemas couldn't be loaded
+	if c.Dedupe != nil && c.CheckRunID == 0 && e.GetAction() != "rerequested" {
+		repo := fmt.Sprintf("%s/%s", e.Repo.GetOwner().GetLogin(), e.Repo.GetName())
+		key := fmt.Sprintf("check_suite:%s@%s:%x", repo, e.CheckSuite.GetHeadSHA(), sha256.Sum256(configBytes))
+		claimed, claimErr := c.Dedupe.Claim(key)
+		if claimErr != nil {
+			c.logger().Error("Couldn't claim check suite", "err", claimErr)
+		} else if !claimed {
+			c.logger().Info("Skipping check suite, it was already validated with the same configuration", "action", e.GetAction())
+			return false, nil
+		} else {
+			defer func() {
+				// Allow the suite to be retried
+				if IsRetryable(err) {
+					c.Dedupe.Release(key)
+				}
+			}()
 		}
-		if configAnnotation != nil {
-			annotations = append(annotations, configAnnotation)
-			c.createConfigInvalidCheckRun(&checkRunStart, e, annotations)
-			return
+	}
+
+	return c.validateCheckSuite(e, source, configBytes, configErr)
+}
+
+// validateCheckSuite annotates a check run with the results of validating
+// the files in scope using the configuration in configBytes
+func (c *Context) validateCheckSuite(e *github.CheckSuiteEvent, source *GitHubSource, configBytes []byte, configErr error) (bool, error) {
+	if c.CheckRunID == 0 {
+		createCheckRunErr := c.createInitialCheckRun(e)
+		if createCheckRunErr != nil {
+			return false, githubError(createCheckRunErr, "Couldn't create check run")
 		}
+	}
 
-		// Determine which files to validate
-		changedFileList, fileListError := c.changedFileList(e)
-		if fileListError != nil {
-			// TODO fail the checkrun instead
-			log.Println(fileListError)
-			return
+	defer func() {
+		if r := recover(); r != nil {
+			if c.CheckRunID != 0 {
+				c.cancelCheckRun(e, "an internal error occurred")
+			}
+			panic(r)
 		}
+	}()
 
-		candidates = config.matchingCandidates(c, changedFileList)
-		annotations = append(annotations, candidates.LoadBytes()...)
-		annotations = append(annotations, candidates.Validate()...)
+	var annotations []*github.CheckRunAnnotation
+	var candidates Candidates
 
-		// Annotate the PR
-		finalCheckRunErr := c.createFinalCheckRun(&checkRunStart, e, candidates, annotations)
-		if finalCheckRunErr != nil {
-			// TODO return a 500 to signal that retry is preferred
-			log.Println(errors.Wrap(finalCheckRunErr, "Couldn't create check run"))
-			return
+	if configErr != nil {
+		return true, githubError(c.finishConfigMissingCheckRun(e), "Couldn't update check run")
+	}
+	config, configAnnotation := configOrAnnotation(configBytes, source.BlobURL(configPath))
+	if configAnnotation != nil {
+		annotations = append(annotations, configAnnotation)
+		return true, githubError(c.finishConfigInvalidCheckRun(e, annotations), "Couldn't update check run")
+	}
+
+	// Determine which files to validate
+	fileList, fileListError := config.files(source)
+	if fileListError != nil {
+		err := githubError(fileListError, "Couldn't list files to validate")
+		if !IsRetryable(err) {
+			c.cancelCheckRun(e, "the files to validate couldn't be listed")
 		}
+		return false, err
+	}
+
+	annotations = append(annotations, config.loadCRDs(source)...)
+	candidates = config.matchingCandidates(source, fileList)
+	builtCandidates, builtAnnotations := config.builtCandidates(source, fileList)
+	candidates = append(candidates, builtCandidates...)
+	annotations = append(annotations, builtAnnotations...)
+	checkSuiteCandidates.observe(float64(len(candidates)))
+	annotations = append(annotations, candidates.LoadBytes()...)
+	annotations = append(annotations, candidates.Validate()...)
+
+	// Annotate the PR
+	filesDescription := source.ChangedFilesDescription()
+	if config.ScopeAll() {
+		filesDescription = fmt.Sprintf("Every file in the repository was listed using the Git Trees API as [`%s`](%s) sets `scope: all`.", configPath, source.BlobURL(configPath))
+	}
+	if source.Truncated() {
+		filesDescription += " GitHub truncated the list of files in this repository because it has too many, so some files may not have been validated."
+	}
+	finalCheckRunErr := c.finishFinalCheckRun(e, candidates, annotations, config.ScopeAll(), filesDescription)
+	if finalCheckRunErr != nil {
+		return false, githubError(finalCheckRunErr, "Couldn't update check run")
+	}
+	return true, nil
+}
+
+// Cancel concludes the check run in progress, if any, as cancelled
+func (c *Context) Cancel(reason string) error {
+	e, ok := c.Event.(*github.CheckSuiteEvent)
+	if !ok || c.CheckRunID == 0 {
+		return nil
+	}
+	return c.cancelCheckRun(e, reason)
+}
+
+// Abandon concludes the check run for a check suite which won't be processed
+// as cancelled, creating one first if processing never started so that the
+// suite can be re-run
+func (c *Context) Abandon(reason string) error {
+	e, ok := c.Event.(*github.CheckSuiteEvent)
+	if !ok {
+		return nil
+	}
+	if action := e.GetAction(); c.CheckRunID == 0 && action != "created" && action != "requested" && action != "rerequested" {
+		return nil
+	}
+	if c.CheckRunID == 0 {
+		if err := c.createInitialCheckRun(e); err != nil {
+			return githubError(err, "Couldn't create check run")
+		}
+	}
+	return githubError(c.cancelCheckRun(e, reason), "Couldn't cancel check run")
+}
+
+// source returns a Source which reads files from the head of the CheckSuite
+func (c *Context) source(e *github.CheckSuiteEvent) *GitHubSource {
+	var pullRequests []int
+	for _, pr := range e.CheckSuite.PullRequests {
+		pullRequests = append(pullRequests, pr.GetNumber())
+	}
+	return &GitHubSource{
+		Client:       c.Github,
+		Ctx:          *c.Ctx,
+		Owner:        e.Repo.GetOwner().GetLogin(),
+		Repo:         e.Repo.GetName(),
+		Ref:          e.CheckSuite.GetHeadSHA(),
+		HTMLURL:      e.Repo.GetHTMLURL(),
+		PullRequests: pullRequests,
+		Log:          c.logger(),
 	}
-	return
 }
 
 // ProcessPrEvent re-requests check suites on PRs when they're opened or re-opened
-func (c *Context) ProcessPrEvent(e *github.PullRequestEvent) bool {
+func (c *Context) ProcessPrEvent(e *github.PullRequestEvent) (bool, error) {
 	if *e.Action == "opened" || *e.Action == "reopened" {
 
 		results, _, err := c.Github.Checks.ListCheckSuitesForRef(*c.Ctx, e.Repo.GetOwner().GetLogin(), e.Repo.GetName(), e.PullRequest.Head.GetRef(), &github.ListCheckSuiteOptions{
 			AppID: c.AppID,
 		})
 		if err != nil {
-			log.Printf("%+v\n", err)
+			return false, githubError(err, "Couldn't list check suites")
 		}
 		if results.GetTotal() == 1 {
 			suite := results.CheckSuites[0]
 			_, err := c.Github.Checks.ReRequestCheckSuite(*c.Ctx, e.Repo.GetOwner().GetLogin(), e.Repo.GetName(), suite.GetID())
 			if err != nil {
-				log.Printf("%+v\n", err)
+				return false, githubError(err, "Couldn't re-request check suite")
 			}
-			return true
+			return true, nil
 		}
 	}
-	return false
+	return false, nil
 }
 
 // ProcessCheckRunEvent re-requests CheckSuites when a conatined CheckRun is rerequested
-func (c *Context) ProcessCheckRunEvent(e *github.CheckRunEvent) bool {
+func (c *Context) ProcessCheckRunEvent(e *github.CheckRunEvent) (bool, error) {
 	if *e.Action == "rerequested" {
 
 		_, err := c.Github.Checks.ReRequestCheckSuite(*c.Ctx, e.Repo.GetOwner().GetLogin(), e.Repo.GetName(), e.CheckRun.CheckSuite.GetID())
 		if err != nil {
-			log.Printf("%+v\n", err)
-			return false
+			return false, githubError(err, "Couldn't re-request check suite")
 		}
-		return true
+		return true, nil
 	}
-	return false
+	return false, nil
 }
 
 // LogInstallationCount logs the number of installations to help keep track of
@@ -142,13 +281,13 @@ func (c *Context) LogInstallationCount() error {
 		PerPage: 251,
 	})
 	if err != nil {
-		return err
+		return githubError(err, "Couldn't list installations")
 	}
 	installationCount := len(installations)
 	if installationCount > 250 {
-		log.Printf("%+v installations. get thee to the market!", installationCount)
+		c.logger().Info("get thee to the market!", "installations", installationCount)
 	} else {
-		log.Printf("%+v installations. keep it up!", installationCount)
+		c.logger().Info("keep it up!", "installations", installationCount)
 	}
 	return nil
 }
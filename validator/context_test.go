@@ -2,9 +2,11 @@ package validator
 
 import (
 	"context"
+	"encoding/base64"
 	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/google/go-github/github"
 )
@@ -51,7 +53,10 @@ func TestPullRequestTestingHappyPath(t *testing.T) {
 		testMethod(t, r, "POST")
 		testBody(t, r, "")
 	})
-	processed := context.Process()
+	processed, err := context.Process()
+	if err != nil {
+		t.Error(err)
+	}
 	if !processed {
 		t.Error("PR event was never processed")
 	}
@@ -102,7 +107,10 @@ func TestPullRequestTestingTooManyCheckSuites(t *testing.T) {
 			]
 		}`)
 	})
-	processed := context.Process()
+	processed, err := context.Process()
+	if err != nil {
+		t.Error(err)
+	}
 	if processed {
 		t.Error("PR event expected to be skipped")
 	}
@@ -139,9 +147,161 @@ func TestReRequestedCheckRunReRequestsTheCheckSuite(t *testing.T) {
 		testMethod(t, r, "POST")
 		testBody(t, r, "")
 	})
-	processed := context.Process()
+	processed, err := context.Process()
+	if err != nil {
+		t.Error(err)
+	}
 	if !processed {
 		t.Error("PR event was never processed")
 	}
 	return
 }
+
+func TestCheckSuiteUpdatesTheCheckRunItCreated(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	created := 0
+	mux.HandleFunc("/repos/o/r/check-runs", func(w http.ResponseWriter, r *http.Request) {
+		testMethod(t, r, "POST")
+		created++
+		fmt.Fprint(w, `{"id": 4}`)
+	})
+	mux.HandleFunc("/repos/o/r/contents/.github/kubevalidator.yaml", func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	})
+	updates := recordCheckRunUpdates(t, mux)
+
+	ctx := context.Background()
+	c := &Context{
+		Ctx:    &ctx,
+		Event:  testCheckSuiteEvent(),
+		Github: client,
+	}
+	if _, err := c.Process(); err != nil {
+		t.Fatal(err)
+	}
+
+	if created != 1 {
+		t.Errorf("Expected a single check run to be created, got %d", created)
+	}
+	if len(*updates) != 1 || (*updates)[0].GetConclusion() != "neutral" {
+		t.Errorf("Expected the check run to be concluded as neutral, got %s", github.Stringify(*updates))
+	}
+	if c.CheckRunID != 0 {
+		t.Errorf("Expected the check run to be finished, got %d", c.CheckRunID)
+	}
+}
+
+func TestCheckSuiteErrorsAreClassified(t *testing.T) {
+	for status, retryable := range map[int]bool{
+		http.StatusBadGateway:   true,
+		http.StatusUnauthorized: false,
+	} {
+		client, mux, _, teardown := setup()
+		mux.HandleFunc("/repos/o/r/check-runs", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			fmt.Fprint(w, `{"message": "nope"}`)
+		})
+
+		ctx := context.Background()
+		c := &Context{
+			Ctx:    &ctx,
+			Event:  testCheckSuiteEvent(),
+			Github: client,
+		}
+		_, err := c.Process()
+		if IsRetryable(err) != retryable || IsPermanent(err) == retryable {
+			t.Errorf("%d: expected retryable to be %t, got %T %v", status, retryable, err, err)
+		}
+		teardown()
+	}
+}
+
+func TestCheckSuiteRetriesWithTheSameCheckRun(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	created := 0
+	mux.HandleFunc("/repos/o/r/check-runs", func(w http.ResponseWriter, r *http.Request) {
+		created++
+		fmt.Fprint(w, `{"id": 4}`)
+	})
+	attempts := 0
+	mux.HandleFunc("/repos/o/r/contents/.github/kubevalidator.yaml", func(w http.ResponseWriter, r *http.Request) {
+		attempts++
+		if attempts == 1 {
+			http.Error(w, `{"message": "oops"}`, http.StatusBadGateway)
+			return
+		}
+		http.NotFound(w, r)
+	})
+	updates := recordCheckRunUpdates(t, mux)
+
+	ctx := context.Background()
+	c := &Context{
+		Ctx:    &ctx,
+		Event:  testCheckSuiteEvent(),
+		Github: client,
+	}
+	if _, err := c.Process(); !IsRetryable(err) {
+		t.Fatalf("Expected a retryable error, got %v", err)
+	}
+	if len(*updates) != 0 {
+		t.Error("Expected the check run to be left in progress")
+	}
+	if _, err := c.Process(); err != nil {
+		t.Fatal(err)
+	}
+	if created != 1 || len(*updates) != 1 {
+		t.Errorf("Expected 1 check run to be created and updated once, got %d and %d", created, len(*updates))
+	}
+}
+
+func TestRepeatedCheckSuitesAreSkipped(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	created := 0
+	mux.HandleFunc("/repos/o/r/check-runs", func(w http.ResponseWriter, r *http.Request) {
+		created++
+		fmt.Fprint(w, `{"id": 4}`)
+	})
+	config := "spec: {}"
+	mux.HandleFunc("/repos/o/r/contents/.github/kubevalidator.yaml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"type": "file", "encoding": "base64", "content": %q}`, base64.StdEncoding.EncodeToString([]byte(config)))
+	})
+	recordCheckRunUpdates(t, mux)
+
+	dedupe := &MemoryDedupeStore{TTL: time.Hour}
+	process := func(action string) bool {
+		ctx := context.Background()
+		e := testCheckSuiteEvent()
+		e.Action = github.String(action)
+		c := &Context{
+			Ctx:    &ctx,
+			Event:  e,
+			Github: client,
+			Dedupe: dedupe,
+		}
+		processed, err := c.Process()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return processed
+	}
+
+	if !process("requested") {
+		t.Error("Expected the first check suite to be processed")
+	}
+	if process("requested") {
+		t.Error("Expected the repeated check suite to be skipped")
+	}
+	if !process("rerequested") {
+		t.Error("Expected the check suite to be processed when it's re-run")
+	}
+	config = "spec:\n  manifests: []\n"
+	if !process("requested") {
+		t.Error("Expected the check suite to be processed once the configuration changed")
+	}
+	if created != 3 {
+		t.Errorf("Expected 3 check runs, got %d", created)
+	}
+}
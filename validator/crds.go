@@ -0,0 +1,240 @@
+package validator
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/bmatcuk/doublestar"
+	"github.com/google/go-github/github"
+	"github.com/xeipuuv/gojsonschema"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// customResourceSchemas maps the apiVersion and kind of custom resources to
+// the schemas declared by their CustomResourceDefinitions
+type customResourceSchemas map[string]*customResourceSchema
+
+// customResourceSchema holds a schema compiled with and without strict mode
+type customResourceSchema struct {
+	strict *gojsonschema.Schema
+	loose  *gojsonschema.Schema
+}
+
+func customResourceKey(apiVersion string, kind string) string {
+	return fmt.Sprintf("%s/%s", apiVersion, kind)
+}
+
+// schema returns the schema for a custom resource or nil if no
+// CustomResourceDefinition declared one
+func (s customResourceSchemas) schema(apiVersion string, kind string, strict bool) *gojsonschema.Schema {
+	crd, ok := s[customResourceKey(apiVersion, kind)]
+	if !ok {
+		return nil
+	}
+	if strict {
+		return crd.strict
+	}
+	return crd.loose
+}
+
+// loadCRDs reads the CustomResourceDefinitions matching the configured globs
+// from source so that custom resources can be validated, returning
+// CheckRunAnnotations for any that couldn't be loaded
+func (config *KubeValidatorConfig) loadCRDs(source Source) Annotations {
+	if config.Spec == nil || len(config.Spec.CRDs) == 0 {
+		return nil
+	}
+
+	var annotations Annotations
+	files, err := source.Files()
+	if err != nil {
+		annotationsAdded.inc("failure", "crd")
+		blobHRef := source.BlobURL(configPath)
+		annotation := &github.CheckRunAnnotation{
+			Path:            github.String(configPath),
+			StartLine:       github.Int(1),
+			EndLine:         github.Int(1),
+			AnnotationLevel: github.String("failure"),
+			Title:           github.String("Error listing CustomResourceDefinitions"),
+			Message:         github.String(fmt.Sprintf("%+v", err)),
+		}
+		if blobHRef != "" {
+			annotation.BlobHRef = &blobHRef
+		}
+		return append(annotations, annotation)
+	}
+
+	config.crds = customResourceSchemas{}
+	for _, file := range files {
+		for _, crdConfig := range config.Spec.CRDs {
+			if matched, _ := doublestar.Match(crdConfig.Glob, file.GetFilename()); matched {
+				annotations = append(annotations, config.crds.load(source, file)...)
+				break
+			}
+		}
+	}
+	return annotations
+}
+
+// load adds the schemas from every CustomResourceDefinition in file
+func (s customResourceSchemas) load(source Source, file *File) Annotations {
+	candidate := NewCandidate(source, file, nil)
+	if annotation := candidate.LoadBytes(); annotation != nil {
+		return Annotations{annotation}
+	}
+
+	var annotations Annotations
+	b := *candidate.bytes
+	lineBreak := detectLineBreak(b)
+	for _, document := range bytes.Split(b, []byte(lineBreak+"---"+lineBreak)) {
+		var spec interface{}
+		if err := yaml.Unmarshal(document, &spec); err != nil {
+			annotations = append(annotations, candidate.crdErrorAnnotation(err))
+			continue
+		}
+		body, _ := convertToStringKeys(spec).(map[string]interface{})
+		if kind, _ := body["kind"].(string); kind != "CustomResourceDefinition" {
+			continue
+		}
+		if apiVersion, _ := body["apiVersion"].(string); !strings.HasPrefix(apiVersion, "apiextensions.k8s.io/") {
+			continue
+		}
+		if err := s.add(body); err != nil {
+			annotations = append(annotations, candidate.crdErrorAnnotation(err))
+		}
+	}
+	return annotations
+}
+
+// add compiles the schemas declared by a CustomResourceDefinition, supporting
+// both the per-version schemas of apiextensions.k8s.io/v1 and the top level
+// validation of apiextensions.k8s.io/v1beta1
+func (s customResourceSchemas) add(crd map[string]interface{}) error {
+	spec, _ := crd["spec"].(map[string]interface{})
+	group, _ := spec["group"].(string)
+	names, _ := spec["names"].(map[string]interface{})
+	kind, _ := names["kind"].(string)
+	if group == "" || kind == "" {
+		return fmt.Errorf("CustomResourceDefinition is missing spec.group or spec.names.kind")
+	}
+
+	var sharedSchema interface{}
+	if validation, ok := spec["validation"].(map[string]interface{}); ok {
+		sharedSchema = validation["openAPIV3Schema"]
+	}
+
+	versionSchemas := make(map[string]interface{})
+	if version, ok := spec["version"].(string); ok && version != "" {
+		versionSchemas[version] = sharedSchema
+	}
+	versions, _ := spec["versions"].([]interface{})
+	for _, v := range versions {
+		version, _ := v.(map[string]interface{})
+		name, _ := version["name"].(string)
+		if name == "" {
+			continue
+		}
+		versionSchemas[name] = sharedSchema
+		if schema, ok := version["schema"].(map[string]interface{}); ok && schema["openAPIV3Schema"] != nil {
+			versionSchemas[name] = schema["openAPIV3Schema"]
+		}
+	}
+
+	for version, openAPIV3Schema := range versionSchemas {
+		if openAPIV3Schema == nil {
+			continue
+		}
+		strict, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(jsonSchemaFromOpenAPI(openAPIV3Schema, true, true)))
+		if err != nil {
+			return fmt.Errorf("Couldn't compile the schema for %s/%s %s: %s", group, version, kind, err)
+		}
+		loose, err := gojsonschema.NewSchema(gojsonschema.NewGoLoader(jsonSchemaFromOpenAPI(openAPIV3Schema, false, true)))
+		if err != nil {
+			return fmt.Errorf("Couldn't compile the schema for %s/%s %s: %s", group, version, kind, err)
+		}
+		s[customResourceKey(fmt.Sprintf("%s/%s", group, version), kind)] = &customResourceSchema{
+			strict: strict,
+			loose:  loose,
+		}
+	}
+	return nil
+}
+
+// jsonSchemaFromOpenAPI converts the OpenAPI v3 subset used by
+// CustomResourceDefinitions to a JSON schema gojsonschema understands,
+// prohibiting unknown fields the way the API server prunes them when strict
+// is set. The root of the schema always allows the fields every resource has.
+func jsonSchemaFromOpenAPI(openAPIV3Schema interface{}, strict bool, root bool) interface{} {
+	schema, ok := openAPIV3Schema.(map[string]interface{})
+	if !ok {
+		return openAPIV3Schema
+	}
+
+	converted := make(map[string]interface{}, len(schema))
+	for k, v := range schema {
+		switch k {
+		case "properties", "patternProperties", "definitions":
+			properties, _ := v.(map[string]interface{})
+			convertedProperties := make(map[string]interface{}, len(properties))
+			for name, property := range properties {
+				convertedProperties[name] = jsonSchemaFromOpenAPI(property, strict, false)
+			}
+			converted[k] = convertedProperties
+		case "items", "additionalProperties", "not":
+			converted[k] = jsonSchemaFromOpenAPI(v, strict, false)
+		case "allOf", "anyOf", "oneOf":
+			subschemas, _ := v.([]interface{})
+			convertedSubschemas := make([]interface{}, len(subschemas))
+			for i, subschema := range subschemas {
+				convertedSubschemas[i] = jsonSchemaFromOpenAPI(subschema, strict, false)
+			}
+			converted[k] = convertedSubschemas
+		default:
+			converted[k] = v
+		}
+	}
+
+	if nullable, _ := schema["nullable"].(bool); nullable {
+		if t, ok := schema["type"].(string); ok {
+			converted["type"] = []interface{}{t, "null"}
+		}
+	}
+
+	if root {
+		properties, _ := converted["properties"].(map[string]interface{})
+		if properties == nil {
+			properties = make(map[string]interface{})
+			converted["properties"] = properties
+		}
+		for _, field := range []string{"apiVersion", "kind"} {
+			if _, ok := properties[field]; !ok {
+				properties[field] = map[string]interface{}{"type": "string"}
+			}
+		}
+		if _, ok := properties["metadata"]; !ok {
+			properties["metadata"] = map[string]interface{}{"type": "object"}
+		}
+	}
+
+	preserveUnknownFields, _ := schema["x-kubernetes-preserve-unknown-fields"].(bool)
+	_, hasProperties := converted["properties"]
+	_, hasAdditionalProperties := converted["additionalProperties"]
+	if strict && hasProperties && !hasAdditionalProperties && !preserveUnknownFields {
+		converted["additionalProperties"] = false
+	}
+	return converted
+}
+
+func (c *Candidate) crdErrorAnnotation(err error) *github.CheckRunAnnotation {
+	annotationsAdded.inc("failure", "crd")
+	return &github.CheckRunAnnotation{
+		Path:            c.path(),
+		BlobHRef:        c.blobHRef(),
+		StartLine:       github.Int(1),
+		EndLine:         github.Int(1),
+		AnnotationLevel: github.String("failure"),
+		Title:           github.String(fmt.Sprintf("Error loading CustomResourceDefinitions from %s", c.file.GetFilename())),
+		Message:         github.String(fmt.Sprintf("%+v", err)),
+	}
+}
@@ -0,0 +1,70 @@
+package validator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func TestCustomResourcesValidateAgainstCRDsInTheRepository(t *testing.T) {
+	config := &KubeValidatorConfig{
+		Spec: &KubeValidatorConfigSpec{
+			Manifests: []*KubeValidatorConfigManifest{{
+				Glob: "fixtures/crds/crontab.yaml",
+				// Built in kinds would fail to load from here
+				Schemas: []*KubeValidatorConfigSchema{{Location: "http://127.0.0.1:0"}},
+			}},
+			CRDs: []*KubeValidatorConfigCRD{{
+				Glob: "fixtures/crds/*-crd.yaml",
+			}},
+		},
+	}
+	source := &DirectorySource{Dir: ".."}
+	if annotations := config.loadCRDs(source); len(annotations) != 0 {
+		t.Fatalf("Expected CRDs to load, got %s", github.Stringify(annotations))
+	}
+
+	candidates := Candidates(config.matchingCandidates(source, []*File{{Filename: "fixtures/crds/crontab.yaml"}}))
+	annotations := candidates.LoadBytes()
+	annotations = append(annotations, candidates.Validate()...)
+
+	var messages []string
+	for _, annotation := range annotations {
+		messages = append(messages, annotation.GetMessage())
+	}
+	want := []string{
+		"cronSpec: cronSpec is required",
+		"spec.replicas: Invalid type. Expected: [integer,null], given: string",
+		"unknown: Additional property unknown is not allowed",
+		"spec.schedule: Invalid type. Expected: string, given: integer",
+	}
+	if len(messages) != len(want) {
+		t.Fatalf("Expected %d annotations, got %s", len(want), github.Stringify(annotations))
+	}
+	for i := range want {
+		if messages[i] != want[i] {
+			t.Errorf("Expected %q, got %q", want[i], messages[i])
+		}
+	}
+}
+
+func TestInvalidCRDsAreAnnotated(t *testing.T) {
+	crds := customResourceSchemas{}
+	b := []byte("apiVersion: apiextensions.k8s.io/v1\nkind: CustomResourceDefinition\nspec:\n  names:\n    kind: Broken\n")
+
+	annotations := crds.load(&DirectorySource{}, &File{Filename: "missing.yaml"})
+	if len(annotations) != 1 || annotations[0].GetPath() != "missing.yaml" {
+		t.Errorf("Expected an annotation for a missing file, got %s", github.Stringify(annotations))
+	}
+
+	dir, _ := ioutil.TempDir("", "kubevalidator")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "crd.yaml"), b, 0644)
+	annotations = crds.load(&DirectorySource{Dir: dir}, &File{Filename: "crd.yaml"})
+	if len(annotations) != 1 || annotations[0].GetPath() != "crd.yaml" {
+		t.Errorf("Expected an annotation for an invalid CRD, got %s", github.Stringify(annotations))
+	}
+}
@@ -0,0 +1,137 @@
+package validator
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// DedupeStore remembers keys for a while so that repeated webhooks can be
+// skipped
+type DedupeStore interface {
+	// Claim records key, returning false if it was already recorded less
+	// than the store's TTL ago
+	Claim(key string) (bool, error)
+	// Release forgets key so that it can be claimed again
+	Release(key string) error
+}
+
+// MemoryDedupeStore is a DedupeStore which keeps keys in memory, so it's only
+// suitable for a single instance
+type MemoryDedupeStore struct {
+	TTL time.Duration
+
+	mu   sync.Mutex
+	keys map[string]time.Time
+}
+
+// Claim implements DedupeStore
+func (s *MemoryDedupeStore) Claim(key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if s.keys == nil {
+		s.keys = make(map[string]time.Time)
+	}
+	for k, claimed := range s.keys {
+		if now.Sub(claimed) >= s.TTL {
+			delete(s.keys, k)
+		}
+	}
+	if _, ok := s.keys[key]; ok {
+		return false, nil
+	}
+	s.keys[key] = now
+	return true, nil
+}
+
+// Release implements DedupeStore
+func (s *MemoryDedupeStore) Release(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, key)
+	return nil
+}
+
+// FileDedupeStore is a DedupeStore which keeps a file for each key in Dir,
+// allowing instances which share a volume to share keys and keys to survive
+// restarts
+type FileDedupeStore struct {
+	Dir string
+	TTL time.Duration
+
+	mu         sync.Mutex
+	lastPruned time.Time
+}
+
+func (s *FileDedupeStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(s.Dir, hex.EncodeToString(sum[:]))
+}
+
+// Claim implements DedupeStore
+func (s *FileDedupeStore) Claim(key string) (bool, error) {
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return false, errors.Wrap(err, "Couldn't create dedupe directory")
+	}
+	s.prune()
+
+	path := s.path(key)
+	if info, err := os.Stat(path); err == nil {
+		if time.Since(info.ModTime()) < s.TTL {
+			return false, nil
+		}
+		os.Remove(path)
+	}
+
+	// O_EXCL ensures only one instance claims the key
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("Couldn't claim %s", key))
+	}
+	defer f.Close()
+	if _, err := f.WriteString(key); err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("Couldn't claim %s", key))
+	}
+	return true, nil
+}
+
+// Release implements DedupeStore
+func (s *FileDedupeStore) Release(key string) error {
+	err := os.Remove(s.path(key))
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, fmt.Sprintf("Couldn't release %s", key))
+	}
+	return nil
+}
+
+// prune removes expired keys at most once per TTL
+func (s *FileDedupeStore) prune() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.lastPruned) < s.TTL {
+		return
+	}
+	s.lastPruned = time.Now()
+
+	files, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		if time.Since(file.ModTime()) >= s.TTL {
+			os.Remove(filepath.Join(s.Dir, file.Name()))
+		}
+	}
+}
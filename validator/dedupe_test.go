@@ -0,0 +1,58 @@
+package validator
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func testDedupeStore(t *testing.T, store DedupeStore, expire func()) {
+	if claimed, err := store.Claim("a"); err != nil || !claimed {
+		t.Fatalf("Expected to claim a, got %t %v", claimed, err)
+	}
+	if claimed, _ := store.Claim("a"); claimed {
+		t.Error("Expected a to have been claimed already")
+	}
+	if claimed, _ := store.Claim("b"); !claimed {
+		t.Error("Expected to claim b")
+	}
+
+	if err := store.Release("a"); err != nil {
+		t.Fatal(err)
+	}
+	if claimed, _ := store.Claim("a"); !claimed {
+		t.Error("Expected to claim a once it was released")
+	}
+
+	expire()
+	if claimed, _ := store.Claim("b"); !claimed {
+		t.Error("Expected to claim b once it expired")
+	}
+}
+
+func TestMemoryDedupeStore(t *testing.T) {
+	store := &MemoryDedupeStore{TTL: time.Hour}
+	testDedupeStore(t, store, func() {
+		store.TTL = 0
+	})
+}
+
+func TestFileDedupeStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dedupe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &FileDedupeStore{Dir: dir, TTL: time.Hour}
+	testDedupeStore(t, store, func() {
+		store.TTL = 0
+	})
+
+	// Keys are shared by stores using the same directory
+	other := &FileDedupeStore{Dir: dir, TTL: time.Hour}
+	if claimed, _ := other.Claim("b"); claimed {
+		t.Error("Expected b to have been claimed by the first store")
+	}
+}
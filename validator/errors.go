@@ -0,0 +1,67 @@
+package validator
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
+)
+
+// RetryableError wraps failures which may succeed if retried, like GitHub
+// server errors, rate limits and network problems
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+// PermanentError wraps failures which won't succeed however many times
+// they're retried, like bad signatures and unsupported events
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// IsRetryable returns whether err, or the error it wraps, is a RetryableError
+func IsRetryable(err error) bool {
+	_, ok := errors.Cause(err).(*RetryableError)
+	return ok
+}
+
+// IsPermanent returns whether err, or the error it wraps, is a PermanentError
+func IsPermanent(err error) bool {
+	_, ok := errors.Cause(err).(*PermanentError)
+	return ok
+}
+
+// unsupportedEventError is returned for webhook events kubevalidator doesn't
+// handle
+func unsupportedEventError(event interface{}) error {
+	return &PermanentError{Err: fmt.Errorf("unsupported event %s", reflect.TypeOf(event))}
+}
+
+// githubError classifies an error returned by the GitHub API, describing it
+// with message. Server errors, rate limits and anything that didn't get a
+// response at all are retryable, other responses are permanent.
+func githubError(err error, message string) error {
+	if err == nil {
+		return nil
+	}
+	wrapped := errors.Wrap(err, message)
+	switch e := errors.Cause(err).(type) {
+	case *github.RateLimitError, *github.AbuseRateLimitError:
+		return &RetryableError{Err: wrapped}
+	case *github.ErrorResponse:
+		if e.Response != nil && e.Response.StatusCode < http.StatusInternalServerError {
+			return &PermanentError{Err: wrapped}
+		}
+	}
+	return &RetryableError{Err: wrapped}
+}
@@ -2,13 +2,13 @@ package validator
 
 import (
 	"fmt"
-	"log"
+	"sort"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/go-github/github"
 	"github.com/pkg/errors"
-	yaml "gopkg.in/yaml.v2"
 )
 
 const (
@@ -16,10 +16,27 @@ const (
 	initialCheckRunSummary = "Validating..."
 	noMatchingFiles        = "No files to validate"
 	configPath             = ".github/kubevalidator.yaml"
+
+	// maxAnnotationsPerRequest is the most annotations the Checks API
+	// accepts in a single request
+	maxAnnotationsPerRequest = 50
+	// maxAnnotations is the most annotations added to a single check run
+	maxAnnotations = 1000
+	// maxSummaryLength is the longest summary the Checks API accepts
+	maxSummaryLength = 65535
+
+	// staleCheckRunAge is how long a check run may be in progress before
+	// it's considered abandoned
+	staleCheckRunAge = 15 * time.Minute
+	// sweepWindow is how recently a branch or PR must have been updated for
+	// its check runs to be swept
+	sweepWindow = 24 * time.Hour
+	// maxSweptRefs is the most refs whose check runs are swept at startup
+	maxSweptRefs = 200
 )
 
 // createInitialCheckRun contains the logic which sets the title and summary
-// of the check
+// of the check, remembering its ID so it can be finished later
 func (c *Context) createInitialCheckRun(e *github.CheckSuiteEvent) error {
 	checkRunOpt := github.CreateCheckRunOptions{
 		Name:       checkRunName,
@@ -33,65 +50,81 @@ func (c *Context) createInitialCheckRun(e *github.CheckSuiteEvent) error {
 		},
 	}
 
-	_, _, err := c.Github.Checks.CreateCheckRun(*c.Ctx, e.Repo.GetOwner().GetLogin(), e.Repo.GetName(), checkRunOpt)
+	checkRun, _, err := c.Github.Checks.CreateCheckRun(*c.Ctx, e.Repo.GetOwner().GetLogin(), e.Repo.GetName(), checkRunOpt)
 	if err != nil {
-		log.Println(errors.Wrap(err, "Couldn't create check run"))
+		c.logger().Error("Couldn't create check run", "err", err)
 		return err
 	}
+	c.CheckRunID = checkRun.GetID()
+	c.Log = c.logger().With("check_run", c.CheckRunID)
+	c.logger().Debug("Created check run")
 	return nil
 }
 
-func (c *Context) createConfigMissingCheckRun(startedAt *time.Time, e *github.CheckSuiteEvent) error {
-	checkRunOpt := github.CreateCheckRunOptions{
+// finishCheckRun completes the check run created by createInitialCheckRun
+func (c *Context) finishCheckRun(e *github.CheckSuiteEvent, conclusion string, output *github.CheckRunOutput) error {
+	_, _, err := c.Github.Checks.UpdateCheckRun(*c.Ctx, e.Repo.GetOwner().GetLogin(), e.Repo.GetName(), c.CheckRunID, github.UpdateCheckRunOptions{
 		Name:        checkRunName,
-		HeadBranch:  e.CheckSuite.GetHeadBranch(),
-		HeadSHA:     e.CheckSuite.GetHeadSHA(),
 		Status:      github.String("completed"),
-		Conclusion:  github.String("neutral"),
-		StartedAt:   &github.Timestamp{Time: *startedAt},
+		Conclusion:  github.String(conclusion),
 		CompletedAt: &github.Timestamp{Time: time.Now()},
-		Output: &github.CheckRunOutput{
-			Title:       github.String("No configuration"),
-			Summary:     github.String(fmt.Sprintf("kubevalidator needs a tiny bit of configuration to know where to find the Kubernetes YAML in your Repository.\n\n1. Check out the [documentation and examples](https://github.com/urcomputeringpal/kubevalidator#configuration).\n1. Add your configuration to [`.github/kubevalidator.yaml`](https://github.com/%s/%s/new/%s?filename=.github/kubevalidator.yaml)\n1. Profit???", e.Repo.GetOwner().GetLogin(), e.Repo.GetName(), e.CheckSuite.GetHeadBranch())),
-			Annotations: nil,
-		},
-	}
-
-	_, _, err := c.Github.Checks.CreateCheckRun(*c.Ctx, e.Repo.GetOwner().GetLogin(), e.Repo.GetName(), checkRunOpt)
+		Output:      output,
+	})
 	if err != nil {
-		log.Println(errors.Wrap(err, "Couldn't create check run"))
+		c.logger().Error("Couldn't update check run", "err", err)
 		return err
 	}
+	c.logger().Info("Completed check run", "conclusion", conclusion)
+	checkRunsCompleted.inc(conclusion)
+	c.CheckRunID = 0
 	return nil
 }
 
-func (c *Context) createConfigInvalidCheckRun(startedAt *time.Time, e *github.CheckSuiteEvent, annotations []*github.CheckRunAnnotation) error {
-	configURL := fmt.Sprintf("https://github.com/%s/%s/blob/%s/%s", e.Repo.GetOwner().GetLogin(), e.Repo.GetName(), e.CheckSuite.GetHeadBranch(), configPath)
-	checkRunOpt := github.CreateCheckRunOptions{
-		Name:        checkRunName,
-		HeadBranch:  e.CheckSuite.GetHeadBranch(),
-		HeadSHA:     e.CheckSuite.GetHeadSHA(),
-		Status:      github.String("completed"),
-		Conclusion:  github.String("failure"),
-		StartedAt:   &github.Timestamp{Time: *startedAt},
-		CompletedAt: &github.Timestamp{Time: time.Now()},
-		Output: &github.CheckRunOutput{
-			Title:       github.String("Configuration invalid"),
-			Summary:     github.String(fmt.Sprintf("Check out the [documentation and examples](https://github.com/urcomputeringpal/kubevalidator#configuration) and [update your configuration to match](%v). Please do [reach out](https://github.com/urcomputeringpal/kubevalidator/issues/new/choose) if you're having trouble or think you've have found a bug!", configURL)),
-			Annotations: annotations,
-		},
+// repoURL returns the web URL of repo, which is on a GitHub Enterprise
+// Server's host rather than github.com when kubevalidator is installed there
+func repoURL(repo *github.Repository) string {
+	if url := repo.GetHTMLURL(); url != "" {
+		return strings.TrimSuffix(url, "/")
 	}
+	return fmt.Sprintf("https://github.com/%s/%s", repo.GetOwner().GetLogin(), repo.GetName())
+}
 
-	_, _, err := c.Github.Checks.CreateCheckRun(*c.Ctx, e.Repo.GetOwner().GetLogin(), e.Repo.GetName(), checkRunOpt)
-	if err != nil {
-		log.Println(errors.Wrap(err, "Couldn't create check run"))
-		return err
-	}
-	return nil
+// blobURL links to path at ref in repo
+func blobURL(repo *github.Repository, ref string, path string) string {
+	return fmt.Sprintf("%s/blob/%s/%s", repoURL(repo), ref, path)
+}
+
+func (c *Context) finishConfigMissingCheckRun(e *github.CheckSuiteEvent) error {
+	return c.finishCheckRun(e, "neutral", &github.CheckRunOutput{
+		Title:       github.String("No configuration"),
+		Summary:     github.String(fmt.Sprintf("kubevalidator needs a tiny bit of configuration to know where to find the Kubernetes YAML in your Repository.\n\n1. Check out the [documentation and examples](https://github.com/urcomputeringpal/kubevalidator#configuration).\n1. Add your configuration to [`.github/kubevalidator.yaml`](%s/new/%s?filename=.github/kubevalidator.yaml)\n1. Profit???", repoURL(e.Repo), e.CheckSuite.GetHeadBranch())),
+		Annotations: nil,
+	})
+}
+
+func (c *Context) finishConfigInvalidCheckRun(e *github.CheckSuiteEvent, annotations []*github.CheckRunAnnotation) error {
+	configURL := blobURL(e.Repo, e.CheckSuite.GetHeadBranch(), configPath)
+	return c.finishCheckRun(e, "failure", &github.CheckRunOutput{
+		Title:       github.String("Configuration invalid"),
+		Summary:     github.String(fmt.Sprintf("Check out the [documentation and examples](https://github.com/urcomputeringpal/kubevalidator#configuration) and [update your configuration to match](%v). Please do [reach out](https://github.com/urcomputeringpal/kubevalidator/issues/new/choose) if you're having trouble or think you've have found a bug!", configURL)),
+		Annotations: annotations,
+	})
+}
+
+// cancelCheckRun completes a check run which couldn't be finished, asking
+// for it to be re-run
+func (c *Context) cancelCheckRun(e *github.CheckSuiteEvent, reason string) error {
+	return c.finishCheckRun(e, "cancelled", &github.CheckRunOutput{
+		Title:   github.String("Cancelled"),
+		Summary: github.String(fmt.Sprintf("kubevalidator couldn't finish this check: %s. Re-run it to try again.", reason)),
+	})
 }
 
-// createFinalCheckRun concludes the check run
-func (c *Context) createFinalCheckRun(startedAt *time.Time, e *github.CheckSuiteEvent, candidates Candidates, annotations []*github.CheckRunAnnotation) error {
+// finishFinalCheckRun concludes the check run, noting how the files were found
+// in its summary. allFiles is set when every file in the repository was
+// considered rather than only the changed files. Annotations are added in
+// batches as the Checks API only accepts a limited number per request.
+func (c *Context) finishFinalCheckRun(e *github.CheckSuiteEvent, candidates Candidates, annotations Annotations, allFiles bool, filesDescription string) error {
 	var checkRunConclusion string
 	var checkRunText string
 	var checkRunSummary string
@@ -99,128 +132,204 @@ func (c *Context) createFinalCheckRun(startedAt *time.Time, e *github.CheckSuite
 	if numFiles == 0 {
 		checkRunConclusion = "neutral"
 		checkRunText = noMatchingFiles
-		configURL := fmt.Sprintf("https://github.com/%s/%s/blob/%s/%s", e.Repo.GetOwner().GetLogin(), e.Repo.GetName(), e.CheckSuite.GetHeadBranch(), configPath)
-		checkRunSummary = fmt.Sprintf("None of the files changed on this Pull Request matched the configuration in [`%s`](%s). Please do [reach out](https://github.com/urcomputeringpal/kubevalidator/issues/new/choose) if you're having trouble or think you've have found a bug!", configPath, configURL)
+		configURL := blobURL(e.Repo, e.CheckSuite.GetHeadBranch(), configPath)
+		files := "the files changed on this Pull Request"
+		if allFiles {
+			files = "the files in this repository"
+		}
+		checkRunSummary = fmt.Sprintf("None of %s matched the configuration in [`%s`](%s). Please do [reach out](https://github.com/urcomputeringpal/kubevalidator/issues/new/choose) if you're having trouble or think you've have found a bug!", files, configPath, configURL)
 	} else {
 		// MVP pluralization
 		filesString := "files"
-		errorsString := "errors"
-
 		if numFiles == 1 {
 			filesString = "file"
 		}
 
-		if len(annotations) == 1 {
-			errorsString = "error"
-		}
-
-		if len(annotations) > 0 {
+		failures := annotations.Failures()
+		if failures > 0 {
 			checkRunConclusion = "failure"
 		} else {
 			checkRunConclusion = "success"
 		}
-		checkRunText = fmt.Sprintf("%d %s checked, %d %s", numFiles, filesString, len(annotations), errorsString)
+		checkRunText = fmt.Sprintf("%d %s checked, %s", numFiles, filesString, pluralize(failures, "error"))
 
+		counts := make(map[string]int)
+		blobHRefs := make(map[string]string)
+		for _, annotation := range annotations {
+			counts[annotation.GetPath()]++
+			blobHRefs[annotation.GetPath()] = annotation.GetBlobHRef()
+		}
 		var list []string
+		listed := make(map[string]bool)
 		for _, c := range candidates {
-			list = append(list, c.MarkdownListItem())
+			listed[c.file.GetFilename()] = true
+			if count := counts[c.file.GetFilename()]; count > 0 {
+				list = append(list, fmt.Sprintf("%s: %s", c.MarkdownListItem(), pluralize(count, "annotation")))
+			} else {
+				list = append(list, c.MarkdownListItem())
+			}
+		}
+		// Annotations on the output of Helm charts and kustomize overlays
+		// are moved to the files which produced it, so list those too
+		var others []string
+		for path := range counts {
+			if !listed[path] {
+				others = append(others, path)
+			}
+		}
+		sort.Strings(others)
+		for _, path := range others {
+			list = append(list, fmt.Sprintf("* [`./%s`](%s): %s", path, blobHRefs[path], pluralize(counts[path], "annotation")))
 		}
 		checkRunSummary = strings.Join(list, "\n")
 	}
 
-	checkRunOpt := github.CreateCheckRunOptions{
-		Name:        checkRunName,
-		HeadBranch:  e.CheckSuite.GetHeadBranch(),
-		HeadSHA:     e.CheckSuite.GetHeadSHA(),
-		Status:      github.String("completed"),
-		Conclusion:  &checkRunConclusion,
-		StartedAt:   &github.Timestamp{Time: *startedAt},
-		CompletedAt: &github.Timestamp{Time: time.Now()},
-		Output: &github.CheckRunOutput{
-			Title:       &checkRunText,
-			Summary:     &checkRunSummary,
-			Annotations: annotations,
-		},
+	var notes []string
+	if len(annotations) > maxAnnotations {
+		notes = append(notes, fmt.Sprintf("%s weren't added because GitHub limits check runs to %d annotations. Run [`kubevalidator validate`](https://github.com/urcomputeringpal/kubevalidator#validating-locally) to see them all.", pluralize(len(annotations)-maxAnnotations, "more annotation"), maxAnnotations))
+		annotations = annotations[:maxAnnotations]
 	}
+	if filesDescription != "" {
+		notes = append(notes, filesDescription)
+	}
+	checkRunSummary = truncateSummary(checkRunSummary, notes)
 
-	_, _, err := c.Github.Checks.CreateCheckRun(*c.Ctx, e.Repo.GetOwner().GetLogin(), e.Repo.GetName(), checkRunOpt)
-	if err != nil {
-		log.Println(errors.Wrap(err, "Couldn't create check run"))
-		return err
+	batches := annotations.batches(maxAnnotationsPerRequest)
+	for i := 1; i < len(batches); i++ {
+		_, _, err := c.Github.Checks.UpdateCheckRun(*c.Ctx, e.Repo.GetOwner().GetLogin(), e.Repo.GetName(), c.CheckRunID, github.UpdateCheckRunOptions{
+			Name: checkRunName,
+			Output: &github.CheckRunOutput{
+				Title:       &checkRunText,
+				Summary:     &checkRunSummary,
+				Annotations: batches[i],
+			},
+		})
+		if err != nil {
+			c.logger().Error("Couldn't add annotations to check run", "err", err)
+			return err
+		}
 	}
-	return nil
-}
 
-func (c *Context) bytesForFilename(e *github.CheckSuiteEvent, f string) (*[]byte, error) {
-	fileToValidate, _, _, err := c.Github.Repositories.GetContents(*c.Ctx, e.Repo.GetOwner().GetLogin(), e.Repo.GetName(), f, &github.RepositoryContentGetOptions{
-		Ref: e.CheckSuite.GetHeadSHA(),
+	// Conclude the check run along with the first batch once every other
+	// batch has been added
+	var firstBatch Annotations
+	if len(batches) > 0 {
+		firstBatch = batches[0]
+	}
+	return c.finishCheckRun(e, checkRunConclusion, &github.CheckRunOutput{
+		Title:       &checkRunText,
+		Summary:     &checkRunSummary,
+		Annotations: firstBatch,
 	})
-	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf("Couldn't load %s", f))
+}
+
+// truncateSummary appends notes to a summary listing one file per line,
+// leaving out as many files as needed to fit within the length GitHub
+// accepts and noting how many were left out
+func truncateSummary(summary string, notes []string) string {
+	if s := strings.Join(append([]string{summary}, notes...), "\n\n"); len(s) <= maxSummaryLength {
+		return s
 	}
 
-	contentToValidate, err := fileToValidate.GetContent()
-	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf("Couldn't load contents of %s", f))
+	omitted := func(count int) string {
+		return fmt.Sprintf("%s weren't listed because GitHub limits the length of check run summaries. Run [`kubevalidator validate`](https://github.com/urcomputeringpal/kubevalidator#validating-locally) to see them all.", pluralize(count, "more file"))
+	}
+	lines := strings.Split(summary, "\n")
+	// Leave room for the longest note about omitted files
+	length := len(strings.Join(append([]string{"", omitted(len(lines))}, notes...), "\n\n"))
+	kept := 0
+	for kept < len(lines) && length+len(lines[kept])+1 <= maxSummaryLength {
+		length += len(lines[kept]) + 1
+		kept++
 	}
 
-	b := []byte(contentToValidate)
-	return &b, nil
+	var parts []string
+	if kept > 0 {
+		parts = append(parts, strings.Join(lines[:kept], "\n"))
+	}
+	parts = append(parts, omitted(len(lines)-kept))
+	s := strings.Join(append(parts, notes...), "\n\n")
+	// Only notes which are far too long themselves could leave this too long
+	for len(s) > maxSummaryLength {
+		_, size := utf8.DecodeLastRuneInString(s)
+		s = s[:len(s)-size]
+	}
+	return s
 }
 
-func (c *Context) kubeValidatorConfigOrAnnotation(e *github.CheckSuiteEvent) (*KubeValidatorConfig, *github.CheckRunAnnotation, error) {
-	config := &KubeValidatorConfig{}
-	// TODO also support .github/kubevalidator.yml
-	configBlobHRef := fmt.Sprintf("https://github.com/%s/%s/blob/%s/%s", e.Repo.GetOwner().GetLogin(), e.Repo.GetName(), e.CheckSuite.GetHeadSHA(), configPath)
-	configBytes, err := c.bytesForFilename(e, configPath)
-	if err != nil {
-		return nil, nil, err
+// pluralize formats a count of things, MVP style
+func pluralize(count int, thing string) string {
+	if count == 1 {
+		return fmt.Sprintf("%d %s", count, thing)
+	}
+	return fmt.Sprintf("%d %ss", count, thing)
+}
+
+// sweepStaleCheckRuns concludes kubevalidator check runs which have been in
+// progress for longer than staleCheckRunAge, as the instance processing them
+// must have exited before finishing them. Only the heads of repo's default
+// branch and open PRs updated within sweepWindow are checked, and at most
+// limit of them. It returns how many were checked.
+func (c *Context) sweepStaleCheckRuns(repo *github.Repository, limit int) (int, error) {
+	owner := repo.GetOwner().GetLogin()
+	name := repo.GetName()
+	since := time.Now().Add(-sweepWindow)
+
+	var refs []string
+	if repo.GetPushedAt().After(since) {
+		refs = append(refs, repo.GetDefaultBranch())
 	}
-	if configBytes != nil {
-		err := yaml.Unmarshal(*configBytes, config)
+	opt := &github.PullRequestListOptions{
+		State:       "open",
+		Sort:        "updated",
+		Direction:   "desc",
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+list:
+	for len(refs) < limit {
+		prs, resp, err := c.Github.PullRequests.List(*c.Ctx, owner, name, opt)
 		if err != nil {
-			return nil, &github.CheckRunAnnotation{
-				Path:            github.String(configPath),
-				BlobHRef:        &configBlobHRef,
-				StartLine:       github.Int(1),
-				EndLine:         github.Int(1),
-				AnnotationLevel: github.String("failure"),
-				Title:           github.String("Unmarshaling error"),
-				Message:         github.String(fmt.Sprintf("%+v", err)),
-			}, nil
+			return 0, errors.Wrap(err, fmt.Sprintf("Couldn't list pull requests on %s/%s", owner, name))
+		}
+		for _, pr := range prs {
+			if pr.GetUpdatedAt().Before(since) || len(refs) >= limit {
+				break list
+			}
+			refs = append(refs, pr.GetHead().GetSHA())
 		}
-		if !config.Valid() {
-			return nil, &github.CheckRunAnnotation{
-				Path:            github.String(configPath),
-				BlobHRef:        &configBlobHRef,
-				StartLine:       github.Int(1),
-				EndLine:         github.Int(1),
-				AnnotationLevel: github.String("failure"),
-				Message:         github.String("Schema validation error"),
-			}, nil
+		if resp.NextPage == 0 {
+			break
 		}
+		opt.Page = resp.NextPage
 	}
-	return config, nil, nil
-}
 
-func (c *Context) changedFileList(e *github.CheckSuiteEvent) ([]*github.CommitFile, error) {
-	var prFiles []*github.CommitFile
-	for _, pr := range e.CheckSuite.PullRequests {
-		files, _, prListErr := c.Github.PullRequests.ListFiles(*c.Ctx, e.Repo.GetOwner().GetLogin(), e.Repo.GetName(), pr.GetNumber(), &github.ListOptions{})
-		if prListErr != nil {
-			return nil, errors.Wrap(prListErr, "Couldn't list files")
+	for _, ref := range refs {
+		results, _, err := c.Github.Checks.ListCheckRunsForRef(*c.Ctx, owner, name, ref, &github.ListCheckRunsOptions{
+			CheckName: github.String(checkRunName),
+			Status:    github.String("in_progress"),
+		})
+		if err != nil {
+			return 0, errors.Wrap(err, fmt.Sprintf("Couldn't list check runs for %s on %s/%s", ref, owner, name))
 		}
-		for _, file := range files {
-			switch status := file.GetStatus(); status {
-			// skip files that weren't added or changed
-			case "removed":
+		for _, checkRun := range results.CheckRuns {
+			if checkRun.GetApp().GetID() != int64(*c.AppID) || time.Since(checkRun.GetStartedAt().Time) < staleCheckRunAge {
 				continue
-			default:
-				prFiles = append(prFiles, file)
 			}
-
+			c.logger().Info("Marking check run as timed out", "repo", repo.GetFullName(), "check_run", checkRun.GetID())
+			_, _, err := c.Github.Checks.UpdateCheckRun(*c.Ctx, owner, name, checkRun.GetID(), github.UpdateCheckRunOptions{
+				Name:        checkRunName,
+				Status:      github.String("completed"),
+				Conclusion:  github.String("timed_out"),
+				CompletedAt: &github.Timestamp{Time: time.Now()},
+				Output: &github.CheckRunOutput{
+					Title:   github.String("Timed out"),
+					Summary: github.String(fmt.Sprintf("kubevalidator didn't finish this check within %s. Re-run it to try again.", staleCheckRunAge)),
+				},
+			})
+			if err != nil {
+				return 0, errors.Wrap(err, "Couldn't update check run")
+			}
 		}
-
 	}
-	return prFiles, nil
+	return len(refs), nil
 }
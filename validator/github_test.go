@@ -0,0 +1,277 @@
+package validator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func testCheckSuiteEvent() *github.CheckSuiteEvent {
+	return &github.CheckSuiteEvent{
+		Action: github.String("requested"),
+		CheckSuite: &github.CheckSuite{
+			HeadBranch: github.String("branch"),
+			HeadSHA:    github.String("s"),
+		},
+		Repo: &github.Repository{
+			Name:  github.String("r"),
+			Owner: &github.User{Login: github.String("o")},
+		},
+	}
+}
+
+func testAnnotations(path string, n int) Annotations {
+	var annotations Annotations
+	for i := 0; i < n; i++ {
+		annotations = append(annotations, &github.CheckRunAnnotation{
+			Path:            github.String(path),
+			StartLine:       github.Int(i + 1),
+			EndLine:         github.Int(i + 1),
+			AnnotationLevel: github.String("failure"),
+			Message:         github.String("broken"),
+		})
+	}
+	return annotations
+}
+
+// recordCheckRunUpdates records every update to check run 4 on o/r
+func recordCheckRunUpdates(t *testing.T, mux *http.ServeMux) *[]*github.CheckRun {
+	var updates []*github.CheckRun
+	mux.HandleFunc("/repos/o/r/check-runs/4", func(w http.ResponseWriter, r *http.Request) {
+		testMethod(t, r, "PATCH")
+		update := &github.CheckRun{}
+		if err := json.NewDecoder(r.Body).Decode(update); err != nil {
+			t.Error(err)
+		}
+		updates = append(updates, update)
+		fmt.Fprint(w, `{"id": 4}`)
+	})
+	return &updates
+}
+
+func TestFinalCheckRunAddsAnnotationsInBatches(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	updates := recordCheckRunUpdates(t, mux)
+
+	ctx := context.Background()
+	c := &Context{Github: client, Ctx: &ctx, CheckRunID: 4}
+	candidates := Candidates{
+		NewCandidate(nil, &File{Filename: "a.yaml"}, nil),
+		NewCandidate(nil, &File{Filename: "b.yaml"}, nil),
+	}
+	annotations := append(testAnnotations("a.yaml", 119), testAnnotations("b.yaml", 1)...)
+
+	if err := c.finishFinalCheckRun(testCheckSuiteEvent(), candidates, annotations, false, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*updates) != 3 {
+		t.Fatalf("Expected 3 updates, got %d", len(*updates))
+	}
+	// The first batch is added when the check run is completed
+	for i, want := range []int{50, 20, 50} {
+		output := (*updates)[i].GetOutput()
+		if got := len(output.Annotations); got != want {
+			t.Errorf("Request %d: expected %d annotations, got %d", i, want, got)
+		}
+		if output.GetTitle() != "2 files checked, 120 errors" {
+			t.Errorf("Request %d: unexpected title %q", i, output.GetTitle())
+		}
+		if !strings.Contains(output.GetSummary(), "* [`./a.yaml`](): 119 annotations\n* [`./b.yaml`](): 1 annotation") {
+			t.Errorf("Request %d: unexpected summary %q", i, output.GetSummary())
+		}
+	}
+	if status := (*updates)[2].GetStatus(); status != "completed" {
+		t.Errorf("Expected the last update to complete the check run, got %q", status)
+	}
+}
+
+func TestFinalCheckRunListsTheSourcesOfBuiltFiles(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	updates := recordCheckRunUpdates(t, mux)
+
+	ctx := context.Background()
+	c := &Context{Github: client, Ctx: &ctx, CheckRunID: 4}
+	candidates := Candidates{
+		NewCandidate(nil, &File{Filename: "overlay/kustomization.yaml"}, nil),
+	}
+	// Annotations on the built overlay are moved to the patches which set
+	// the properties they describe
+	annotations := append(testAnnotations("overlay/patch.yaml", 2), testAnnotations("base/deployment.yaml", 1)...)
+	annotations[2].BlobHRef = github.String("https://github.com/o/r/blob/s/base/deployment.yaml")
+
+	if err := c.finishFinalCheckRun(testCheckSuiteEvent(), candidates, annotations, false, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "* [`./overlay/kustomization.yaml`]()\n* [`./base/deployment.yaml`](https://github.com/o/r/blob/s/base/deployment.yaml): 1 annotation\n* [`./overlay/patch.yaml`](): 2 annotations"
+	if summary := (*updates)[0].GetOutput().GetSummary(); summary != want {
+		t.Errorf("Expected summary %q, got %q", want, summary)
+	}
+}
+
+func TestFinalCheckRunReportsAnnotationsPastTheLimit(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	updates := recordCheckRunUpdates(t, mux)
+
+	ctx := context.Background()
+	c := &Context{Github: client, Ctx: &ctx, CheckRunID: 4}
+	candidates := Candidates{NewCandidate(nil, &File{Filename: "a.yaml"}, nil)}
+
+	if err := c.finishFinalCheckRun(testCheckSuiteEvent(), candidates, testAnnotations("a.yaml", maxAnnotations+30), false, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	added := 0
+	for _, update := range *updates {
+		added += len(update.GetOutput().Annotations)
+	}
+	if added != maxAnnotations {
+		t.Errorf("Expected %d annotations to be added, got %d", maxAnnotations, added)
+	}
+	summary := (*updates)[0].GetOutput().GetSummary()
+	if !strings.Contains(summary, "1030 annotations") || !strings.Contains(summary, "30 more annotations weren't added") {
+		t.Errorf("Unexpected summary %q", summary)
+	}
+}
+
+func TestFinalCheckRunOmitsFilesPastTheSummaryLimit(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	updates := recordCheckRunUpdates(t, mux)
+
+	ctx := context.Background()
+	c := &Context{Github: client, Ctx: &ctx, CheckRunID: 4}
+	var candidates Candidates
+	for i := 0; i < 2000; i++ {
+		candidates = append(candidates, NewCandidate(nil, &File{Filename: fmt.Sprintf("config/kubernetes/default/deployments/%04d.yaml", i)}, nil))
+	}
+
+	if err := c.finishFinalCheckRun(testCheckSuiteEvent(), candidates, nil, false, "These files were listed by magic."); err != nil {
+		t.Fatal(err)
+	}
+
+	summary := (*updates)[0].GetOutput().GetSummary()
+	if len(summary) > maxSummaryLength {
+		t.Errorf("Expected the summary to be at most %d characters, got %d", maxSummaryLength, len(summary))
+	}
+	listed := strings.Count(summary, "\n* ") + 1
+	if listed == len(candidates) || !strings.Contains(summary, fmt.Sprintf("%d more files weren't listed", len(candidates)-listed)) {
+		t.Errorf("Expected a note about the %d omitted files, got %q", len(candidates)-listed, summary[len(summary)-500:])
+	}
+	if !strings.HasSuffix(summary, "\n\nThese files were listed by magic.") {
+		t.Errorf("Expected the description of the files to be kept, got %q", summary[len(summary)-500:])
+	}
+}
+
+func TestFinalCheckRunSucceedsWithOnlyWarnings(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	updates := recordCheckRunUpdates(t, mux)
+
+	ctx := context.Background()
+	c := &Context{Github: client, Ctx: &ctx, CheckRunID: 4}
+	candidates := Candidates{NewCandidate(nil, &File{Filename: "a.yaml"}, nil)}
+	annotations := testAnnotations("a.yaml", 1)
+	annotations[0].AnnotationLevel = github.String("warning")
+
+	if err := c.finishFinalCheckRun(testCheckSuiteEvent(), candidates, annotations, false, ""); err != nil {
+		t.Fatal(err)
+	}
+	if conclusion := (*updates)[0].GetConclusion(); conclusion != "success" {
+		t.Errorf("Expected success, got %q", conclusion)
+	}
+}
+
+func TestSweepTimesOutStaleCheckRuns(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	mux.HandleFunc("/repos/o/r/pulls", func(w http.ResponseWriter, r *http.Request) {
+		testFormValues(t, r, values{"state": "open", "sort": "updated", "direction": "desc", "per_page": "100"})
+		fmt.Fprintf(w, `[{"number": 1, "head": {"sha": "s"}, "updated_at": %q}, {"number": 2, "head": {"sha": "old"}, "updated_at": %q}]`,
+			time.Now().Format(time.RFC3339),
+			time.Now().Add(-2*sweepWindow).Format(time.RFC3339))
+	})
+	checked := make(map[string]bool)
+	mux.HandleFunc("/repos/o/r/commits/", func(w http.ResponseWriter, r *http.Request) {
+		checked[strings.Split(strings.TrimPrefix(r.URL.Path, "/repos/o/r/commits/"), "/")[0]] = true
+		fmt.Fprint(w, `{"total_count": 0, "check_runs": []}`)
+	})
+	mux.HandleFunc("/repos/o/r/commits/s/check-runs", func(w http.ResponseWriter, r *http.Request) {
+		checked["s"] = true
+		testFormValues(t, r, values{"check_name": "kubevalidator", "status": "in_progress"})
+		fmt.Fprintf(w, `{"total_count": 3, "check_runs": [
+			{"id": 4, "app": {"id": 1}, "started_at": %q},
+			{"id": 5, "app": {"id": 1}, "started_at": %q},
+			{"id": 6, "app": {"id": 2}, "started_at": %q}
+		]}`,
+			time.Now().Add(-time.Hour).Format(time.RFC3339),
+			time.Now().Format(time.RFC3339),
+			time.Now().Add(-time.Hour).Format(time.RFC3339))
+	})
+	updates := recordCheckRunUpdates(t, mux)
+
+	ctx := context.Background()
+	c := &Context{Github: client, Ctx: &ctx, AppID: github.Int(1)}
+	repo := &github.Repository{
+		Name:          github.String("r"),
+		Owner:         &github.User{Login: github.String("o")},
+		DefaultBranch: github.String("master"),
+		PushedAt:      &github.Timestamp{Time: time.Now().Add(-time.Hour)},
+	}
+	swept, err := c.sweepStaleCheckRuns(repo, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(*updates) != 1 || (*updates)[0].GetConclusion() != "timed_out" {
+		t.Errorf("Expected only check run 4 to time out, got %s", github.Stringify(*updates))
+	}
+	// The PR which hasn't been updated recently is left alone
+	if swept != 2 || !checked["master"] || !checked["s"] || checked["old"] {
+		t.Errorf("Expected the default branch and recently updated PR to be swept, got %d refs: %v", swept, checked)
+	}
+
+	checked = make(map[string]bool)
+	repo.PushedAt = &github.Timestamp{Time: time.Now().Add(-2 * sweepWindow)}
+	if swept, _ := c.sweepStaleCheckRuns(repo, 1); swept != 1 || checked["master"] {
+		t.Errorf("Expected only the PR to be swept, got %d refs: %v", swept, checked)
+	}
+}
+
+func TestConfigLinksPointAtTheRepositorysHost(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	updates := recordCheckRunUpdates(t, mux)
+
+	ctx := context.Background()
+	c := &Context{Github: client, Ctx: &ctx, CheckRunID: 4}
+	e := testCheckSuiteEvent()
+	e.Repo.HTMLURL = github.String("https://ghe.example.com/o/r")
+
+	if err := c.finishConfigMissingCheckRun(e); err != nil {
+		t.Fatal(err)
+	}
+	c.CheckRunID = 4
+	if err := c.finishConfigInvalidCheckRun(e, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	wants := []string{
+		"(https://ghe.example.com/o/r/new/branch?filename=.github/kubevalidator.yaml)",
+		"(https://ghe.example.com/o/r/blob/branch/.github/kubevalidator.yaml)",
+	}
+	for i, want := range wants {
+		if summary := (*updates)[i].GetOutput().GetSummary(); !strings.Contains(summary, want) {
+			t.Errorf("Expected summary to link to %s, got %s", want, summary)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package validator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/bradleyfalzon/ghinstallation"
+	"github.com/pkg/errors"
+)
+
+// healthCheck reports the status of a single check along with any details
+// worth showing alongside it
+type healthCheck map[string]interface{}
+
+func passed(details ...interface{}) healthCheck {
+	check := healthCheck{"status": "ok"}
+	for i := 0; i+1 < len(details); i += 2 {
+		check[fmt.Sprintf("%v", details[i])] = details[i+1]
+	}
+	return check
+}
+
+func failed(err error, details ...interface{}) healthCheck {
+	check := passed(details...)
+	check["status"] = "failed"
+	check["error"] = err.Error()
+	return check
+}
+
+// livez reports whether the process is able to serve requests at all. It
+// doesn't depend on anything outside the process so that instances aren't
+// restarted because GitHub or the schema location is unavailable.
+func (s *Server) livez(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, map[string]healthCheck{
+		"server": passed(),
+	})
+}
+
+// readyz reports whether webhooks can be processed: the private key must
+// parse and sign an App JWT, schemas must have been reachable when they were
+// last checked and there must be room in the queue
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]healthCheck)
+
+	itr, err := s.appsTransport(jwtRecorder{})
+	if err != nil {
+		checks["private_key"] = failed(err)
+		checks["app_jwt"] = failed(errors.New("the private key couldn't be loaded"))
+	} else {
+		checks["private_key"] = passed()
+		if err := mintJWT(itr); err != nil {
+			checks["app_jwt"] = failed(err)
+		} else {
+			checks["app_jwt"] = passed()
+		}
+	}
+
+	if err := s.schemas().CachedReachable(); err != nil {
+		checks["schemas"] = failed(err)
+	} else {
+		checks["schemas"] = passed()
+	}
+
+	if s.queue == nil {
+		checks["queue"] = failed(errors.New("the queue hasn't started"))
+	} else {
+		depth, capacity := s.queue.Depth(), s.queue.Capacity()
+		if capacity > 0 && depth >= capacity {
+			checks["queue"] = failed(errors.New("the queue is full"), "depth", depth, "capacity", capacity)
+		} else {
+			checks["queue"] = passed("depth", depth, "capacity", capacity)
+		}
+	}
+
+	writeHealth(w, checks)
+}
+
+// writeHealth responds with every check, failing unless they all passed
+func writeHealth(w http.ResponseWriter, checks map[string]healthCheck) {
+	status := "ok"
+	code := http.StatusOK
+	for _, check := range checks {
+		if check["status"] != "ok" {
+			status = "failed"
+			code = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+// jwtRecorder is a RoundTripper which answers every request itself so that
+// an AppsTransport can sign a JWT without contacting GitHub
+type jwtRecorder struct{}
+
+func (jwtRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     req.Header,
+		Body:       ioutil.NopCloser(strings.NewReader("")),
+		Request:    req,
+	}, nil
+}
+
+// mintJWT signs an App JWT using itr, which must wrap a jwtRecorder
+func mintJWT(itr *ghinstallation.AppsTransport) error {
+	req, err := http.NewRequest(http.MethodGet, itr.BaseURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := itr.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if !strings.HasPrefix(resp.Header.Get("Authorization"), "Bearer ") {
+		return errors.New("no JWT was signed")
+	}
+	return nil
+}
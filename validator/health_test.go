@@ -0,0 +1,171 @@
+package validator
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+type healthResponse struct {
+	Status string                            `json:"status"`
+	Checks map[string]map[string]interface{} `json:"checks"`
+}
+
+func testPrivateKeyFile(t *testing.T, dir string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "key.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readyz(t *testing.T, s *Server) (int, healthResponse) {
+	w := httptest.NewRecorder()
+	s.readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	var health healthResponse
+	if err := json.NewDecoder(w.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	return w.Code, health
+}
+
+func TestReadyWhenEveryCheckPasses(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubevalidator-health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &Server{
+		AppID:          1,
+		PrivateKeyFile: testPrivateKeyFile(t, dir),
+		Schemas:        &SchemaStore{DefaultLocation: "file://" + dir},
+		queue:          NewQueue(1, 1),
+	}
+	code, health := readyz(t, s)
+	if code != http.StatusOK || health.Status != "ok" {
+		t.Errorf("Expected to be ready, got %d: %+v", code, health)
+	}
+	for _, name := range []string{"private_key", "app_jwt", "schemas", "queue"} {
+		if status := health.Checks[name]["status"]; status != "ok" {
+			t.Errorf("Expected %s to pass, got %v", name, health.Checks[name])
+		}
+	}
+}
+
+func TestNotReadyWhenChecksFail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubevalidator-health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	badKey := filepath.Join(dir, "bad.pem")
+	if err := ioutil.WriteFile(badKey, []byte("nope"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	queue := NewQueue(1, 1)
+	queue.Enqueue(&Job{Run: func() {}})
+	s := &Server{
+		PrivateKeyFile: badKey,
+		Schemas:        &SchemaStore{DefaultLocation: "file://" + filepath.Join(dir, "missing")},
+		queue:          queue,
+	}
+	code, health := readyz(t, s)
+	if code != http.StatusServiceUnavailable || health.Status != "failed" {
+		t.Errorf("Expected not to be ready, got %d: %+v", code, health)
+	}
+	for _, name := range []string{"private_key", "app_jwt", "schemas", "queue"} {
+		if status := health.Checks[name]["status"]; status != "failed" {
+			t.Errorf("Expected %s to fail, got %v", name, health.Checks[name])
+		}
+		if health.Checks[name]["error"] == "" {
+			t.Errorf("Expected %s to explain why it failed", name)
+		}
+	}
+}
+
+func TestRemoteSchemasAreReachableFromTheCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubevalidator-health")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := &SchemaStore{DefaultLocation: "http://schemas.invalid", CacheDir: dir}
+	if err := store.Reachable(); err == nil {
+		t.Error("Expected an unreachable location with an empty cache to be unreachable")
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "schemas.invalid", "master-standalone"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Reachable(); err != nil {
+		t.Errorf("Expected a cached location to be reachable, got %s", err)
+	}
+}
+
+func TestReadinessUsesTheLastSchemaCheck(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	store := &SchemaStore{DefaultLocation: server.URL}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		store.WatchReachable(ctx, time.Hour)
+		close(done)
+	}()
+
+	// Wait for the first check to finish
+	for checked := false; !checked; time.Sleep(time.Millisecond) {
+		store.reachableMu.Lock()
+		checked = store.reachableChecked
+		store.reachableMu.Unlock()
+	}
+
+	s := &Server{Schemas: store, queue: NewQueue(1, 1)}
+	for i := 0; i < 3; i++ {
+		if _, health := readyz(t, s); health.Checks["schemas"]["status"] != "failed" {
+			t.Errorf("Expected the schemas check to fail, got %v", health.Checks["schemas"])
+		}
+	}
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if requests != 1 {
+		t.Errorf("Expected a single request to the schema location, got %d", requests)
+	}
+}
+
+func TestLiveWithoutDependencies(t *testing.T) {
+	w := httptest.NewRecorder()
+	(&Server{}).livez(w, httptest.NewRequest("GET", "/livez", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected %d, got %d", http.StatusOK, w.Code)
+	}
+}
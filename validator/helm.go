@@ -0,0 +1,519 @@
+package validator
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"unicode"
+
+	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonschema"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// KubeValidatorConfigHelm names a Helm chart whose rendered templates are
+// validated in place of raw files. Charts are rendered by kubevalidator
+// itself, which supports the Go template functions charts most commonly use
+// but not subcharts or hooks. Templates which can't be rendered because of
+// this are reported as notices rather than validated.
+type KubeValidatorConfigHelm struct {
+	// Chart is the directory containing Chart.yaml
+	Chart string `yaml:"chart"`
+
+	// Values lists files whose values override the chart's values.yaml, in
+	// order
+	Values []string `yaml:"values,omitempty"`
+
+	// ReleaseName and Namespace describe the release the chart is rendered
+	// for. They default to release-name and default.
+	ReleaseName string `yaml:"releaseName,omitempty"`
+	Namespace   string `yaml:"namespace,omitempty"`
+}
+
+var (
+	// templateErrorPattern locates errors from text/template, e.g.
+	// "template: chart/templates/deployment.yaml:7:12: executing ..."
+	templateErrorPattern = regexp.MustCompile(`template: ([^:\s]+):(\d+)(?::\d+)?: `)
+
+	// sourceMapPattern matches the comments mapping rendered lines back to
+	// the template they came from, e.g. "# Source: templates/service.yaml:12".
+	// The line of the template is optional, as in the comments Helm writes.
+	sourceMapPattern = regexp.MustCompile(`^\s*#\s*Source:\s*(\S+?)(?::(\d+))?\s*$`)
+
+	// unsupportedFuncPattern matches errors from templates calling functions
+	// kubevalidator doesn't provide
+	unsupportedFuncPattern = regexp.MustCompile(`function "([^"]+)" not defined`)
+
+	// missingTemplatePattern matches errors from templates including a
+	// template which isn't defined, as those defined by subcharts aren't
+	missingTemplatePattern = regexp.MustCompile(`no (?:such )?template "([^"]+)"`)
+)
+
+// helmCandidates renders the charts containing any of the changed files,
+// returning a Candidate for each rendered template along with
+// CheckRunAnnotations describing charts which couldn't be rendered
+func (config *KubeValidatorConfig) helmCandidates(source Source, changed []*File) (Candidates, Annotations) {
+	if config.Spec == nil {
+		return nil, nil
+	}
+
+	var manifests []*KubeValidatorConfigManifest
+	for _, manifestConfig := range config.Spec.Manifests {
+		if manifestConfig.Helm != nil && manifestConfig.Helm.changed(changed) {
+			manifests = append(manifests, manifestConfig)
+		}
+	}
+	if len(manifests) == 0 {
+		return nil, nil
+	}
+
+	files, err := source.Files()
+	if err != nil {
+		annotationsAdded.inc("failure", "helm")
+		annotation := &github.CheckRunAnnotation{
+			Path:            github.String(configPath),
+			StartLine:       github.Int(1),
+			EndLine:         github.Int(1),
+			AnnotationLevel: github.String("failure"),
+			Title:           github.String("Error listing Helm charts"),
+			Message:         github.String(fmt.Sprintf("%+v", err)),
+		}
+		if blobHRef := source.BlobURL(configPath); blobHRef != "" {
+			annotation.BlobHRef = &blobHRef
+		}
+		return nil, Annotations{annotation}
+	}
+
+	var candidates Candidates
+	var annotations Annotations
+	for _, manifestConfig := range manifests {
+		rendered, chartAnnotations := manifestConfig.Helm.render(source, files)
+		annotations = append(annotations, chartAnnotations...)
+		for _, r := range rendered {
+			candidate := NewCandidate(source, &File{
+				Filename: r.template,
+				BlobURL:  source.BlobURL(r.template),
+			}, manifestConfig.Schemas)
+			candidate.crds = config.crds
+			candidate.setBytes(&r.bytes)
+			candidate.origin = r.sourceMap
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates, annotations
+}
+
+// dir returns the chart's directory as a prefix of the paths of the files
+// within it
+func (h *KubeValidatorConfigHelm) dir() string {
+	dir := path.Clean(strings.Trim(h.Chart, "/"))
+	if dir == "." {
+		return ""
+	}
+	return dir + "/"
+}
+
+// changed returns whether any of files are part of the chart or its values
+func (h *KubeValidatorConfigHelm) changed(files []*File) bool {
+	dir := h.dir()
+	for _, file := range files {
+		filename := file.GetFilename()
+		if strings.HasPrefix(filename, dir) {
+			return true
+		}
+		for _, values := range h.Values {
+			if filename == path.Clean(values) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// renderedTemplate is the output of a single template of a chart
+type renderedTemplate struct {
+	template  string
+	bytes     []byte
+	sourceMap *sourceMap
+}
+
+// chart is a Helm chart read from a Source
+type chart struct {
+	source   Source
+	dir      string
+	metadata map[string]interface{}
+	values   map[string]interface{}
+	// paths lists the paths of the chart's files relative to dir
+	paths map[string]bool
+	// files maps the paths of the files which have been read to their
+	// contents. Files other than templates and values are only read when a
+	// template asks for them.
+	files map[string][]byte
+}
+
+// render reads the chart from source and renders each of its templates
+func (h *KubeValidatorConfigHelm) render(source Source, files []*File) ([]renderedTemplate, Annotations) {
+	c, annotations := h.load(source, files)
+	if c == nil {
+		return nil, annotations
+	}
+
+	if c.hasSubcharts() {
+		annotations = append(annotations, c.noticeAnnotation(source, c.dir+"Chart.yaml", 1, "Subcharts weren't rendered", "kubevalidator renders charts itself and doesn't render subcharts, so only this chart's own templates were validated."))
+	}
+
+	budget := newRenderBudget()
+	t := template.New(c.dir).Option("missingkey=zero")
+	t.Funcs(helmFuncs(t, budget))
+
+	var names []string
+	for name := range c.paths {
+		if strings.HasPrefix(name, "templates/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	parsed := true
+	for _, name := range names {
+		if _, err := t.New(c.dir + name).Parse(string(c.files[name])); err != nil {
+			annotations = append(annotations, c.errorAnnotation(source, c.dir+name, "Error parsing Helm template", err))
+			parsed = false
+		}
+	}
+	if !parsed {
+		return nil, annotations
+	}
+
+	var rendered []renderedTemplate
+	for _, name := range names {
+		base := path.Base(name)
+		if strings.HasPrefix(base, "_") || base == "NOTES.txt" {
+			continue
+		}
+		filename := c.dir + name
+		buffer := &budgetWriter{budget: budget}
+		if err := budget.execute(t, buffer, filename, c.data(h, name)); err != nil {
+			annotations = append(annotations, c.errorAnnotation(source, filename, "Error rendering Helm template", err))
+			if budget.expired() != nil {
+				// The template may still be executing, so nothing more
+				// can be rendered with t
+				return nil, annotations
+			}
+			continue
+		}
+		b := bytes.Replace(buffer.Bytes(), []byte("<no value>"), nil, -1)
+		if len(bytes.TrimSpace(b)) == 0 {
+			continue
+		}
+		rendered = append(rendered, renderedTemplate{
+			template:  filename,
+			bytes:     b,
+			sourceMap: c.sourceMap(source, b, filename),
+		})
+	}
+	return rendered, annotations
+}
+
+// load reads the chart's files, metadata and values from source, returning
+// CheckRunAnnotations describing any that couldn't be loaded
+func (h *KubeValidatorConfigHelm) load(source Source, files []*File) (*chart, Annotations) {
+	c := &chart{source: source, dir: h.dir(), paths: map[string]bool{}, files: map[string][]byte{}}
+	for _, file := range files {
+		filename := file.GetFilename()
+		if !strings.HasPrefix(filename, c.dir) {
+			continue
+		}
+		name := strings.TrimPrefix(filename, c.dir)
+		c.paths[name] = true
+		if !strings.HasPrefix(name, "templates/") && name != "Chart.yaml" && name != "values.yaml" {
+			continue
+		}
+		if _, err := c.read(name); err != nil {
+			return nil, Annotations{c.errorAnnotation(source, filename, "Error loading Helm chart", err)}
+		}
+	}
+
+	chartFile := c.dir + "Chart.yaml"
+	b, ok := c.files["Chart.yaml"]
+	if !ok {
+		annotation := c.errorAnnotation(source, configPath, "Error loading Helm chart", errors.Errorf("Couldn't find %s", chartFile))
+		return nil, Annotations{annotation}
+	}
+	metadata, err := parseValues(b)
+	if err != nil {
+		return nil, Annotations{c.errorAnnotation(source, chartFile, "Error loading Helm chart", err)}
+	}
+	// Templates refer to Chart.yaml's fields by their Go names, e.g.
+	// .Chart.AppVersion
+	c.metadata = map[string]interface{}{}
+	for k, v := range metadata {
+		if k == "" {
+			continue
+		}
+		runes := []rune(k)
+		runes[0] = unicode.ToUpper(runes[0])
+		c.metadata[string(runes)] = v
+	}
+
+	c.values = map[string]interface{}{}
+	if b, ok := c.files["values.yaml"]; ok {
+		values, err := parseValues(b)
+		if err != nil {
+			return nil, Annotations{c.errorAnnotation(source, c.dir+"values.yaml", "Error loading Helm values", err)}
+		}
+		mergeValues(c.values, values)
+	}
+	var annotations Annotations
+	for _, filename := range h.Values {
+		filename = path.Clean(filename)
+		b, err := source.ReadFile(filename)
+		if err == nil {
+			var values map[string]interface{}
+			if values, err = parseValues(b); err == nil {
+				mergeValues(c.values, values)
+				continue
+			}
+		}
+		annotations = append(annotations, c.errorAnnotation(source, filename, "Error loading Helm values", err))
+	}
+	if len(annotations) > 0 {
+		return nil, annotations
+	}
+	return c, nil
+}
+
+// data returns the object the template named name is rendered with
+func (c *chart) data(h *KubeValidatorConfigHelm, name string) map[string]interface{} {
+	releaseName := h.ReleaseName
+	if releaseName == "" {
+		releaseName = "release-name"
+	}
+	namespace := h.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	return map[string]interface{}{
+		"Values": c.values,
+		"Chart":  c.metadata,
+		"Release": map[string]interface{}{
+			"Name":      releaseName,
+			"Namespace": namespace,
+			"Service":   "Helm",
+			"Revision":  1,
+			"IsInstall": true,
+			"IsUpgrade": false,
+		},
+		"Capabilities": map[string]interface{}{
+			"KubeVersion": map[string]interface{}{
+				"Version":    "v1.13.0",
+				"GitVersion": "v1.13.0",
+				"Major":      "1",
+				"Minor":      "13",
+			},
+			"APIVersions": helmAPIVersions{},
+		},
+		"Template": map[string]interface{}{
+			"Name":     c.dir + name,
+			"BasePath": c.dir + "templates",
+		},
+		"Files": chartFiles{chart: c},
+	}
+}
+
+// read returns the contents of the chart's file at name, reading it from
+// the chart's Source the first time it's asked for
+func (c *chart) read(name string) ([]byte, error) {
+	if b, ok := c.files[name]; ok {
+		return b, nil
+	}
+	if !c.paths[name] {
+		return nil, errors.Errorf("Couldn't find %s in the chart", name)
+	}
+	b, err := c.source.ReadFile(c.dir + name)
+	if err != nil {
+		return nil, err
+	}
+	c.files[name] = b
+	return b, nil
+}
+
+// hasSubcharts returns whether the chart depends on other charts
+func (c *chart) hasSubcharts() bool {
+	if c.paths["requirements.yaml"] {
+		return true
+	}
+	if dependencies, ok := c.metadata["Dependencies"].([]interface{}); ok && len(dependencies) > 0 {
+		return true
+	}
+	for name := range c.paths {
+		if strings.HasPrefix(name, "charts/") {
+			return true
+		}
+	}
+	return false
+}
+
+// errorAnnotation describes a problem loading or rendering the chart on the
+// line of filename given by err, if any. Templates kubevalidator can't render
+// because they use a function it doesn't support or a template defined by a
+// subchart are described with a notice rather than a failure.
+func (c *chart) errorAnnotation(source Source, filename string, title string, err error) *github.CheckRunAnnotation {
+	line := 1
+	if match := templateErrorPattern.FindStringSubmatch(err.Error()); match != nil {
+		if c.paths[strings.TrimPrefix(match[1], c.dir)] {
+			filename = match[1]
+			line, _ = strconv.Atoi(match[2])
+		}
+	}
+	if match := unsupportedFuncPattern.FindStringSubmatch(err.Error()); match != nil {
+		return c.noticeAnnotation(source, filename, line, "Helm template wasn't validated", fmt.Sprintf("kubevalidator renders charts itself and doesn't support the %s function, so templates using it weren't validated.", match[1]))
+	}
+	if match := missingTemplatePattern.FindStringSubmatch(err.Error()); match != nil && c.hasSubcharts() {
+		return c.noticeAnnotation(source, filename, line, "Helm template wasn't validated", fmt.Sprintf("%s isn't defined by this chart and kubevalidator doesn't render subcharts, so templates using it weren't validated.", match[1]))
+	}
+	annotationsAdded.inc("failure", "helm")
+	annotation := &github.CheckRunAnnotation{
+		Path:            github.String(filename),
+		StartLine:       github.Int(line),
+		EndLine:         github.Int(line),
+		AnnotationLevel: github.String("failure"),
+		Title:           github.String(title),
+		Message:         github.String(fmt.Sprintf("%+v", err)),
+	}
+	if blobHRef := source.BlobURL(filename); blobHRef != "" {
+		annotation.BlobHRef = &blobHRef
+	}
+	return annotation
+}
+
+// noticeAnnotation describes part of the chart kubevalidator couldn't render
+func (c *chart) noticeAnnotation(source Source, filename string, line int, title string, message string) *github.CheckRunAnnotation {
+	annotationsAdded.inc("notice", "helm")
+	annotation := &github.CheckRunAnnotation{
+		Path:            github.String(filename),
+		StartLine:       github.Int(line),
+		EndLine:         github.Int(line),
+		AnnotationLevel: github.String("notice"),
+		Title:           github.String(title),
+		Message:         github.String(message),
+	}
+	if blobHRef := source.BlobURL(filename); blobHRef != "" {
+		annotation.BlobHRef = &blobHRef
+	}
+	return annotation
+}
+
+// sourceMap reads the source map comments from the output of the template
+// filename
+func (c *chart) sourceMap(source Source, b []byte, filename string) *sourceMap {
+	m := &sourceMap{source: source, template: filename}
+	for i, line := range strings.Split(string(b), "\n") {
+		match := sourceMapPattern.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		entry := sourceMapEntry{rendered: i + 1, path: filename}
+		// Helm prefixes sources with the chart's name rather than its
+		// directory
+		name, _ := c.metadata["Name"].(string)
+		for _, candidate := range []string{match[1], c.dir + match[1], c.dir + strings.TrimPrefix(match[1], name+"/")} {
+			if c.paths[strings.TrimPrefix(candidate, c.dir)] && strings.HasPrefix(candidate, c.dir) {
+				entry.path = candidate
+				break
+			}
+		}
+		entry.line, _ = strconv.Atoi(match[2])
+		m.entries = append(m.entries, entry)
+	}
+	return m
+}
+
+// sourceMap maps the lines of a rendered template back to the files they
+// came from
+type sourceMap struct {
+	source   Source
+	template string
+	entries  []sourceMapEntry
+}
+
+// sourceMapEntry records that the lines following line rendered of the
+// output came from path, starting at line if it's known
+type sourceMapEntry struct {
+	rendered int
+	path     string
+	line     int
+}
+
+// resolve returns the file and line that line of the output came from.
+// Lines without a source map comment are attributed to the first line of
+// the template.
+func (m *sourceMap) resolve(line int) (string, int) {
+	filename, mapped := m.template, 1
+	for _, entry := range m.entries {
+		if entry.rendered >= line {
+			break
+		}
+		filename, mapped = entry.path, 1
+		if entry.line > 0 {
+			mapped = entry.line + line - entry.rendered - 1
+		}
+	}
+	return filename, mapped
+}
+
+// annotate moves annotation from the rendered output to the file and lines
+// it came from. Columns are dropped as they refer to the rendered output.
+func (m *sourceMap) annotate(annotation *github.CheckRunAnnotation, result ValidationResult, e gojsonschema.ResultError) {
+	filename, start := m.resolve(annotation.GetStartLine())
+	endFilename, end := m.resolve(annotation.GetEndLine())
+	if endFilename != filename || end < start {
+		end = start
+	}
+	annotation.Path = github.String(filename)
+	annotation.BlobHRef = nil
+	if blobHRef := m.source.BlobURL(filename); blobHRef != "" {
+		annotation.BlobHRef = &blobHRef
+	}
+	annotation.StartLine, annotation.EndLine = &start, &end
+	annotation.StartColumn, annotation.EndColumn = nil, nil
+}
+
+// parseValues unmarshals a YAML mapping such as values.yaml
+func parseValues(b []byte) (map[string]interface{}, error) {
+	var values interface{}
+	if err := yaml.Unmarshal(b, &values); err != nil {
+		return nil, err
+	}
+	if values == nil {
+		return map[string]interface{}{}, nil
+	}
+	m, ok := convertToStringKeys(values).(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Expected a mapping")
+	}
+	return m, nil
+}
+
+// mergeValues recursively merges src into dst as Helm merges values files,
+// with null values removing keys
+func mergeValues(dst, src map[string]interface{}) {
+	for k, v := range src {
+		if v == nil {
+			delete(dst, k)
+			continue
+		}
+		srcMap, srcIsMap := v.(map[string]interface{})
+		dstMap, dstIsMap := dst[k].(map[string]interface{})
+		if srcIsMap && dstIsMap {
+			mergeValues(dstMap, srcMap)
+			continue
+		}
+		dst[k] = v
+	}
+}
@@ -0,0 +1,486 @@
+package validator
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// helmAPIVersions is .Capabilities.APIVersions. Charts are rendered without
+// a cluster, so only the APIs every cluster serves are available.
+type helmAPIVersions []string
+
+// Has returns whether the API version is available
+func (v helmAPIVersions) Has(apiVersion string) bool {
+	switch apiVersion {
+	case "v1", "apps/v1", "batch/v1", "policy/v1beta1", "rbac.authorization.k8s.io/v1":
+		return true
+	}
+	return false
+}
+
+// chartFiles is .Files, the chart's files keyed by their path relative to
+// the chart
+type chartFiles struct {
+	chart *chart
+}
+
+// Get returns the contents of name, or an empty string if there's no such
+// file
+func (f chartFiles) Get(name string) (string, error) {
+	b, err := f.GetBytes(name)
+	return string(b), err
+}
+
+// GetBytes returns the contents of name
+func (f chartFiles) GetBytes(name string) ([]byte, error) {
+	if !f.chart.paths[name] {
+		return nil, nil
+	}
+	return f.chart.read(name)
+}
+
+// Glob returns the files matching pattern
+func (f chartFiles) Glob(pattern string) (helmFiles, error) {
+	matched := helmFiles{}
+	for name := range f.chart.paths {
+		if ok, _ := path.Match(pattern, name); ok {
+			b, err := f.chart.read(name)
+			if err != nil {
+				return nil, err
+			}
+			matched[name] = b
+		}
+	}
+	return matched, nil
+}
+
+// helmFiles are files returned by .Files.Glob, keyed by their path relative
+// to the chart
+type helmFiles map[string][]byte
+
+// Get returns the contents of name, or an empty string if there's no such
+// file
+func (f helmFiles) Get(name string) string {
+	return string(f[name])
+}
+
+// GetBytes returns the contents of name
+func (f helmFiles) GetBytes(name string) []byte {
+	return f[name]
+}
+
+// Glob returns the files matching pattern
+func (f helmFiles) Glob(pattern string) helmFiles {
+	matched := helmFiles{}
+	for name, b := range f {
+		if ok, _ := path.Match(pattern, name); ok {
+			matched[name] = b
+		}
+	}
+	return matched
+}
+
+const (
+	// maxRenderedBytes caps how much text rendering a chart may produce,
+	// counting what's built by include, tpl and string functions along the
+	// way
+	maxRenderedBytes = 8 << 20
+
+	// maxIncludeDepth caps how deeply include and tpl may be nested
+	maxIncludeDepth = 100
+)
+
+// renderTimeout caps how long rendering a chart may take
+var renderTimeout = 10 * time.Second
+
+var errRenderedTooLarge = errors.Errorf("Rendering this chart produces more than %d bytes", maxRenderedBytes)
+
+// renderBudget tracks what's left of the limits on rendering a single chart
+type renderBudget struct {
+	bytes    int
+	depth    int
+	timeout  time.Duration
+	deadline time.Time
+}
+
+func newRenderBudget() *renderBudget {
+	return &renderBudget{bytes: maxRenderedBytes, timeout: renderTimeout, deadline: time.Now().Add(renderTimeout)}
+}
+
+// expired returns an error once rendering has taken longer than
+// renderTimeout
+func (b *renderBudget) expired() error {
+	if time.Now().After(b.deadline) {
+		return errors.Errorf("Rendering this chart took longer than %s", b.timeout)
+	}
+	return nil
+}
+
+// spend deducts n bytes from the budget, returning an error if there aren't
+// enough left or rendering has taken too long
+func (b *renderBudget) spend(n int) error {
+	if err := b.expired(); err != nil {
+		return err
+	}
+	if n < 0 || n > b.bytes {
+		return errRenderedTooLarge
+	}
+	b.bytes -= n
+	return nil
+}
+
+// enter records that include or tpl has been called, returning an error if
+// they're nested too deeply. leave must be called when it returns.
+func (b *renderBudget) enter() error {
+	if err := b.expired(); err != nil {
+		return err
+	}
+	if b.depth >= maxIncludeDepth {
+		return errors.Errorf("include and tpl can't be nested more than %d deep", maxIncludeDepth)
+	}
+	b.depth++
+	return nil
+}
+
+func (b *renderBudget) leave() {
+	b.depth--
+}
+
+// execute renders the template name of t into w, giving up once rendering
+// has taken longer than renderTimeout. text/template can't be interrupted,
+// so a template which loops without writing anything is abandoned to finish
+// in the background; any other stops at its next write. Neither t nor w may
+// be used again after execute returns an error.
+func (b *renderBudget) execute(t *template.Template, w *budgetWriter, name string, data interface{}) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- t.ExecuteTemplate(w, name, data)
+	}()
+	timer := time.NewTimer(time.Until(b.deadline))
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return b.expired()
+	}
+}
+
+// budgetWriter buffers rendered text as long as the budget allows
+type budgetWriter struct {
+	budget *renderBudget
+	bytes.Buffer
+}
+
+func (w *budgetWriter) Write(p []byte) (int, error) {
+	if err := w.budget.spend(len(p)); err != nil {
+		return 0, err
+	}
+	return w.Buffer.Write(p)
+}
+
+// helmFuncs returns the subset of the functions Helm provides to templates
+// which kubevalidator supports. include and tpl execute templates from t, and
+// functions which build strings draw on budget.
+func helmFuncs(t *template.Template, budget *renderBudget) template.FuncMap {
+	return template.FuncMap{
+		"include": func(name string, data interface{}) (string, error) {
+			if err := budget.enter(); err != nil {
+				return "", err
+			}
+			defer budget.leave()
+			buffer := &budgetWriter{budget: budget}
+			err := t.ExecuteTemplate(buffer, name, data)
+			return buffer.String(), err
+		},
+		"tpl": func(text string, data interface{}) (string, error) {
+			if err := budget.enter(); err != nil {
+				return "", err
+			}
+			defer budget.leave()
+			clone, err := t.Clone()
+			if err != nil {
+				return "", err
+			}
+			parsed, err := clone.New("tpl").Parse(text)
+			if err != nil {
+				return "", err
+			}
+			buffer := &budgetWriter{budget: budget}
+			err = parsed.Execute(buffer, data)
+			return buffer.String(), err
+		},
+		"required": func(message string, value interface{}) (interface{}, error) {
+			if helmEmpty(value) {
+				return nil, errors.New(message)
+			}
+			return value, nil
+		},
+		"fail": func(message string) (string, error) {
+			return "", errors.New(message)
+		},
+
+		"toYaml": func(v interface{}) string {
+			b, err := yaml.Marshal(v)
+			if err != nil {
+				return ""
+			}
+			return strings.TrimSuffix(string(b), "\n")
+		},
+		"fromYaml": func(s string) map[string]interface{} {
+			values, err := parseValues([]byte(s))
+			if err != nil {
+				return map[string]interface{}{"Error": err.Error()}
+			}
+			return values
+		},
+		"toJson": func(v interface{}) string {
+			b, err := json.Marshal(v)
+			if err != nil {
+				return ""
+			}
+			return string(b)
+		},
+		"fromJson": func(s string) map[string]interface{} {
+			values := map[string]interface{}{}
+			if err := json.Unmarshal([]byte(s), &values); err != nil {
+				return map[string]interface{}{"Error": err.Error()}
+			}
+			return values
+		},
+
+		"default": func(d interface{}, given ...interface{}) interface{} {
+			if len(given) == 0 || helmEmpty(given[0]) {
+				return d
+			}
+			return given[0]
+		},
+		"empty": helmEmpty,
+		"coalesce": func(values ...interface{}) interface{} {
+			for _, v := range values {
+				if !helmEmpty(v) {
+					return v
+				}
+			}
+			return nil
+		},
+		"ternary": func(t, f interface{}, condition bool) interface{} {
+			if condition {
+				return t
+			}
+			return f
+		},
+
+		"quote": func(values ...interface{}) string {
+			var quoted []string
+			for _, v := range values {
+				if v != nil {
+					quoted = append(quoted, strconv.Quote(helmString(v)))
+				}
+			}
+			return strings.Join(quoted, " ")
+		},
+		"squote": func(values ...interface{}) string {
+			var quoted []string
+			for _, v := range values {
+				if v != nil {
+					quoted = append(quoted, "'"+helmString(v)+"'")
+				}
+			}
+			return strings.Join(quoted, " ")
+		},
+		"indent": func(spaces int, s string) (string, error) {
+			return helmIndent(budget, spaces, s)
+		},
+		"nindent": func(spaces int, s string) (string, error) {
+			s, err := helmIndent(budget, spaces, s)
+			return "\n" + s, err
+		},
+		"toString":   helmString,
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"title":      strings.Title,
+		"trim":       strings.TrimSpace,
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"trunc": func(length int, s string) string {
+			if length >= 0 && len(s) > length {
+				return s[:length]
+			}
+			return s
+		},
+		"replace": func(old, new, s string) (string, error) {
+			if err := budget.spend(len(s) + strings.Count(s, old)*len(new)); err != nil {
+				return "", err
+			}
+			return strings.Replace(s, old, new, -1), nil
+		},
+		"contains":  func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix": func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix": func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"repeat": func(count int, s string) (string, error) {
+			if count < 0 || (len(s) > 0 && count > maxRenderedBytes/len(s)) {
+				return "", errRenderedTooLarge
+			}
+			if err := budget.spend(count * len(s)); err != nil {
+				return "", err
+			}
+			return strings.Repeat(s, count), nil
+		},
+		"join": func(sep string, values interface{}) string {
+			var s []string
+			for _, v := range helmList(values) {
+				s = append(s, helmString(v))
+			}
+			return strings.Join(s, sep)
+		},
+		"splitList": func(sep, s string) []string { return strings.Split(s, sep) },
+		"b64enc":    func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec": func(s string) string {
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil {
+				return err.Error()
+			}
+			return string(b)
+		},
+		"sha256sum": func(s string) string {
+			sum := sha256.Sum256([]byte(s))
+			return hex.EncodeToString(sum[:])
+		},
+
+		"list": func(values ...interface{}) []interface{} { return values },
+		"dict": func(pairs ...interface{}) map[string]interface{} {
+			d := map[string]interface{}{}
+			for i := 0; i+1 < len(pairs); i += 2 {
+				d[helmString(pairs[i])] = pairs[i+1]
+			}
+			return d
+		},
+		"hasKey": func(d map[string]interface{}, key string) bool {
+			_, ok := d[key]
+			return ok
+		},
+		"get": func(d map[string]interface{}, key string) interface{} { return d[key] },
+		"set": func(d map[string]interface{}, key string, value interface{}) map[string]interface{} {
+			d[key] = value
+			return d
+		},
+
+		"int":     func(v interface{}) int { return int(helmFloat(v)) },
+		"int64":   func(v interface{}) int64 { return int64(helmFloat(v)) },
+		"float64": helmFloat,
+		"add1":    func(v interface{}) int64 { return int64(helmFloat(v)) + 1 },
+		"add": func(values ...interface{}) int64 {
+			var sum int64
+			for _, v := range values {
+				sum += int64(helmFloat(v))
+			}
+			return sum
+		},
+		"sub": func(a, b interface{}) int64 { return int64(helmFloat(a)) - int64(helmFloat(b)) },
+		"mul": func(a, b interface{}) int64 { return int64(helmFloat(a)) * int64(helmFloat(b)) },
+		"div": func(a, b interface{}) (int64, error) {
+			if int64(helmFloat(b)) == 0 {
+				return 0, errors.New("Division by zero")
+			}
+			return int64(helmFloat(a)) / int64(helmFloat(b)), nil
+		},
+	}
+}
+
+// helmEmpty returns whether v is nil or the zero value of its type, as
+// Sprig's empty function does
+func helmEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return value.Len() == 0
+	case reflect.Bool:
+		return !value.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return value.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return value.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return value.Float() == 0
+	case reflect.Ptr, reflect.Interface:
+		return value.IsNil()
+	}
+	return false
+}
+
+// helmString formats v as text/template would print it
+func helmString(v interface{}) string {
+	switch s := v.(type) {
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// helmFloat converts a number or numeric string to a float64
+func helmFloat(v interface{}) float64 {
+	value := reflect.ValueOf(v)
+	switch value.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(value.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(value.Uint())
+	case reflect.Float32, reflect.Float64:
+		return value.Float()
+	case reflect.String:
+		f, _ := strconv.ParseFloat(value.String(), 64)
+		return f
+	}
+	return 0
+}
+
+// helmList converts a slice of any type to a []interface{}
+func helmList(v interface{}) []interface{} {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Slice && value.Kind() != reflect.Array {
+		return []interface{}{v}
+	}
+	list := make([]interface{}, value.Len())
+	for i := range list {
+		list[i] = value.Index(i).Interface()
+	}
+	return list
+}
+
+// helmIndent indents every line of s by spaces, drawing the text added from
+// budget
+func helmIndent(budget *renderBudget, spaces int, s string) (string, error) {
+	if spaces < 0 {
+		spaces = 0
+	}
+	lines := strings.Count(s, "\n") + 1
+	if spaces > maxRenderedBytes/lines {
+		return "", errRenderedTooLarge
+	}
+	if err := budget.spend(spaces * lines); err != nil {
+		return "", err
+	}
+	padding := strings.Repeat(" ", spaces)
+	return padding + strings.Replace(s, "\n", "\n"+padding, -1), nil
+}
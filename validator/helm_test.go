@@ -0,0 +1,291 @@
+package validator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func helmTestConfig(values ...string) *KubeValidatorConfig {
+	return &KubeValidatorConfig{
+		Spec: &KubeValidatorConfigSpec{
+			Manifests: []*KubeValidatorConfigManifest{{
+				Helm: &KubeValidatorConfigHelm{
+					Chart:  "fixtures/helm/example",
+					Values: values,
+				},
+				Schemas: []*KubeValidatorConfigSchema{{Strict: github.Bool(false)}},
+			}},
+		},
+	}
+}
+
+func TestHelmChartsAreRenderedAndValidated(t *testing.T) {
+	defaultLocation := DefaultSchemaStore.DefaultLocation
+	DefaultSchemaStore.DefaultLocation = fixtureSchemaLocation()
+	defer func() { DefaultSchemaStore.DefaultLocation = defaultLocation }()
+
+	config := helmTestConfig("fixtures/helm/values-invalid.yaml")
+	if !config.Valid() {
+		t.Fatal("Expected a Helm manifest to be valid")
+	}
+	source := &DirectorySource{Dir: ".."}
+
+	candidates, annotations := config.helmCandidates(source, []*File{{Filename: "fixtures/helm/values-invalid.yaml"}})
+	if len(annotations) != 0 {
+		t.Fatalf("Expected the chart to render, got %s", github.Stringify(annotations))
+	}
+	var filenames []string
+	for _, candidate := range candidates {
+		filenames = append(filenames, candidate.file.GetFilename())
+	}
+	if got, want := strings.Join(filenames, ","), "fixtures/helm/example/templates/configmap.yaml,fixtures/helm/example/templates/deployment.yaml"; got != want {
+		t.Fatalf("Expected candidates %s, got %s", want, got)
+	}
+	if rendered := string(*candidates[0].bytes); !strings.Contains(rendered, "name: release-name-example\n") || !strings.Contains(rendered, "greeting: hello\n") {
+		t.Errorf("Unexpected rendered ConfigMap:\n%s", rendered)
+	}
+
+	annotations = append(candidates.LoadBytes(), candidates.Validate()...)
+	want := []struct {
+		path    string
+		line    int
+		message string
+	}{
+		// The ConfigMap has no source map comments
+		{"fixtures/helm/example/templates/configmap.yaml", 1, "data: Invalid type. Expected: [string,null], given: integer"},
+		// The Deployment's source map comment locates replicas even though
+		// the labels above it rendered to more lines than the template
+		{"fixtures/helm/example/templates/deployment.yaml", 9, "spec.replicas: Invalid type. Expected: integer, given: string"},
+	}
+	if len(annotations) != len(want) {
+		t.Fatalf("Expected %d annotations, got %s", len(want), github.Stringify(annotations))
+	}
+	for i, w := range want {
+		a := annotations[i]
+		if a.GetPath() != w.path || a.GetStartLine() != w.line || a.GetEndLine() != w.line || a.GetMessage() != w.message {
+			t.Errorf("Expected %s:%d %q, got %s", w.path, w.line, w.message, github.Stringify(a))
+		}
+		if a.StartColumn != nil || a.EndColumn != nil {
+			t.Errorf("Expected no columns on rendered templates, got %s", github.Stringify(a))
+		}
+	}
+}
+
+func TestHelmChartsAreOnlyRenderedWhenTheyChange(t *testing.T) {
+	config := helmTestConfig("fixtures/helm/values-invalid.yaml")
+	source := &DirectorySource{Dir: ".."}
+
+	candidates, annotations := config.helmCandidates(source, []*File{{Filename: "fixtures/deployment.yaml"}})
+	if len(candidates) != 0 || len(annotations) != 0 {
+		t.Errorf("Expected nothing to be rendered, got %d candidates and %s", len(candidates), github.Stringify(annotations))
+	}
+
+	candidates, _ = config.helmCandidates(source, []*File{{Filename: "fixtures/helm/example/templates/_helpers.tpl"}})
+	if len(candidates) != 2 {
+		t.Errorf("Expected a change to a helper to render the chart, got %d candidates", len(candidates))
+	}
+}
+
+func TestHelmTemplateErrorsAreAnnotated(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubevalidator-helm")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "chart", "templates"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "chart", "Chart.yaml"), []byte("name: chart\nversion: 0.1.0\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "chart", "templates", "parse.yaml"), []byte("kind: ConfigMap\n{{ unsupported . }}\n"), 0644)
+
+	config := &KubeValidatorConfig{Spec: &KubeValidatorConfigSpec{
+		Manifests: []*KubeValidatorConfigManifest{{Helm: &KubeValidatorConfigHelm{Chart: "chart"}}},
+	}}
+	source := &DirectorySource{Dir: dir}
+	files, _ := source.Files()
+	candidates, annotations := config.helmCandidates(source, files)
+	if len(candidates) != 0 || len(annotations) != 1 {
+		t.Fatalf("Expected a single annotation, got %d candidates and %s", len(candidates), github.Stringify(annotations))
+	}
+	if a := annotations[0]; a.GetPath() != "chart/templates/parse.yaml" || a.GetStartLine() != 2 || a.GetAnnotationLevel() != "notice" || !strings.Contains(a.GetMessage(), "doesn't support the unsupported function") {
+		t.Errorf("Expected a notice about the unsupported function on line 2, got %s", github.Stringify(a))
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "chart", "templates", "parse.yaml"), []byte("kind: ConfigMap\n{{ template \"missing\" . }}\n"), 0644)
+	candidates, annotations = config.helmCandidates(source, files)
+	if len(candidates) != 0 || len(annotations) != 1 || annotations[0].GetAnnotationLevel() != "failure" || annotations[0].GetStartLine() != 2 {
+		t.Fatalf("Expected a missing template to fail on line 2, got %d candidates and %s", len(candidates), github.Stringify(annotations))
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "chart", "templates", "parse.yaml"), []byte("kind: ConfigMap\n\n{{ required \"name is required\" .Values.name }}\n"), 0644)
+	candidates, annotations = config.helmCandidates(source, files)
+	if len(candidates) != 0 || len(annotations) != 1 {
+		t.Fatalf("Expected a single annotation, got %d candidates and %s", len(candidates), github.Stringify(annotations))
+	}
+	if a := annotations[0]; a.GetPath() != "chart/templates/parse.yaml" || a.GetStartLine() != 3 || !strings.Contains(a.GetMessage(), "name is required") {
+		t.Errorf("Expected the execution error to be annotated on line 3, got %s", github.Stringify(a))
+	}
+
+	os.Remove(filepath.Join(dir, "chart", "Chart.yaml"))
+	files, _ = source.Files()
+	_, annotations = config.helmCandidates(source, files)
+	if len(annotations) != 1 || annotations[0].GetPath() != configPath {
+		t.Errorf("Expected a missing Chart.yaml to be annotated on the config, got %s", github.Stringify(annotations))
+	}
+}
+
+func TestHelmChartsWithSubchartsAreRenderedWithoutThem(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubevalidator-helm")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "chart", "templates"), 0755)
+	os.MkdirAll(filepath.Join(dir, "chart", "charts", "common", "templates"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "chart", "Chart.yaml"), []byte("name: chart\nversion: 0.1.0\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "chart", "charts", "common", "Chart.yaml"), []byte("name: common\nversion: 0.1.0\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "chart", "charts", "common", "templates", "_names.tpl"), []byte("{{ define \"common.name\" }}common{{ end }}\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "chart", "templates", "configmap.yaml"), []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "chart", "templates", "service.yaml"), []byte("apiVersion: v1\nkind: Service\nmetadata:\n  name: {{ include \"common.name\" . }}\n"), 0644)
+
+	config := &KubeValidatorConfig{Spec: &KubeValidatorConfigSpec{
+		Manifests: []*KubeValidatorConfigManifest{{Helm: &KubeValidatorConfigHelm{Chart: "chart"}}},
+	}}
+	source := &DirectorySource{Dir: dir}
+	files, _ := source.Files()
+	candidates, annotations := config.helmCandidates(source, files)
+	if len(candidates) != 1 || candidates[0].file.GetFilename() != "chart/templates/configmap.yaml" {
+		t.Fatalf("Expected only the template which doesn't use the subchart to be rendered, got %d candidates", len(candidates))
+	}
+	want := []struct {
+		path string
+		line int
+	}{
+		{"chart/Chart.yaml", 1},
+		{"chart/templates/service.yaml", 4},
+	}
+	if len(annotations) != len(want) {
+		t.Fatalf("Expected %d annotations, got %s", len(want), github.Stringify(annotations))
+	}
+	for i, w := range want {
+		if a := annotations[i]; a.GetPath() != w.path || a.GetStartLine() != w.line || a.GetAnnotationLevel() != "notice" {
+			t.Errorf("Expected a notice on %s:%d, got %s", w.path, w.line, github.Stringify(a))
+		}
+	}
+}
+
+// readRecordingSource records the files read from a DirectorySource
+type readRecordingSource struct {
+	*DirectorySource
+	read []string
+}
+
+func (s *readRecordingSource) ReadFile(filename string) ([]byte, error) {
+	s.read = append(s.read, filename)
+	return s.DirectorySource.ReadFile(filename)
+}
+
+func TestHelmChartFilesAreOnlyReadWhenUsed(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubevalidator-helm")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "chart", "templates"), 0755)
+	os.MkdirAll(filepath.Join(dir, "chart", "files"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "chart", "Chart.yaml"), []byte("name: chart\nversion: 0.1.0\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "chart", "files", "greeting.txt"), []byte("hello"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "chart", "files", "unused.txt"), []byte("unused"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "chart", "templates", "configmap.yaml"), []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\ndata:\n  greeting: {{ .Files.Get \"files/greeting.txt\" }}\n"), 0644)
+
+	config := &KubeValidatorConfig{Spec: &KubeValidatorConfigSpec{
+		Manifests: []*KubeValidatorConfigManifest{{Helm: &KubeValidatorConfigHelm{Chart: "chart"}}},
+	}}
+	source := &readRecordingSource{DirectorySource: &DirectorySource{Dir: dir}}
+	files, _ := source.Files()
+	candidates, annotations := config.helmCandidates(source, files)
+	if len(candidates) != 1 || len(annotations) != 0 {
+		t.Fatalf("Expected the chart to render, got %d candidates and %s", len(candidates), github.Stringify(annotations))
+	}
+	if rendered := string(*candidates[0].bytes); !strings.Contains(rendered, "greeting: hello\n") {
+		t.Errorf("Expected the file to be rendered:\n%s", rendered)
+	}
+	if got, want := strings.Join(source.read, ","), "chart/Chart.yaml,chart/templates/configmap.yaml,chart/files/greeting.txt"; got != want {
+		t.Errorf("Expected only %s to be read, got %s", want, got)
+	}
+}
+
+func TestHelmRenderingIsLimited(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubevalidator-helm")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "chart", "templates"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "chart", "Chart.yaml"), []byte("name: chart\nversion: 0.1.0\n"), 0644)
+
+	config := &KubeValidatorConfig{Spec: &KubeValidatorConfigSpec{
+		Manifests: []*KubeValidatorConfigManifest{{Helm: &KubeValidatorConfigHelm{Chart: "chart"}}},
+	}}
+	source := &DirectorySource{Dir: dir}
+	for template, message := range map[string]string{
+		"{{ repeat 1000000000 \"x\" }}":                                                  "more than 8388608 bytes",
+		"{{ repeat 1000 (repeat 1000 \"xxxxxxxxxx\") }}":                                 "more than 8388608 bytes",
+		"{{ define \"loop\" }}{{ include \"loop\" . }}{{ end }}{{ include \"loop\" . }}": "nested more than 100 deep",
+	} {
+		ioutil.WriteFile(filepath.Join(dir, "chart", "templates", "limited.yaml"), []byte(template), 0644)
+		files, _ := source.Files()
+		candidates, annotations := config.helmCandidates(source, files)
+		if len(candidates) != 0 || len(annotations) != 1 || annotations[0].GetAnnotationLevel() != "failure" || !strings.Contains(annotations[0].GetMessage(), message) {
+			t.Errorf("Expected %s to fail with %q, got %d candidates and %s", template, message, len(candidates), github.Stringify(annotations))
+		}
+	}
+}
+
+func TestHelmRenderingTimesOut(t *testing.T) {
+	defer func(timeout time.Duration) { renderTimeout = timeout }(renderTimeout)
+	renderTimeout = 100 * time.Millisecond
+
+	dir, _ := ioutil.TempDir("", "kubevalidator-helm")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "chart", "templates"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "chart", "Chart.yaml"), []byte("name: chart\nversion: 0.1.0\n"), 0644)
+
+	config := &KubeValidatorConfig{Spec: &KubeValidatorConfigSpec{
+		Manifests: []*KubeValidatorConfigManifest{{Helm: &KubeValidatorConfigHelm{Chart: "chart"}}},
+	}}
+	source := &DirectorySource{Dir: dir}
+	for _, template := range []string{
+		"{{ range 100000 }}{{ range 100000 }}{{ \"\" }}{{ end }}{{ end }}",
+		"{{ range 30000000 }}{{ end }}",
+	} {
+		ioutil.WriteFile(filepath.Join(dir, "chart", "templates", "slow.yaml"), []byte(template), 0644)
+		files, _ := source.Files()
+		start := time.Now()
+		candidates, annotations := config.helmCandidates(source, files)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("Expected %s to be abandoned after 100ms, took %s", template, elapsed)
+		}
+		if len(candidates) != 0 || len(annotations) != 1 || annotations[0].GetAnnotationLevel() != "failure" || !strings.Contains(annotations[0].GetMessage(), "took longer than 100ms") {
+			t.Errorf("Expected %s to time out, got %d candidates and %s", template, len(candidates), github.Stringify(annotations))
+		}
+	}
+}
+
+func TestSourceMapResolve(t *testing.T) {
+	m := &sourceMap{
+		template: "chart/templates/a.yaml",
+		entries: []sourceMapEntry{
+			{rendered: 3, path: "chart/templates/a.yaml", line: 10},
+			{rendered: 6, path: "chart/templates/_helpers.tpl"},
+		},
+	}
+	cases := []struct {
+		line int
+		path string
+		want int
+	}{
+		{1, "chart/templates/a.yaml", 1},
+		{3, "chart/templates/a.yaml", 1},
+		{4, "chart/templates/a.yaml", 10},
+		{5, "chart/templates/a.yaml", 11},
+		{7, "chart/templates/_helpers.tpl", 1},
+	}
+	for _, c := range cases {
+		if path, line := m.resolve(c.line); path != c.path || line != c.want {
+			t.Errorf("Expected line %d to resolve to %s:%d, got %s:%d", c.line, c.path, c.want, path, line)
+		}
+	}
+}
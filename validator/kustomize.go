@@ -0,0 +1,820 @@
+package validator
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonschema"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// KubeValidatorConfigKustomize lists kustomize overlays which are built and
+// validated whenever any of the files they're built from change. Overlays
+// are built by kubevalidator itself, which supports resources, bases,
+// patchesStrategicMerge, namePrefix, nameSuffix, namespace, commonLabels and
+// commonAnnotations. Overlays using other fields or remote bases are
+// reported as notices rather than validated.
+type KubeValidatorConfigKustomize struct {
+	Overlays []string                     `yaml:"overlays"`
+	Schemas  []*KubeValidatorConfigSchema `yaml:"schemas,omitempty"`
+}
+
+// kustomizationFilenames are the names kustomize looks for in a directory
+var kustomizationFilenames = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
+// supportedKustomizationFields are the fields of a kustomization which are
+// applied when it's built. Overlays using other fields aren't built.
+var supportedKustomizationFields = map[string]bool{
+	"apiVersion":            true,
+	"kind":                  true,
+	"resources":             true,
+	"bases":                 true,
+	"patchesStrategicMerge": true,
+	"namePrefix":            true,
+	"nameSuffix":            true,
+	"namespace":             true,
+	"commonLabels":          true,
+	"commonAnnotations":     true,
+}
+
+// clusterScopedKinds aren't moved into a kustomization's namespace
+var clusterScopedKinds = map[string]bool{
+	"Namespace":                true,
+	"Node":                     true,
+	"PersistentVolume":         true,
+	"StorageClass":             true,
+	"ClusterRole":              true,
+	"ClusterRoleBinding":       true,
+	"CustomResourceDefinition": true,
+}
+
+// kustomizeCandidates builds the overlays whose files changed, returning a
+// Candidate for each along with CheckRunAnnotations describing overlays which
+// couldn't be built
+func (config *KubeValidatorConfig) kustomizeCandidates(source Source, changed []*File) (Candidates, Annotations) {
+	if config.Spec == nil || len(config.Spec.Kustomize) == 0 {
+		return nil, nil
+	}
+
+	files, err := source.Files()
+	if err != nil {
+		annotationsAdded.inc("failure", "kustomize")
+		annotation := &github.CheckRunAnnotation{
+			Path:            github.String(configPath),
+			StartLine:       github.Int(1),
+			EndLine:         github.Int(1),
+			AnnotationLevel: github.String("failure"),
+			Title:           github.String("Error listing kustomize overlays"),
+			Message:         github.String(fmt.Sprintf("%+v", err)),
+		}
+		if blobHRef := source.BlobURL(configPath); blobHRef != "" {
+			annotation.BlobHRef = &blobHRef
+		}
+		return nil, Annotations{annotation}
+	}
+	b := newKustomizeBuilder(source, files)
+
+	var candidates Candidates
+	var annotations Annotations
+	for _, kustomizeConfig := range config.Spec.Kustomize {
+		for _, overlay := range kustomizeConfig.Overlays {
+			overlay = path.Clean(overlay)
+			dependencies, err := b.dependencies(overlay, map[string]bool{})
+			if err != nil {
+				// The overlay's dependencies aren't known, so only report
+				// the problem if something in the overlay itself changed
+				for _, file := range changed {
+					if strings.HasPrefix(file.GetFilename(), overlay+"/") {
+						annotations = append(annotations, b.errorAnnotation(err))
+						break
+					}
+				}
+				continue
+			}
+			if !anyChanged(dependencies, changed) {
+				continue
+			}
+
+			if unsupported := b.unsupported(overlay, map[string]bool{}); unsupported != nil {
+				annotations = append(annotations, b.noticeAnnotation(overlay, unsupported))
+				continue
+			}
+			k, _ := b.load(overlay)
+			resources, err := b.build(overlay, map[string]bool{})
+			if err != nil {
+				annotations = append(annotations, b.errorAnnotation(err))
+				continue
+			}
+
+			output := &kustomizeOutput{source: source, kustomization: k.path, resources: resources}
+			built := output.bytes()
+			candidate := NewCandidate(source, &File{
+				Filename: k.path,
+				BlobURL:  source.BlobURL(k.path),
+			}, kustomizeConfig.Schemas)
+			candidate.crds = config.crds
+			candidate.setBytes(&built)
+			candidate.origin = output
+			candidates = append(candidates, candidate)
+		}
+	}
+	return candidates, annotations
+}
+
+// anyChanged returns whether any of changed are in filenames
+func anyChanged(filenames []string, changed []*File) bool {
+	for _, filename := range filenames {
+		for _, file := range changed {
+			if file.GetFilename() == filename {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// kustomization is a kustomization file
+type kustomization struct {
+	Resources             []string          `yaml:"resources"`
+	Bases                 []string          `yaml:"bases"`
+	PatchesStrategicMerge []string          `yaml:"patchesStrategicMerge"`
+	NamePrefix            string            `yaml:"namePrefix"`
+	NameSuffix            string            `yaml:"nameSuffix"`
+	Namespace             string            `yaml:"namespace"`
+	CommonLabels          map[string]string `yaml:"commonLabels"`
+	CommonAnnotations     map[string]string `yaml:"commonAnnotations"`
+
+	// path is the kustomization's filename
+	path string
+	// positions locates its fields
+	positions *yamlPositions
+	// unsupported lists the fields kubevalidator can't apply
+	unsupported []string
+}
+
+// kustomizeError is a problem building an overlay found on line of path. path
+// is empty if the problem is with the overlay's configuration.
+type kustomizeError struct {
+	path string
+	line int
+	err  error
+}
+
+func (e *kustomizeError) Error() string {
+	return e.err.Error()
+}
+
+// kustomizeBuilder builds overlays from the files in a Source
+type kustomizeBuilder struct {
+	source         Source
+	files          map[string]bool
+	dirs           map[string]bool
+	kustomizations map[string]*kustomization
+}
+
+func newKustomizeBuilder(source Source, files []*File) *kustomizeBuilder {
+	b := &kustomizeBuilder{
+		source:         source,
+		files:          map[string]bool{},
+		dirs:           map[string]bool{},
+		kustomizations: map[string]*kustomization{},
+	}
+	for _, file := range files {
+		b.files[file.GetFilename()] = true
+		for dir := path.Dir(file.GetFilename()); dir != "."; dir = path.Dir(dir) {
+			b.dirs[dir] = true
+		}
+	}
+	return b
+}
+
+// load reads the kustomization in dir
+func (b *kustomizeBuilder) load(dir string) (*kustomization, error) {
+	if k, ok := b.kustomizations[dir]; ok {
+		return k, nil
+	}
+	for _, name := range kustomizationFilenames {
+		filename := path.Join(dir, name)
+		if !b.files[filename] {
+			continue
+		}
+		contents, err := b.source.ReadFile(filename)
+		if err != nil {
+			return nil, &kustomizeError{path: filename, line: 1, err: err}
+		}
+		k := &kustomization{path: filename, positions: newYAMLPositions(contents, 1)}
+		if err := yaml.Unmarshal(contents, k); err != nil {
+			return nil, &kustomizeError{path: filename, line: 1, err: err}
+		}
+		var fields map[string]interface{}
+		yaml.Unmarshal(contents, &fields)
+		for field := range fields {
+			if !supportedKustomizationFields[field] {
+				k.unsupported = append(k.unsupported, field)
+			}
+		}
+		sort.Strings(k.unsupported)
+		b.kustomizations[dir] = k
+		return k, nil
+	}
+	return nil, &kustomizeError{err: errors.Errorf("Couldn't find a kustomization in %s", dir)}
+}
+
+// list returns the entries of one of the kustomization's lists of files
+func (k *kustomization) list(field string) []string {
+	switch field {
+	case "bases":
+		return k.Bases
+	case "resources":
+		return k.Resources
+	case "patchesStrategicMerge":
+		return k.PatchesStrategicMerge
+	}
+	return nil
+}
+
+// errorAt returns a kustomizeError on the line of the item at index of field
+func (k *kustomization) errorAt(field string, index int, err error) *kustomizeError {
+	node, _ := k.positions.lookup([]string{field, fmt.Sprintf("%d", index)})
+	line := node.full.start.line
+	if line == 0 {
+		line = 1
+	}
+	return &kustomizeError{path: k.path, line: line, err: err}
+}
+
+// resolve returns the path of a resource, base or patch listed at index of
+// field by the kustomization in dir, and whether it's a directory
+func (b *kustomizeBuilder) resolve(k *kustomization, dir string, field string, index int, entry string) (string, bool, error) {
+	filename := path.Join(dir, entry)
+	if b.files[filename] {
+		return filename, false, nil
+	}
+	if b.dirs[filename] {
+		return filename, true, nil
+	}
+	return "", false, k.errorAt(field, index, errors.Errorf("Couldn't find %s in the repository", entry))
+}
+
+// remote returns whether entry, listed by the kustomization in dir, refers
+// to a base outside of the repository such as
+// github.com/example/repo//config?ref=v1
+func (b *kustomizeBuilder) remote(dir string, entry string) bool {
+	filename := path.Join(dir, entry)
+	if b.files[filename] || b.dirs[filename] {
+		return false
+	}
+	return strings.Contains(entry, "://") || strings.HasPrefix(entry, "git@") || strings.Contains(entry, "?ref=") ||
+		strings.HasPrefix(entry, "github.com/") || strings.HasPrefix(entry, "gitlab.com/") || strings.HasPrefix(entry, "bitbucket.org/")
+}
+
+// dependencies lists the files in the repository the overlay in dir is
+// built from
+func (b *kustomizeBuilder) dependencies(dir string, visiting map[string]bool) ([]string, error) {
+	k, err := b.load(dir)
+	if err != nil {
+		return nil, err
+	}
+	visiting[dir] = true
+	defer delete(visiting, dir)
+
+	dependencies := []string{k.path}
+	for _, field := range []string{"bases", "resources", "patchesStrategicMerge"} {
+		for i, entry := range k.list(field) {
+			if b.remote(dir, entry) {
+				continue
+			}
+			filename, isDir, err := b.resolve(k, dir, field, i, entry)
+			if err != nil {
+				return nil, err
+			}
+			if !isDir {
+				dependencies = append(dependencies, filename)
+				continue
+			}
+			if visiting[filename] {
+				return nil, k.errorAt(field, i, errors.Errorf("%s includes itself", filename))
+			}
+			base, err := b.dependencies(filename, visiting)
+			if err != nil {
+				return nil, err
+			}
+			dependencies = append(dependencies, base...)
+		}
+	}
+	return dependencies, nil
+}
+
+// unsupported returns a kustomizeError describing why the overlay in dir
+// can't be built, if it or any of its bases use a field kubevalidator
+// doesn't support or a remote base. The overlay's dependencies must have
+// been found.
+func (b *kustomizeBuilder) unsupported(dir string, visiting map[string]bool) *kustomizeError {
+	k, err := b.load(dir)
+	if err != nil {
+		return nil
+	}
+	visiting[dir] = true
+	defer delete(visiting, dir)
+
+	if len(k.unsupported) > 0 {
+		line := 1
+		if node, ok := k.positions.lookup([]string{k.unsupported[0]}); ok {
+			line = node.head.start.line
+		}
+		return &kustomizeError{path: k.path, line: line, err: errors.Errorf("kubevalidator builds overlays itself and doesn't support %s", strings.Join(k.unsupported, ", "))}
+	}
+	for _, field := range []string{"bases", "resources"} {
+		for i, entry := range k.list(field) {
+			if b.remote(dir, entry) {
+				return k.errorAt(field, i, errors.Errorf("kubevalidator builds overlays itself and doesn't support remote bases like %s", entry))
+			}
+			filename := path.Join(dir, entry)
+			if b.dirs[filename] && !visiting[filename] {
+				if unsupported := b.unsupported(filename, visiting); unsupported != nil {
+					return unsupported
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// kustomizeResource is a resource built by an overlay
+type kustomizeResource struct {
+	body map[string]interface{}
+	// name is the resource's name before any prefix or suffix was added
+	name string
+	// origins are the documents the resource was built from, starting with
+	// the resource itself followed by the patches applied to it
+	origins []kustomizeDocument
+}
+
+// kustomizeDocument is a document in a resource or patch file
+type kustomizeDocument struct {
+	body     map[string]interface{}
+	path     string
+	document []byte
+	line     int
+}
+
+// build builds the overlay in dir
+func (b *kustomizeBuilder) build(dir string, visiting map[string]bool) ([]*kustomizeResource, error) {
+	k, err := b.load(dir)
+	if err != nil {
+		return nil, err
+	}
+	visiting[dir] = true
+	defer delete(visiting, dir)
+
+	var resources []*kustomizeResource
+	for _, field := range []string{"bases", "resources"} {
+		for i, entry := range k.list(field) {
+			filename, isDir, err := b.resolve(k, dir, field, i, entry)
+			if err != nil {
+				return nil, err
+			}
+			if isDir {
+				if visiting[filename] {
+					return nil, k.errorAt(field, i, errors.Errorf("%s includes itself", filename))
+				}
+				base, err := b.build(filename, visiting)
+				if err != nil {
+					return nil, err
+				}
+				resources = append(resources, base...)
+				continue
+			}
+			documents, err := b.documents(filename)
+			if err != nil {
+				return nil, err
+			}
+			for _, d := range documents {
+				name, _ := nestedMap(d.body, false, "metadata")["name"].(string)
+				resources = append(resources, &kustomizeResource{body: d.body, name: name, origins: []kustomizeDocument{d}})
+			}
+		}
+	}
+
+	for i, entry := range k.PatchesStrategicMerge {
+		filename, isDir, err := b.resolve(k, dir, "patchesStrategicMerge", i, entry)
+		if err == nil && isDir {
+			err = k.errorAt("patchesStrategicMerge", i, errors.Errorf("%s is a directory", entry))
+		}
+		if err != nil {
+			return nil, err
+		}
+		patches, err := b.documents(filename)
+		if err != nil {
+			return nil, err
+		}
+		for _, patch := range patches {
+			target := findPatchTarget(resources, patch.body)
+			if target == nil {
+				return nil, &kustomizeError{path: patch.path, line: patch.line, err: errors.New("No resource matches this patch")}
+			}
+			mergePatch(target.body, patch.body)
+			target.origins = append(target.origins, patch)
+		}
+	}
+
+	for _, r := range resources {
+		k.transform(r.body)
+	}
+	return resources, nil
+}
+
+// documents reads the resources in filename
+func (b *kustomizeBuilder) documents(filename string) ([]kustomizeDocument, error) {
+	contents, err := b.source.ReadFile(filename)
+	if err != nil {
+		return nil, &kustomizeError{path: filename, line: 1, err: err}
+	}
+
+	var documents []kustomizeDocument
+	lineBreak := detectLineBreak(contents)
+	separator := []byte(lineBreak + "---" + lineBreak)
+	line := 1
+	for _, document := range bytes.Split(contents, separator) {
+		var spec interface{}
+		if err := yaml.Unmarshal(document, &spec); err != nil {
+			return nil, &kustomizeError{path: filename, line: line, err: err}
+		}
+		if spec != nil {
+			body, ok := convertToStringKeys(spec).(map[string]interface{})
+			if !ok {
+				return nil, &kustomizeError{path: filename, line: line, err: errors.New("Expected a Kubernetes resource")}
+			}
+			documents = append(documents, kustomizeDocument{body: body, path: filename, document: document, line: line})
+		}
+		line += bytes.Count(document, []byte("\n")) + bytes.Count(separator, []byte("\n"))
+	}
+	return documents, nil
+}
+
+// findPatchTarget returns the resource patch applies to, matching on its kind
+// and its name with or without any prefix or suffix
+func findPatchTarget(resources []*kustomizeResource, patch map[string]interface{}) *kustomizeResource {
+	kind, _ := patch["kind"].(string)
+	name, _ := nestedMap(patch, false, "metadata")["name"].(string)
+	for _, r := range resources {
+		if rKind, _ := r.body["kind"].(string); rKind != kind {
+			continue
+		}
+		if rName, _ := nestedMap(r.body, false, "metadata")["name"].(string); rName == name || r.name == name {
+			return r
+		}
+	}
+	return nil
+}
+
+// transform applies the kustomization's name, namespace, label and annotation
+// changes to body
+func (k *kustomization) transform(body map[string]interface{}) {
+	metadata := nestedMap(body, true, "metadata")
+	if name, ok := metadata["name"].(string); ok {
+		metadata["name"] = k.NamePrefix + name + k.NameSuffix
+	}
+	kind, _ := body["kind"].(string)
+	if k.Namespace != "" && !clusterScopedKinds[kind] {
+		metadata["namespace"] = k.Namespace
+	}
+
+	if len(k.CommonLabels) > 0 {
+		labelMaps := []map[string]interface{}{nestedMap(body, true, "metadata", "labels")}
+		if kind == "Service" {
+			labelMaps = append(labelMaps, nestedMap(body, true, "spec", "selector"))
+		}
+		if nestedMap(body, false, "spec", "template") != nil {
+			labelMaps = append(labelMaps, nestedMap(body, true, "spec", "template", "metadata", "labels"))
+			if nestedMap(body, false, "spec", "selector") != nil {
+				labelMaps = append(labelMaps, nestedMap(body, true, "spec", "selector", "matchLabels"))
+			}
+		}
+		for _, labels := range labelMaps {
+			for key, value := range k.CommonLabels {
+				labels[key] = value
+			}
+		}
+	}
+
+	if len(k.CommonAnnotations) > 0 {
+		annotationMaps := []map[string]interface{}{nestedMap(body, true, "metadata", "annotations")}
+		if nestedMap(body, false, "spec", "template") != nil {
+			annotationMaps = append(annotationMaps, nestedMap(body, true, "spec", "template", "metadata", "annotations"))
+		}
+		for _, annotations := range annotationMaps {
+			for key, value := range k.CommonAnnotations {
+				annotations[key] = value
+			}
+		}
+	}
+}
+
+// nestedMap returns the mapping at keys beneath body, creating any that are
+// missing if create is set and returning nil otherwise
+func nestedMap(body map[string]interface{}, create bool, keys ...string) map[string]interface{} {
+	m := body
+	for _, key := range keys {
+		next, ok := m[key].(map[string]interface{})
+		if !ok {
+			if !create {
+				return nil
+			}
+			next = map[string]interface{}{}
+			m[key] = next
+		}
+		m = next
+	}
+	return m
+}
+
+// listMergeKeys are the patch merge keys Kubernetes declares for lists of
+// objects, keyed by the name of the list. The items of these lists are
+// merged by a strategic merge patch rather than replaced. ports are keyed by
+// containerPort in containers and port in Services.
+var listMergeKeys = map[string]string{
+	"containers":                "name",
+	"initContainers":            "name",
+	"ephemeralContainers":       "name",
+	"env":                       "name",
+	"volumes":                   "name",
+	"volumeMounts":              "mountPath",
+	"volumeDevices":             "devicePath",
+	"imagePullSecrets":          "name",
+	"hostAliases":               "ip",
+	"topologySpreadConstraints": "topologyKey",
+	"ownerReferences":           "uid",
+}
+
+// containerLists are the lists of a pod spec which hold containers
+var containerLists = map[string]bool{"containers": true, "initContainers": true, "ephemeralContainers": true}
+
+// mergePatch applies a strategic merge patch to the resource dst. Mappings
+// are merged, null values remove keys and lists of objects with a patch
+// merge key are merged item by item. Other lists, along with every list of a
+// custom resource, are replaced. "$patch: delete" and "$patch: replace" are
+// honored and every other directive is dropped, so none end up in dst.
+func mergePatch(dst, patch map[string]interface{}) {
+	apiVersion, _ := dst["apiVersion"].(string)
+	kind, _ := dst["kind"].(string)
+	group := ""
+	if i := strings.LastIndex(apiVersion, "/"); i >= 0 {
+		group = apiVersion[:i]
+	}
+	m := &strategicMerge{
+		kind:    kind,
+		builtIn: !strings.Contains(group, ".") || strings.HasSuffix(group, ".k8s.io"),
+	}
+	m.merge(dst, patch, nil)
+}
+
+// strategicMerge applies a strategic merge patch to a resource of kind
+type strategicMerge struct {
+	kind string
+	// builtIn is set for kinds Kubernetes declares patch merge keys for
+	builtIn bool
+}
+
+// merge merges patch into dst, the mapping at path
+func (m *strategicMerge) merge(dst, patch map[string]interface{}, path []string) {
+	if patchDirective(patch) == "replace" {
+		for key := range dst {
+			delete(dst, key)
+		}
+		for key, value := range withoutDirectives(patch).(map[string]interface{}) {
+			dst[key] = value
+		}
+		return
+	}
+	for key, value := range patch {
+		if strings.HasPrefix(key, "$") {
+			continue
+		}
+		if value == nil {
+			delete(dst, key)
+			continue
+		}
+		switch p := value.(type) {
+		case map[string]interface{}:
+			if patchDirective(p) == "delete" {
+				delete(dst, key)
+				continue
+			}
+			if d, ok := dst[key].(map[string]interface{}); ok {
+				m.merge(d, p, append(path, key))
+				continue
+			}
+		case []interface{}:
+			if d, ok := dst[key].([]interface{}); ok {
+				if mergeKey := m.listMergeKey(path, key); mergeKey != "" && allMappings(d) && allMappings(p) {
+					dst[key] = m.mergeList(d, p, mergeKey, append(path, key))
+					continue
+				}
+			}
+		}
+		dst[key] = withoutDirectives(value)
+	}
+}
+
+// listMergeKey returns the key the items of the list named field at path are
+// merged on, or an empty string if the list is replaced
+func (m *strategicMerge) listMergeKey(path []string, field string) string {
+	if !m.builtIn {
+		return ""
+	}
+	if field == "ports" {
+		switch {
+		case m.kind == "Service" && len(path) == 1 && path[0] == "spec":
+			return "port"
+		case len(path) > 0 && containerLists[path[len(path)-1]]:
+			return "containerPort"
+		}
+		return ""
+	}
+	return listMergeKeys[field]
+}
+
+// mergeList merges the items of patch into those of dst, the list at path,
+// which share the same value of mergeKey. dst is left as it was.
+func (m *strategicMerge) mergeList(dst, patch []interface{}, mergeKey string, path []string) []interface{} {
+	for _, item := range patch {
+		if patchDirective(item.(map[string]interface{})) == "replace" {
+			return withoutDirectives(patch).([]interface{})
+		}
+	}
+
+	merged := append([]interface{}(nil), dst...)
+	for _, item := range patch {
+		p := item.(map[string]interface{})
+		index := -1
+		for i, d := range merged {
+			if d.(map[string]interface{})[mergeKey] == p[mergeKey] {
+				index = i
+				break
+			}
+		}
+		if patchDirective(p) == "delete" {
+			if index >= 0 {
+				merged = append(merged[:index], merged[index+1:]...)
+			}
+			continue
+		}
+		if index >= 0 {
+			m.merge(merged[index].(map[string]interface{}), p, path)
+		} else {
+			merged = append(merged, withoutDirectives(p))
+		}
+	}
+	return merged
+}
+
+// patchDirective returns the value of a mapping's $patch directive
+func patchDirective(m map[string]interface{}) string {
+	directive, _ := m["$patch"].(string)
+	return directive
+}
+
+// withoutDirectives returns a copy of a value from a patch without any of its
+// directives. Items of lists which are only directives, like the markers
+// "$patch: replace" adds, are dropped along with items to be deleted.
+func withoutDirectives(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			if !strings.HasPrefix(key, "$") {
+				m[key] = withoutDirectives(item)
+			}
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, 0, len(value))
+		for _, item := range value {
+			if m, ok := item.(map[string]interface{}); ok && m["$patch"] != nil && (patchDirective(m) == "delete" || len(m) == 1) {
+				continue
+			}
+			list = append(list, withoutDirectives(item))
+		}
+		return list
+	}
+	return v
+}
+
+// allMappings returns whether every item of list is a mapping
+func allMappings(list []interface{}) bool {
+	for _, item := range list {
+		if _, ok := item.(map[string]interface{}); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// errorAnnotation describes a problem building an overlay
+func (b *kustomizeBuilder) errorAnnotation(err error) *github.CheckRunAnnotation {
+	filename, line := configPath, 1
+	if e, ok := err.(*kustomizeError); ok && e.path != "" {
+		filename, line = e.path, e.line
+	}
+	annotationsAdded.inc("failure", "kustomize")
+	return &github.CheckRunAnnotation{
+		Path:            github.String(filename),
+		BlobHRef:        b.blobHRef(filename),
+		StartLine:       github.Int(line),
+		EndLine:         github.Int(line),
+		AnnotationLevel: github.String("failure"),
+		Title:           github.String("Error building kustomize overlay"),
+		Message:         github.String(fmt.Sprintf("%+v", err)),
+	}
+}
+
+// noticeAnnotation describes why the overlay in dir wasn't built
+func (b *kustomizeBuilder) noticeAnnotation(dir string, e *kustomizeError) *github.CheckRunAnnotation {
+	annotationsAdded.inc("notice", "kustomize")
+	return &github.CheckRunAnnotation{
+		Path:            github.String(e.path),
+		BlobHRef:        b.blobHRef(e.path),
+		StartLine:       github.Int(e.line),
+		EndLine:         github.Int(e.line),
+		AnnotationLevel: github.String("notice"),
+		Title:           github.String("kustomize overlay wasn't validated"),
+		Message:         github.String(fmt.Sprintf("%s, so %s wasn't built or validated.", e.err, dir)),
+	}
+}
+
+func (b *kustomizeBuilder) blobHRef(filename string) *string {
+	if blobHRef := b.source.BlobURL(filename); blobHRef != "" {
+		return &blobHRef
+	}
+	return nil
+}
+
+// kustomizeOutput is the output of building an overlay
+type kustomizeOutput struct {
+	source        Source
+	kustomization string
+	resources     []*kustomizeResource
+	// lines are the lines each resource starts on in the output
+	lines []int
+}
+
+// bytes returns the overlay's resources as a multi-document YAML file
+func (o *kustomizeOutput) bytes() []byte {
+	var buffer bytes.Buffer
+	o.lines = nil
+	line := 1
+	for i, r := range o.resources {
+		if i > 0 {
+			buffer.WriteString("---\n")
+			line++
+		}
+		o.lines = append(o.lines, line)
+		b, _ := yaml.Marshal(r.body)
+		buffer.Write(b)
+		line += bytes.Count(b, []byte("\n"))
+	}
+	return buffer.Bytes()
+}
+
+// annotate moves annotation from the output to the document the resource or
+// property it describes came from. Properties set by patches are annotated on
+// the last patch which set them.
+func (o *kustomizeOutput) annotate(annotation *github.CheckRunAnnotation, result ValidationResult, e gojsonschema.ResultError) {
+	var r *kustomizeResource
+	for i, line := range o.lines {
+		if line == result.Line {
+			r = o.resources[i]
+		}
+	}
+
+	filename, s := o.kustomization, span{start: position{line: 1}, end: position{line: 1}}
+	if r != nil {
+		filename, s = r.origins[0].path, span{start: position{line: r.origins[0].line}, end: position{line: r.origins[0].line}}
+		if e != nil {
+			depth := -1
+			for _, origin := range r.origins {
+				located, d := newYAMLPositions(origin.document, origin.line).locate(e)
+				if d >= depth && located.start.line > 0 {
+					filename, s, depth = origin.path, located, d
+				}
+			}
+		}
+	}
+
+	annotation.Path = github.String(filename)
+	annotation.BlobHRef = nil
+	if blobHRef := o.source.BlobURL(filename); blobHRef != "" {
+		annotation.BlobHRef = &blobHRef
+	}
+	annotation.StartLine, annotation.EndLine = github.Int(s.start.line), github.Int(s.end.line)
+	annotation.StartColumn, annotation.EndColumn = nil, nil
+	if s.start.line == s.end.line && s.start.column > 0 {
+		annotation.StartColumn, annotation.EndColumn = github.Int(s.start.column), github.Int(s.end.column)
+	}
+}
@@ -0,0 +1,223 @@
+package validator
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/github"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func kustomizeTestConfig() *KubeValidatorConfig {
+	return &KubeValidatorConfig{
+		Spec: &KubeValidatorConfigSpec{
+			Kustomize: []*KubeValidatorConfigKustomize{{
+				Overlays: []string{"fixtures/kustomize/overlays/production"},
+				Schemas:  []*KubeValidatorConfigSchema{{Strict: github.Bool(false)}},
+			}},
+		},
+	}
+}
+
+func TestKustomizeOverlaysAreBuiltAndValidated(t *testing.T) {
+	defaultLocation := DefaultSchemaStore.DefaultLocation
+	DefaultSchemaStore.DefaultLocation = fixtureSchemaLocation()
+	defer func() { DefaultSchemaStore.DefaultLocation = defaultLocation }()
+
+	config := kustomizeTestConfig()
+	if !config.Valid() {
+		t.Fatal("Expected a kustomize entry to be valid")
+	}
+	source := &DirectorySource{Dir: ".."}
+
+	candidates, annotations := config.kustomizeCandidates(source, []*File{{Filename: "fixtures/kustomize/overlays/production/deployment-patch.yaml"}})
+	if len(annotations) != 0 {
+		t.Fatalf("Expected the overlay to build, got %s", github.Stringify(annotations))
+	}
+	if len(candidates) != 1 || candidates[0].file.GetFilename() != "fixtures/kustomize/overlays/production/kustomization.yaml" {
+		t.Fatalf("Expected a candidate for the overlay, got %d", len(candidates))
+	}
+	built := string(*candidates[0].bytes)
+	for _, want := range []string{"name: production-example\n", "namespace: production\n", "app: example\n", "image: nginx:1.15\n", "workers: 4\n"} {
+		if !strings.Contains(built, want) {
+			t.Errorf("Expected the output to contain %q:\n%s", want, built)
+		}
+	}
+	if strings.Contains(built, "sidecar") {
+		t.Errorf("Expected the sidecar to be deleted:\n%s", built)
+	}
+
+	annotations = append(candidates.LoadBytes(), candidates.Validate()...)
+	want := []struct {
+		path        string
+		start, end  int
+		startColumn int
+		message     string
+	}{
+		// Properties are annotated on the last patch which set them
+		{"fixtures/kustomize/overlays/production/configmap-patch.yaml", 5, 6, 0, "data: Invalid type. Expected: [string,null], given: integer"},
+		{"fixtures/kustomize/overlays/production/deployment-patch.yaml", 6, 6, 3, "spec.replicas: Invalid type. Expected: integer, given: string"},
+	}
+	if len(annotations) != len(want) {
+		t.Fatalf("Expected %d annotations, got %s", len(want), github.Stringify(annotations))
+	}
+	for i, w := range want {
+		a := annotations[i]
+		if a.GetPath() != w.path || a.GetStartLine() != w.start || a.GetEndLine() != w.end || a.GetStartColumn() != w.startColumn || a.GetMessage() != w.message {
+			t.Errorf("Expected %s:%d-%d %q, got %s", w.path, w.start, w.end, w.message, github.Stringify(a))
+		}
+	}
+}
+
+func TestKustomizeOverlaysAreOnlyBuiltWhenTheirDependenciesChange(t *testing.T) {
+	config := kustomizeTestConfig()
+	source := &DirectorySource{Dir: ".."}
+
+	candidates, annotations := config.kustomizeCandidates(source, []*File{{Filename: "fixtures/deployment.yaml"}})
+	if len(candidates) != 0 || len(annotations) != 0 {
+		t.Errorf("Expected nothing to be built, got %d candidates and %s", len(candidates), github.Stringify(annotations))
+	}
+
+	candidates, _ = config.kustomizeCandidates(source, []*File{{Filename: "fixtures/kustomize/base/configmap.yaml"}})
+	if len(candidates) != 1 {
+		t.Errorf("Expected a change to the base to build the overlay, got %d candidates", len(candidates))
+	}
+}
+
+func TestKustomizeBuildErrorsAreAnnotated(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubevalidator-kustomize")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "overlay"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "overlay", "kustomization.yaml"), []byte("resources:\n- configmap.yaml\n- missing.yaml\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "overlay", "configmap.yaml"), []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n"), 0644)
+
+	config := &KubeValidatorConfig{Spec: &KubeValidatorConfigSpec{
+		Kustomize: []*KubeValidatorConfigKustomize{{Overlays: []string{"overlay"}}},
+	}}
+	source := &DirectorySource{Dir: dir}
+	files, _ := source.Files()
+	candidates, annotations := config.kustomizeCandidates(source, files)
+	if len(candidates) != 0 || len(annotations) != 1 {
+		t.Fatalf("Expected a single annotation, got %d candidates and %s", len(candidates), github.Stringify(annotations))
+	}
+	if a := annotations[0]; a.GetPath() != "overlay/kustomization.yaml" || a.GetStartLine() != 3 || a.GetMessage() != "Couldn't find missing.yaml in the repository" {
+		t.Errorf("Expected the missing resource to be annotated on line 3, got %s", github.Stringify(a))
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "overlay", "kustomization.yaml"), []byte("resources:\n- configmap.yaml\npatchesStrategicMerge:\n- patch.yaml\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "overlay", "patch.yaml"), []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: other\n"), 0644)
+	files, _ = source.Files()
+	candidates, annotations = config.kustomizeCandidates(source, files)
+	if len(candidates) != 0 || len(annotations) != 1 {
+		t.Fatalf("Expected a single annotation, got %d candidates and %s", len(candidates), github.Stringify(annotations))
+	}
+	if a := annotations[0]; a.GetPath() != "overlay/patch.yaml" || a.GetStartLine() != 6 || a.GetMessage() != "No resource matches this patch" {
+		t.Errorf("Expected the unmatched patch to be annotated on line 6, got %s", github.Stringify(a))
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "overlay", "kustomization.yaml"), []byte("resources:\n- configmap.yaml\npatchesStrategicMerge:\n- patch.yaml\nimages:\n- name: nginx\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "overlay", "patch.yaml"), []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n"), 0644)
+	candidates, annotations = config.kustomizeCandidates(source, files)
+	if len(candidates) != 0 || len(annotations) != 1 {
+		t.Fatalf("Expected a single annotation, got %d candidates and %s", len(candidates), github.Stringify(annotations))
+	}
+	if a := annotations[0]; a.GetPath() != "overlay/kustomization.yaml" || a.GetStartLine() != 5 || a.GetAnnotationLevel() != "notice" || !strings.Contains(a.GetMessage(), "doesn't support images") {
+		t.Errorf("Expected a notice about the unsupported field on line 5, got %s", github.Stringify(a))
+	}
+}
+
+func TestKustomizeOverlaysWithRemoteBasesAreSkipped(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubevalidator-kustomize")
+	defer os.RemoveAll(dir)
+	os.MkdirAll(filepath.Join(dir, "base"), 0755)
+	os.MkdirAll(filepath.Join(dir, "overlay"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "base", "kustomization.yaml"), []byte("resources:\n- configmap.yaml\n- github.com/example/repo//config?ref=v1\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "base", "configmap.yaml"), []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "overlay", "kustomization.yaml"), []byte("bases:\n- ../base\n"), 0644)
+
+	config := &KubeValidatorConfig{Spec: &KubeValidatorConfigSpec{
+		Kustomize: []*KubeValidatorConfigKustomize{{Overlays: []string{"overlay"}}},
+	}}
+	source := &DirectorySource{Dir: dir}
+	candidates, annotations := config.kustomizeCandidates(source, []*File{{Filename: "base/configmap.yaml"}})
+	if len(candidates) != 0 || len(annotations) != 1 {
+		t.Fatalf("Expected a single annotation, got %d candidates and %s", len(candidates), github.Stringify(annotations))
+	}
+	if a := annotations[0]; a.GetPath() != "base/kustomization.yaml" || a.GetStartLine() != 3 || a.GetAnnotationLevel() != "notice" || !strings.Contains(a.GetMessage(), "remote bases") {
+		t.Errorf("Expected a notice about the remote base on line 3, got %s", github.Stringify(a))
+	}
+}
+
+func TestMergePatchLeavesSharedListsAlone(t *testing.T) {
+	containers := []interface{}{
+		map[string]interface{}{"name": "a"},
+		map[string]interface{}{"name": "b"},
+	}
+	dst := map[string]interface{}{"spec": map[string]interface{}{"containers": containers[:2]}}
+	patch := map[string]interface{}{"spec": map[string]interface{}{"containers": []interface{}{
+		map[string]interface{}{"name": "a", "$patch": "delete"},
+	}}}
+
+	mergePatch(dst, patch)
+	want := []interface{}{map[string]interface{}{"name": "b"}}
+	if got := dst["spec"].(map[string]interface{})["containers"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if name := containers[0].(map[string]interface{})["name"]; name != "a" {
+		t.Errorf("Expected the original list to be left alone, got %v", containers)
+	}
+}
+
+func TestMergePatch(t *testing.T) {
+	cases := []struct {
+		dst, patch, want string
+	}{
+		{
+			"spec: {replicas: 1, paused: true, containers: [{name: a, image: a}, {name: b, image: b}], args: [x, y]}",
+			"spec: {paused: null, containers: [{name: a, image: a2}, {name: b, $patch: delete}, {name: c}], args: [z]}",
+			"spec: {replicas: 1, containers: [{name: a, image: a2}, {name: c}], args: [z]}",
+		},
+		{
+			"spec: {containers: [{name: a, ports: [{name: http, containerPort: 80}], volumeMounts: [{name: data, mountPath: /a}]}]}",
+			"spec: {containers: [{name: a, ports: [{containerPort: 80, protocol: TCP}], volumeMounts: [{name: data, mountPath: /b}]}]}",
+			"spec: {containers: [{name: a, ports: [{name: http, containerPort: 80, protocol: TCP}], volumeMounts: [{name: data, mountPath: /a}, {name: data, mountPath: /b}]}]}",
+		},
+		{
+			"{kind: Service, spec: {ports: [{name: http, port: 80}, {name: https, port: 443}]}}",
+			"{kind: Service, spec: {ports: [{port: 80, targetPort: 8080}]}}",
+			"{kind: Service, spec: {ports: [{name: http, port: 80, targetPort: 8080}, {name: https, port: 443}]}}",
+		},
+		{
+			"{apiVersion: example.com/v1, kind: Example, spec: {containers: [{name: a}, {name: b}]}}",
+			"{apiVersion: example.com/v1, kind: Example, spec: {containers: [{name: a, image: a}]}}",
+			"{apiVersion: example.com/v1, kind: Example, spec: {containers: [{image: a, name: a}]}}",
+		},
+		{
+			"spec: {containers: [{name: a}], selector: {a: x}}",
+			"spec: {containers: [{name: b, $patch: merge, env: [{name: e, $patch: replace}]}], selector: {$retainKeys: [b], b: y}}",
+			"spec: {containers: [{name: a}, {name: b, env: [{name: e}]}], selector: {a: x, b: y}}",
+		},
+		{
+			"spec: {containers: [{name: a}, {name: b}], selector: {a: x, b: y}, strategy: {type: Recreate}}",
+			"spec: {containers: [{$patch: replace}, {name: c}], selector: {$patch: replace, c: z}, strategy: {$patch: delete}}",
+			"spec: {containers: [{name: c}], selector: {c: z}}",
+		},
+	}
+	for _, c := range cases {
+		var dst, patch, want map[string]interface{}
+		for s, v := range map[string]*map[string]interface{}{c.dst: &dst, c.patch: &patch, c.want: &want} {
+			var body interface{}
+			yaml.Unmarshal([]byte(s), &body)
+			*v = convertToStringKeys(body).(map[string]interface{})
+		}
+
+		mergePatch(dst, patch)
+		if !reflect.DeepEqual(dst, want) {
+			t.Errorf("Expected %v, got %v", want, dst)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package validator
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+// Levels in increasing order of severity
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return strconv.Itoa(int(l))
+}
+
+// ParseLevel parses the name of a Level
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q, expected one of %s", name, strings.Join(levelNames, ", "))
+}
+
+// Logger writes leveled log entries with structured fields as logfmt or
+// JSON
+type Logger struct {
+	out    *syncWriter
+	level  Level
+	json   bool
+	fields []interface{}
+}
+
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// DefaultLogger is used by Contexts and Servers which weren't given a Logger
+var DefaultLogger = NewLogger(os.Stderr, LevelInfo, "logfmt")
+
+// NewLogger returns a Logger which writes entries at level or above to w.
+// format is either logfmt or json.
+func NewLogger(w io.Writer, level Level, format string) *Logger {
+	return &Logger{
+		out:   &syncWriter{w: w},
+		level: level,
+		json:  format == "json",
+	}
+}
+
+// With returns a Logger which adds the given key value pairs to every entry
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{
+		out:    l.out,
+		level:  l.level,
+		json:   l.json,
+		fields: fields,
+	}
+}
+
+// Debug logs msg and keyvals at LevelDebug
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(LevelDebug, msg, keyvals)
+}
+
+// Info logs msg and keyvals at LevelInfo
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(LevelInfo, msg, keyvals)
+}
+
+// Warn logs msg and keyvals at LevelWarn
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(LevelWarn, msg, keyvals)
+}
+
+// Error logs msg and keyvals at LevelError
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(LevelError, msg, keyvals)
+}
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	keys := []string{"time", "level", "msg"}
+	values := []string{time.Now().UTC().Format(time.RFC3339Nano), level.String(), msg}
+	fields := append(append([]interface{}{}, l.fields...), keyvals...)
+	for i := 0; i < len(fields); i += 2 {
+		var value interface{} = "(MISSING)"
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		keys = append(keys, fmt.Sprintf("%v", fields[i]))
+		values = append(values, formatLogValue(value))
+	}
+
+	var line string
+	if l.json {
+		line = jsonLine(keys, values)
+	} else {
+		line = logfmtLine(keys, values)
+	}
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	io.WriteString(l.out.w, line)
+}
+
+func formatLogValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func logfmtLine(keys []string, values []string) string {
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		value := values[i]
+		if value == "" || strings.ContainsAny(value, " =\"\n\t") {
+			value = strconv.Quote(value)
+		}
+		pairs[i] = fmt.Sprintf("%s=%s", key, value)
+	}
+	return strings.Join(pairs, " ") + "\n"
+}
+
+func jsonLine(keys []string, values []string) string {
+	pairs := make([]string, len(keys))
+	for i, key := range keys {
+		k, _ := json.Marshal(key)
+		v, _ := json.Marshal(values[i])
+		pairs[i] = fmt.Sprintf("%s:%s", k, v)
+	}
+	return fmt.Sprintf("{%s}\n", strings.Join(pairs, ","))
+}
@@ -0,0 +1,66 @@
+package validator
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"regexp"
+	"testing"
+)
+
+var logTime = regexp.MustCompile(`^time=\S+ `)
+
+func TestLoggerWritesLogfmt(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LevelInfo, "logfmt").With("delivery", "d", "installation", int64(1))
+	logger.Info("Couldn't do it", "err", errors.New("it broke"), "empty", "")
+
+	want := `level=info msg="Couldn't do it" delivery=d installation=1 err="it broke" empty=""` + "\n"
+	if got := logTime.ReplaceAllString(buf.String(), ""); got != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestLoggerWritesJSON(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LevelInfo, "json").With("repo", "o/r")
+	logger.Warn("hi", "check_run", int64(4), "dangling")
+
+	var entry map[string]string
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"level": "warn", "msg": "hi", "repo": "o/r", "check_run": "4", "dangling": "(MISSING)"}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("Expected %s to be %q, got %q", k, v, entry[k])
+		}
+	}
+	if entry["time"] == "" {
+		t.Error("Expected entries to be timestamped")
+	}
+}
+
+func TestLoggerSkipsEntriesBelowItsLevel(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, LevelWarn, "logfmt")
+	logger.Debug("debug")
+	logger.Info("info")
+	if buf.Len() != 0 {
+		t.Errorf("Expected nothing to be logged, got %s", buf.String())
+	}
+	logger.Error("error")
+	if buf.Len() == 0 {
+		t.Error("Expected errors to be logged")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("DEBUG")
+	if err != nil || level != LevelDebug {
+		t.Errorf("Expected debug, got %s, %v", level, err)
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Error("Expected an error for an unknown level")
+	}
+}
@@ -0,0 +1,262 @@
+package validator
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics is a minimal Prometheus registry which serves the text exposition
+// format
+type Metrics struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// DefaultMetrics holds kubevalidator's metrics
+var DefaultMetrics = &Metrics{}
+
+var (
+	webhooksReceived = DefaultMetrics.newCounterVec(
+		"kubevalidator_webhooks_received_total",
+		"Webhooks received with a valid signature by event and action.",
+		"event", "action")
+	checkSuiteDuration = DefaultMetrics.newHistogramVec(
+		"kubevalidator_check_suite_duration_seconds",
+		"Time taken to process check suites by outcome.",
+		[]float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+		"outcome")
+	checkSuiteCandidates = DefaultMetrics.newHistogramVec(
+		"kubevalidator_check_suite_candidates",
+		"Files validated per check suite.",
+		[]float64{0, 1, 5, 10, 25, 50, 100, 250, 500, 1000})
+	checkRunsCompleted = DefaultMetrics.newCounterVec(
+		"kubevalidator_check_runs_completed_total",
+		"Check runs completed by conclusion.",
+		"conclusion")
+	annotationsAdded = DefaultMetrics.newCounterVec(
+		"kubevalidator_annotations_total",
+		"Annotations produced by level and kind.",
+		"level", "kind")
+	schemaFetchDuration = DefaultMetrics.newHistogramVec(
+		"kubevalidator_schema_fetch_duration_seconds",
+		"Time taken to load schemas which weren't cached in memory by kind of schema location: default, custom or file.",
+		[]float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		"location")
+	schemaFetchFailures = DefaultMetrics.newCounterVec(
+		"kubevalidator_schema_fetch_failures_total",
+		"Schemas which couldn't be loaded by kind of schema location and reason.",
+		"location", "reason")
+	githubRequests = DefaultMetrics.newCounterVec(
+		"kubevalidator_github_requests_total",
+		"Requests made to the GitHub API by method and outcome.",
+		"method", "outcome")
+	githubRequestDuration = DefaultMetrics.newHistogramVec(
+		"kubevalidator_github_request_duration_seconds",
+		"Time taken by requests to the GitHub API by method.",
+		[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10},
+		"method")
+)
+
+// collector writes metrics in the text exposition format
+type collector interface {
+	write(w io.Writer)
+}
+
+func (m *Metrics) register(c collector) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.collectors = append(m.collectors, c)
+}
+
+// ServeHTTP writes every metric in the text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.mu.Lock()
+	collectors := m.collectors
+	m.mu.Unlock()
+	for _, c := range collectors {
+		c.write(w)
+	}
+}
+
+// labelKey joins label values into a map key
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// labelValueEscaper escapes label values as the text exposition format
+// expects, which unlike Go only escapes backslashes, quotes and newlines
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders label names and the values joined in key
+func formatLabels(names []string, key string, extra ...string) string {
+	var pairs []string
+	if len(names) > 0 {
+		for i, value := range strings.Split(key, "\xff") {
+			pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", names[i], labelValueEscaper.Replace(value)))
+		}
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[i], labelValueEscaper.Replace(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("{%s}", strings.Join(pairs, ","))
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// counterVec is a counter partitioned by labels
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (m *Metrics) newCounterVec(name string, help string, labels ...string) *counterVec {
+	c := &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+	m.register(c)
+	return c
+}
+
+// inc adds one to the counter with the given label values
+func (c *counterVec) inc(values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelKey(values)]++
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, k), formatFloat(c.values[k]))
+	}
+}
+
+// histogramVec is a histogram partitioned by labels
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (m *Metrics) newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	h := &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+	m.register(h)
+	return h
+}
+
+// observe records v in the histogram with the given label values
+func (h *histogramVec) observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := labelKey(values)
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+		}
+	}
+	hist.count++
+	hist.sum += v
+}
+
+// since records the seconds elapsed since start
+func (h *histogramVec) since(start time.Time, values ...string) {
+	h.observe(time.Since(start).Seconds(), values...)
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hist := h.values[k]
+		for i, bound := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", formatFloat(bound)), hist.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, k), formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, k), hist.count)
+	}
+}
+
+// instrumentedTransport counts requests to the GitHub API by their outcome
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+// InstrumentTransport returns a RoundTripper which records the outcome of
+// every request made through next
+func InstrumentTransport(next http.RoundTripper) http.RoundTripper {
+	return &instrumentedTransport{next: next}
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	githubRequestDuration.since(start, req.Method)
+	githubRequests.inc(req.Method, requestOutcome(resp, err))
+	return resp, err
+}
+
+// requestOutcome summarizes a response as error, rate_limited or the class
+// of its status code
+func requestOutcome(resp *http.Response, err error) string {
+	if err != nil {
+		return "error"
+	}
+	if resp.StatusCode == http.StatusForbidden && resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		return "rate_limited"
+	}
+	return fmt.Sprintf("%dxx", resp.StatusCode/100)
+}
@@ -0,0 +1,73 @@
+package validator
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsExpositionFormat(t *testing.T) {
+	m := &Metrics{}
+	counter := m.newCounterVec("test_total", "A counter.", "event", "action")
+	histogram := m.newHistogramVec("test_seconds", "A histogram.", []float64{1, 5})
+	counter.inc("check_suite", "requested")
+	counter.inc("check_suite", "requested")
+	counter.inc("pull_request", `"quoted"`)
+	counter.inc("push", "back\\slash\nnewline é")
+	histogram.observe(0.5)
+	histogram.observe(3)
+
+	w := httptest.NewRecorder()
+	m.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+
+	want := `# HELP test_total A counter.
+# TYPE test_total counter
+test_total{event="check_suite",action="requested"} 2
+test_total{event="pull_request",action="\"quoted\""} 1
+test_total{event="push",action="back\\slash\nnewline é"} 1
+# HELP test_seconds A histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{le="1"} 1
+test_seconds_bucket{le="5"} 2
+test_seconds_bucket{le="+Inf"} 2
+test_seconds_sum 3.5
+test_seconds_count 2
+`
+	if got := w.Body.String(); got != want {
+		t.Errorf("Expected:\n%s\ngot:\n%s", want, got)
+	}
+	if contentType := w.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("Unexpected content type %s", contentType)
+	}
+}
+
+func TestInstrumentedTransportRecordsOutcomes(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/limited" {
+			w.Header().Set("X-RateLimit-Remaining", "0")
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: InstrumentTransport(http.DefaultTransport)}
+	client.Get(server.URL + "/limited")
+	client.Get(server.URL + "/broken")
+	client.Get("http://127.0.0.1:0/")
+
+	w := httptest.NewRecorder()
+	DefaultMetrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{
+		`kubevalidator_github_requests_total{method="GET",outcome="rate_limited"}`,
+		`kubevalidator_github_requests_total{method="GET",outcome="5xx"}`,
+		`kubevalidator_github_requests_total{method="GET",outcome="error"}`,
+		`kubevalidator_github_request_duration_seconds_count{method="GET"}`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("Expected metrics to include %s", want)
+		}
+	}
+}
@@ -0,0 +1,338 @@
+package validator
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/xeipuuv/gojsonschema"
+	"gopkg.in/yaml.v3"
+)
+
+// position is a line and column in a YAML document, both counted from 1
+type position struct {
+	line   int
+	column int
+}
+
+// before returns whether p comes before q
+func (p position) before(q position) bool {
+	return p.line < q.line || (p.line == q.line && p.column < q.column)
+}
+
+// span is the range of a node in a YAML document. end is the position of its
+// last character.
+type span struct {
+	start position
+	end   position
+}
+
+// yamlNode records where a node of a YAML document is
+type yamlNode struct {
+	// head is the key of a mapping entry or the dash of a sequence item. It's
+	// empty for the root of the document.
+	head span
+	// full covers the head along with the node's value
+	full span
+	// children are keyed by mapping key or sequence index
+	children map[string]*yamlNode
+}
+
+// yamlPositions indexes the position of every node in a YAML document so that
+// validation errors can be annotated where they occur. Block mappings and
+// sequences are indexed node by node, while scalars and flow collections are
+// indexed as a whole.
+type yamlPositions struct {
+	root *yamlNode
+}
+
+// newYAMLPositions indexes the single YAML document in b, which starts on
+// firstLine of its file. Nothing is indexed if b can't be parsed.
+func newYAMLPositions(b []byte, firstLine int) *yamlPositions {
+	root := &yamlNode{}
+	var document yaml.Node
+	if err := yaml.Unmarshal(b, &document); err != nil || len(document.Content) == 0 {
+		return &yamlPositions{root: root}
+	}
+	content := document.Content[0]
+	ix := &yamlIndexer{lines: strings.Split(string(b), "\n"), firstLine: firstLine, verbatim: make(map[int]bool)}
+	ix.index(content, root)
+
+	line, offset := ix.locate(content)
+	root.full = span{start: ix.position(line, offset), end: ix.lastBefore(len(ix.lines), 0)}
+	for _, entry := range ix.entries {
+		line, offset := len(ix.lines), 0
+		if entry.next < len(ix.entries) {
+			next := ix.entries[entry.next].node.head.start
+			line, offset = next.line-firstLine, next.column-1
+		}
+		end := ix.lastBefore(line, offset)
+		if end.before(entry.node.head.end) {
+			end = entry.node.head.end
+		}
+		entry.node.full = span{start: entry.node.head.start, end: end}
+	}
+	return &yamlPositions{root: root}
+}
+
+// lookup returns the node at path, or its deepest ancestor which was indexed
+// along with false
+func (y *yamlPositions) lookup(path []string) (*yamlNode, bool) {
+	node, depth := y.deepest(path)
+	return node, depth == len(path)
+}
+
+// deepest returns the deepest node along path which was indexed and the
+// number of keys of path leading to it
+func (y *yamlPositions) deepest(path []string) (*yamlNode, int) {
+	node := y.root
+	for i, key := range path {
+		child, ok := node.children[key]
+		if !ok {
+			return node, i
+		}
+		node = child
+	}
+	return node, len(path)
+}
+
+// locate returns the span a validation error should be annotated on along
+// with the number of keys of the error's path which were found. Missing
+// required properties are reported on the mapping they're missing from and
+// additional properties on the property itself. The span is empty if the
+// document had no content.
+func (y *yamlPositions) locate(e gojsonschema.ResultError) (span, int) {
+	path := contextPath(e.Context())
+	switch e.Type() {
+	case "required":
+		node, depth := y.deepest(path)
+		if node.head != (span{}) {
+			return node.head, depth
+		}
+		return node.full, depth
+	case "additional_property_not_allowed":
+		path = append(path, fmt.Sprintf("%v", e.Details()["property"]))
+	}
+	node, depth := y.deepest(path)
+	return node.full, depth
+}
+
+// contextPath splits the context of a validation error into the keys and
+// indexes leading to it from the root of the document
+func contextPath(context *gojsonschema.JsonContext) []string {
+	if context == nil {
+		return nil
+	}
+	// Keys may contain dots, so join them with something they can't
+	return strings.Split(context.String("\x00"), "\x00")[1:]
+}
+
+// stripYAMLComment removes a comment from the end of a line, ignoring #s in
+// quoted strings
+func stripYAMLComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote == '"' && c == '\\', quote == '\'' && c == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '#' && (i == 0 || text[i-1] == ' ' || text[i-1] == '\t'):
+			return text[:i]
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" \t:[{,-", text[i-1]) >= 0):
+			quote = c
+		}
+	}
+	return text
+}
+
+// keyEnd returns the offset of the last character of the mapping key n in
+// text, which starts with it, or 0 if it can't be found
+func keyEnd(n *yaml.Node, text string) int {
+	switch {
+	case text == "":
+		return 0
+	case n.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0:
+		if end := closingQuote(text, 0); end > 0 {
+			return end
+		}
+	case n.Style == 0 && n.Value != "" && strings.HasPrefix(text, n.Value):
+		return len(n.Value) - 1
+	}
+	return 0
+}
+
+// closingQuote returns the offset of the quote closing the string which
+// starts at offset start of text, or -1 if it isn't closed on this line
+func closingQuote(text string, start int) int {
+	quote := text[start]
+	for i := start + 1; i < len(text); i++ {
+		switch {
+		case quote == '"' && text[i] == '\\':
+			i++
+		case text[i] == quote && quote == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			i++
+		case text[i] == quote:
+			return i
+		}
+	}
+	return -1
+}
+
+// yamlEntry is a mapping entry or sequence item in the order it appears in
+// a document. next is the index of the first entry after it which isn't one
+// of its descendants.
+type yamlEntry struct {
+	node *yamlNode
+	next int
+}
+
+// yamlIndexer builds the index of a document from its yaml.v3 nodes, which
+// know where they start but not where they end. Each entry is taken to end
+// at the last character before the next entry which isn't one of its
+// descendants, ignoring whitespace and comments.
+type yamlIndexer struct {
+	lines     []string
+	firstLine int
+	entries   []yamlEntry
+	// verbatim holds the lines inside block scalars, where # doesn't start a
+	// comment
+	verbatim map[int]bool
+}
+
+// index records the entries of the block collection n in node
+func (ix *yamlIndexer) index(n *yaml.Node, node *yamlNode) {
+	switch {
+	case n.Kind == yaml.ScalarNode && n.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0:
+		ix.markBlockScalar(n)
+	case n.Style&yaml.FlowStyle != 0:
+	case n.Kind == yaml.MappingNode:
+		node.children = make(map[string]*yamlNode)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			if key.Kind != yaml.ScalarNode {
+				continue
+			}
+			line, offset := ix.locate(key)
+			end := offset + keyEnd(key, ix.lines[line][offset:])
+			child := &yamlNode{head: span{start: ix.position(line, offset), end: ix.position(line, end)}}
+			node.children[key.Value] = child
+			ix.add(child, n.Content[i+1])
+		}
+	case n.Kind == yaml.SequenceNode:
+		node.children = make(map[string]*yamlNode)
+		for i, item := range n.Content {
+			line, offset := ix.dash(ix.locate(item))
+			dash := ix.position(line, offset)
+			child := &yamlNode{head: span{start: dash, end: dash}}
+			node.children[fmt.Sprintf("%d", i)] = child
+			ix.add(child, item)
+		}
+	}
+}
+
+// add records the entry node, whose value is n, along with its descendants
+func (ix *yamlIndexer) add(node *yamlNode, n *yaml.Node) {
+	i := len(ix.entries)
+	ix.entries = append(ix.entries, yamlEntry{node: node})
+	ix.index(n, node)
+	ix.entries[i].next = len(ix.entries)
+}
+
+// locate returns the line and byte offset n starts at. yaml.v3 counts
+// columns in characters.
+func (ix *yamlIndexer) locate(n *yaml.Node) (int, int) {
+	line := n.Line - 1
+	if line < 0 || line >= len(ix.lines) {
+		return 0, 0
+	}
+	text := ix.lines[line]
+	offset := 0
+	for column := 1; column < n.Column && offset < len(text); column++ {
+		_, size := utf8.DecodeRuneInString(text[offset:])
+		offset += size
+	}
+	return line, offset
+}
+
+// position converts a line and byte offset to a position in the file
+func (ix *yamlIndexer) position(line, offset int) position {
+	return position{line: line + ix.firstLine, column: offset + 1}
+}
+
+// dash returns the line and offset of the dash introducing the sequence item
+// which starts at line and offset, or the item's start if there isn't one
+func (ix *yamlIndexer) dash(line, offset int) (int, int) {
+	for i := line; i >= 0; i-- {
+		text := ix.lines[i]
+		if i == line {
+			text = text[:offset]
+		} else if !ix.verbatim[i] {
+			text = stripYAMLComment(text)
+		}
+		text = strings.TrimRight(text, " \t\r")
+		if text == "" {
+			continue
+		}
+		if strings.HasSuffix(text, "-") {
+			return i, len(text) - 1
+		}
+		break
+	}
+	return line, offset
+}
+
+// markBlockScalar records the lines of the block scalar n's content, which
+// are those following its header which are indented at least as much as the
+// first of them
+func (ix *yamlIndexer) markBlockScalar(n *yaml.Node) {
+	indent := -1
+	for i := n.Line; i < len(ix.lines); i++ {
+		text := strings.TrimRight(ix.lines[i], " \t\r")
+		if text == "" {
+			continue
+		}
+		lineIndent := len(text) - len(strings.TrimLeft(text, " "))
+		if indent < 0 {
+			indent = lineIndent
+		}
+		if lineIndent < indent || lineIndent == 0 {
+			return
+		}
+		ix.verbatim[i] = true
+	}
+}
+
+// lastBefore returns the position of the last character before offset on
+// line which isn't whitespace or part of a comment. line may be the number
+// of lines to search the whole document. The dashes of sequence items
+// starting on line are ignored along with its indentation.
+func (ix *yamlIndexer) lastBefore(line, offset int) position {
+	for i := line; i >= 0; i-- {
+		if i >= len(ix.lines) {
+			continue
+		}
+		text := ix.lines[i]
+		if i == line {
+			text = text[:offset]
+			if strings.Trim(text, " \t-") == "" {
+				continue
+			}
+		}
+		if !ix.verbatim[i] {
+			trimmed := strings.TrimLeft(text, " \t")
+			trimmed = strings.TrimRight(stripYAMLComment(trimmed), " \t\r")
+			if trimmed == "---" || trimmed == "..." || strings.HasPrefix(trimmed, "%") {
+				continue
+			}
+			text = text[:len(text)-len(strings.TrimLeft(text, " \t"))] + trimmed
+		}
+		if text = strings.TrimRight(text, " \t\r"); text != "" {
+			return ix.position(i, len(text)-1)
+		}
+	}
+	return position{}
+}
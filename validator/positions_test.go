@@ -0,0 +1,108 @@
+package validator
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestYAMLPositions(t *testing.T) {
+	document := strings.Join([]string{
+		`---`,
+		`# comment`,
+		`"quoted key": 'it''s # not a comment' # comment`,
+		`anchored: &anchor`,
+		`  nested: true`,
+		`script: |`,
+		`  #!/bin/sh`,
+		`  echo hello`,
+		``,
+		`flow: {a: 1,`,
+		`  b: [2, 3]}`,
+		`multiline: "one`,
+		`  two"`,
+		`items:`,
+		`- - a`,
+		`  - b`,
+		`-`,
+		`  plain`,
+		`  continued`,
+		`- key: value`,
+		`  list:`,
+		`  - x`,
+		`empty:`,
+		`url: http://example.com`,
+	}, "\n")
+	positions := newYAMLPositions([]byte(document), 1)
+
+	cases := []struct {
+		path string
+		head span
+		full span
+	}{
+		{"", span{}, span{position{3, 1}, position{24, 23}}},
+		{"quoted key", span{position{3, 1}, position{3, 12}}, span{position{3, 1}, position{3, 37}}},
+		{"anchored", span{position{4, 1}, position{4, 8}}, span{position{4, 1}, position{5, 14}}},
+		{"anchored.nested", span{position{5, 3}, position{5, 8}}, span{position{5, 3}, position{5, 14}}},
+		{"script", span{position{6, 1}, position{6, 6}}, span{position{6, 1}, position{8, 12}}},
+		{"flow", span{position{10, 1}, position{10, 4}}, span{position{10, 1}, position{11, 12}}},
+		{"multiline", span{position{12, 1}, position{12, 9}}, span{position{12, 1}, position{13, 6}}},
+		{"items.0", span{position{15, 1}, position{15, 1}}, span{position{15, 1}, position{16, 5}}},
+		{"items.0.1", span{position{16, 3}, position{16, 3}}, span{position{16, 3}, position{16, 5}}},
+		{"items.1", span{position{17, 1}, position{17, 1}}, span{position{17, 1}, position{19, 11}}},
+		{"items.2.key", span{position{20, 3}, position{20, 5}}, span{position{20, 3}, position{20, 12}}},
+		{"items.2.list.0", span{position{22, 3}, position{22, 3}}, span{position{22, 3}, position{22, 5}}},
+		{"empty", span{position{23, 1}, position{23, 5}}, span{position{23, 1}, position{23, 6}}},
+		{"url", span{position{24, 1}, position{24, 3}}, span{position{24, 1}, position{24, 23}}},
+	}
+	for _, c := range cases {
+		var path []string
+		if c.path != "" {
+			path = strings.Split(c.path, ".")
+		}
+		node, ok := positions.lookup(path)
+		if !ok {
+			t.Errorf("%q wasn't indexed", c.path)
+			continue
+		}
+		if node.head != c.head || node.full != c.full {
+			t.Errorf("%q: expected head %v and full %v, got %v and %v", c.path, c.head, c.full, node.head, node.full)
+		}
+	}
+}
+
+func TestYAMLPositionsLookupFallsBackToAncestors(t *testing.T) {
+	positions := newYAMLPositions([]byte("spec:\n  template: {metadata: {}}\n"), 1)
+
+	node, ok := positions.lookup([]string{"spec", "template", "metadata", "name"})
+	if ok {
+		t.Error("Expected a property inside a flow mapping not to be indexed")
+	}
+	if want := (span{position{2, 3}, position{2, 26}}); node.full != want {
+		t.Errorf("Expected the flow mapping %v, got %v", want, node.full)
+	}
+}
+
+func TestYAMLPositionsCountColumnsInBytes(t *testing.T) {
+	positions := newYAMLPositions([]byte("---\nnäme: 'ünï'\nnext: 1\n"), 10)
+
+	node, ok := positions.lookup([]string{"näme"})
+	if !ok {
+		t.Fatal("Expected a key with multibyte characters to be indexed")
+	}
+	if want := (span{position{11, 1}, position{11, 5}}); node.head != want {
+		t.Errorf("Expected the key %v, got %v", want, node.head)
+	}
+	if want := (span{position{11, 1}, position{11, 14}}); node.full != want {
+		t.Errorf("Expected the entry %v, got %v", want, node.full)
+	}
+	if node, _ := positions.lookup([]string{"next"}); node.head.start != (position{12, 1}) {
+		t.Errorf("Expected the next key on line 12, got %v", node.head.start)
+	}
+}
+
+func TestYAMLPositionsOfUnparseableDocumentsAreEmpty(t *testing.T) {
+	positions := newYAMLPositions([]byte("a: b: c\n"), 1)
+	if node, ok := positions.lookup(nil); !ok || node.full != (span{}) || node.children != nil {
+		t.Errorf("Expected nothing to be indexed, got %v", node)
+	}
+}
@@ -0,0 +1,197 @@
+package validator
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// ErrQueueFull is returned when a Job is enqueued on a Queue which has no room
+// left for it
+var ErrQueueFull = errors.New("queue is full")
+
+// ErrQueueStopped is returned when a Job is enqueued on a Queue which has
+// been stopped
+var ErrQueueStopped = errors.New("queue is stopped")
+
+// Job is a unit of work run by a Queue
+type Job struct {
+	// Repo is the full name of the repository the job acts on. Jobs for the
+	// same repository run one at a time in the order they were enqueued.
+	Repo string
+	Run  func()
+}
+
+// Queue runs jobs on a fixed pool of workers so that webhooks can be
+// acknowledged before they're processed
+type Queue struct {
+	jobs    chan *Job
+	workers int
+	wg      sync.WaitGroup
+
+	mu sync.Mutex
+	// busy holds the jobs waiting for the job running for each repository
+	busy map[string][]*Job
+	// pending counts the jobs which haven't started, whether they're in jobs
+	// or busy, so that waiting jobs count against the queue's capacity
+	pending int
+	stopped bool
+	// abandoned is set when a Drain times out so that jobs which haven't
+	// started are dropped
+	abandoned bool
+}
+
+// NewQueue returns a Queue which holds up to size jobs and runs them on the
+// given number of workers
+func NewQueue(size int, workers int) *Queue {
+	if workers < 1 {
+		workers = 1
+	}
+	return &Queue{
+		jobs:    make(chan *Job, size),
+		workers: workers,
+		busy:    make(map[string][]*Job),
+	}
+}
+
+// Start starts the workers
+func (q *Queue) Start() {
+	for i := 0; i < q.workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// Stop stops accepting jobs and waits for those already enqueued to finish
+func (q *Queue) Stop() {
+	q.Drain(context.Background())
+}
+
+// Drain stops accepting jobs and waits for those already enqueued to finish,
+// returning true if they did. If ctx is done first, jobs which haven't started
+// are dropped and false is returned without waiting for running jobs; use
+// Wait to wait for them.
+func (q *Queue) Drain(ctx context.Context) bool {
+	q.mu.Lock()
+	if !q.stopped {
+		q.stopped = true
+		close(q.jobs)
+	}
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		q.mu.Lock()
+		q.abandoned = true
+		q.mu.Unlock()
+		return false
+	}
+}
+
+// Wait waits for the workers to exit once the queue has been drained
+func (q *Queue) Wait() {
+	q.wg.Wait()
+}
+
+// Enqueue adds job to the queue without blocking, returning ErrQueueFull if
+// there's no room for it or ErrQueueStopped if the queue has been drained
+func (q *Queue) Enqueue(job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.stopped {
+		return ErrQueueStopped
+	}
+	if q.pending >= cap(q.jobs) {
+		return ErrQueueFull
+	}
+	// jobs never holds more than pending, so this doesn't block
+	q.jobs <- job
+	q.pending++
+	return nil
+}
+
+// Depth returns the number of jobs which haven't started running
+func (q *Queue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+// Capacity returns the number of jobs the queue can hold
+func (q *Queue) Capacity() int {
+	return cap(q.jobs)
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for job := range q.jobs {
+		if q.isAbandoned() {
+			q.drop()
+			continue
+		}
+		if !q.claim(job) {
+			continue
+		}
+		for job != nil && !q.isAbandoned() {
+			job.Run()
+			job = q.next(job.Repo)
+		}
+	}
+}
+
+func (q *Queue) isAbandoned() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.abandoned
+}
+
+// drop forgets a job which won't be run
+func (q *Queue) drop() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pending--
+}
+
+// claim marks job's repository busy, returning false and holding on to job
+// until the repository is free if another job for it is running
+func (q *Queue) claim(job *Job) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if job.Repo == "" {
+		q.pending--
+		return true
+	}
+	if waiting, ok := q.busy[job.Repo]; ok {
+		q.busy[job.Repo] = append(waiting, job)
+		return false
+	}
+	q.busy[job.Repo] = nil
+	q.pending--
+	return true
+}
+
+// next returns the next job waiting for repo, marking it free if there isn't
+// one
+func (q *Queue) next(repo string) *Job {
+	if repo == "" {
+		return nil
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	waiting := q.busy[repo]
+	if len(waiting) == 0 {
+		delete(q.busy, repo)
+		return nil
+	}
+	q.busy[repo] = waiting[1:]
+	q.pending--
+	return waiting[0]
+}
@@ -0,0 +1,158 @@
+package validator
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQueueSerializesJobsForARepository(t *testing.T) {
+	q := NewQueue(20, 4)
+	q.Start()
+
+	var mu sync.Mutex
+	running := make(map[string]int)
+	var order []int
+	for i := 0; i < 10; i++ {
+		i := i
+		repo := "o/a"
+		if i%2 == 1 {
+			repo = "o/b"
+		}
+		err := q.Enqueue(&Job{
+			Repo: repo,
+			Run: func() {
+				mu.Lock()
+				running[repo]++
+				if running[repo] > 1 {
+					t.Errorf("More than one job ran for %s at once", repo)
+				}
+				if repo == "o/a" {
+					order = append(order, i)
+				}
+				mu.Unlock()
+
+				time.Sleep(time.Millisecond)
+
+				mu.Lock()
+				running[repo]--
+				mu.Unlock()
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.Stop()
+
+	for i, job := range order {
+		if job != i*2 {
+			t.Fatalf("Expected jobs for o/a to run in order, got %v", order)
+		}
+	}
+	if len(order) != 5 {
+		t.Errorf("Expected 5 jobs for o/a to run, got %d", len(order))
+	}
+}
+
+func TestQueueRejectsJobsWhenFull(t *testing.T) {
+	q := NewQueue(1, 1)
+	if err := q.Enqueue(&Job{Run: func() {}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(&Job{Run: func() {}}); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	if depth := q.Depth(); depth != 1 {
+		t.Errorf("Expected a depth of 1, got %d", depth)
+	}
+	q.Start()
+	q.Stop()
+	if depth := q.Depth(); depth != 0 {
+		t.Errorf("Expected a depth of 0, got %d", depth)
+	}
+}
+
+func TestQueueDepthIncludesJobsWaitingForTheirRepository(t *testing.T) {
+	q := NewQueue(10, 2)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	q.Start()
+	defer q.Stop()
+
+	q.Enqueue(&Job{Repo: "o/r", Run: func() {
+		close(started)
+		<-release
+	}})
+	<-started
+	q.Enqueue(&Job{Repo: "o/r", Run: func() {}})
+
+	// The second job is picked up by the idle worker and left waiting
+	deadline := time.Now().Add(time.Second)
+	for q.Depth() != 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if depth := q.Depth(); depth != 1 {
+		t.Errorf("Expected a depth of 1, got %d", depth)
+	}
+	close(release)
+}
+
+func TestQueueCountsJobsWaitingForTheirRepositoryAgainstItsCapacity(t *testing.T) {
+	q := NewQueue(2, 2)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	q.Start()
+	defer q.Stop()
+
+	q.Enqueue(&Job{Repo: "o/r", Run: func() {
+		close(started)
+		<-release
+	}})
+	<-started
+	for i := 0; i < 2; i++ {
+		if err := q.Enqueue(&Job{Repo: "o/r", Run: func() {}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Both jobs are picked up by the idle worker and left waiting, which
+	// mustn't make room for more
+	time.Sleep(10 * time.Millisecond)
+	if err := q.Enqueue(&Job{Repo: "o/r", Run: func() {}}); err != ErrQueueFull {
+		t.Errorf("Expected ErrQueueFull, got %v", err)
+	}
+	if depth := q.Depth(); depth > q.Capacity() {
+		t.Errorf("Expected a depth of at most %d, got %d", q.Capacity(), depth)
+	}
+	close(release)
+}
+
+func TestQueueDrainDropsJobsWhichHaventStartedOnceItTimesOut(t *testing.T) {
+	q := NewQueue(10, 1)
+	release := make(chan struct{})
+	started := make(chan struct{})
+	q.Start()
+	q.Enqueue(&Job{Run: func() {
+		close(started)
+		<-release
+	}})
+	ran := false
+	q.Enqueue(&Job{Run: func() { ran = true }})
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if q.Drain(ctx) {
+		t.Error("Expected the drain to time out")
+	}
+	if err := q.Enqueue(&Job{Run: func() {}}); err != ErrQueueStopped {
+		t.Errorf("Expected ErrQueueStopped, got %v", err)
+	}
+	close(release)
+	q.Wait()
+	if ran {
+		t.Error("Expected the job which hadn't started to be dropped")
+	}
+}
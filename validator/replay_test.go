@@ -0,0 +1,80 @@
+package validator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-github/github"
+	"github.com/urcomputeringpal/kubevalidator/fakegithub"
+)
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+// TestReplayCheckSuite processes a check suite against a fake GitHub serving
+// each directory in fixtures/replay, comparing the check runs posted with
+// the directory's check_runs.golden.json. Run with -update after changing
+// what kubevalidator posts.
+func TestReplayCheckSuite(t *testing.T) {
+	defaultLocation := DefaultSchemaStore.DefaultLocation
+	DefaultSchemaStore.DefaultLocation = fixtureSchemaLocation()
+	defer func() { DefaultSchemaStore.DefaultLocation = defaultLocation }()
+
+	payload, err := ioutil.ReadFile("../fixtures/replay/check_suite.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"no-config", "invalid-config", "no-matching-files", "scope-all", "success", "failure"} {
+		t.Run(name, func(t *testing.T) {
+			dir := filepath.Join("../fixtures/replay", name)
+			fake := fakegithub.New(dir)
+			defer fake.Close()
+
+			event, err := github.ParseWebHook("check_suite", payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx := context.Background()
+			appID := 1
+			c := &Context{
+				Event:  event,
+				Github: fake.Client(),
+				Ctx:    &ctx,
+				AppID:  &appID,
+				Log:    NewLogger(ioutil.Discard, LevelInfo, "logfmt"),
+			}
+			processed, err := c.Process()
+			if err != nil {
+				t.Fatalf("Unexpected error: %+v", err)
+			}
+			if !processed {
+				t.Error("Expected the check suite to be processed")
+			}
+
+			got, err := json.MarshalIndent(fake.CheckRuns(), "", "  ")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			golden := filepath.Join(dir, "check_runs.golden.json")
+			if *updateGolden {
+				if err := ioutil.WriteFile(golden, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Check runs didn't match %s, run with -update if the change is expected:\n%s", golden, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package validator
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"runtime"
+
+	"github.com/xeipuuv/gojsonschema"
+	yaml "gopkg.in/yaml.v2"
+)
+
+var (
+	apiVersionPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9.-]*[a-z0-9])?/)?v[0-9]+((alpha|beta)[0-9]*)?$`)
+	kindPattern       = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+)
+
+// Validator validates Kubernetes resources against a single set of schemas.
+// Its options are fixed when it's created rather than read from kubeval's
+// package-level variables, so a Validator can safely be used from many
+// goroutines at once.
+type Validator struct {
+	// Location is the URL of a copy of kubernetes-json-schema
+	Location string
+	// Version is the Kubernetes version whose schemas are used
+	Version string
+	// Strict prohibits properties which aren't in the schema
+	Strict bool
+	// OpenShift selects the OpenShift schema layout
+	OpenShift bool
+	// Store loads and caches schemas
+	Store *SchemaStore
+	// CustomResources are consulted before Store for the schemas of custom
+	// resources
+	CustomResources customResourceSchemas
+}
+
+// NewValidator returns a Validator configured by schema which loads schemas
+// from store
+func NewValidator(schema *KubeValidatorConfigSchema, store *SchemaStore) *Validator {
+	return &Validator{
+		Location:  store.LocationFor(schema),
+		Version:   schema.Version,
+		Strict:    schema.StrictMode(),
+		OpenShift: schema.ConfigType == "openshift",
+		Store:     store,
+	}
+}
+
+// ValidationResult contains the details from validating a single resource
+type ValidationResult struct {
+	FileName   string
+	Kind       string
+	APIVersion string
+	Errors     []gojsonschema.ResultError
+	// Err is set when the resource couldn't be validated at all. It's an
+	// *invalidResourceError, *missingSchemaError or *schemaLoadError.
+	Err error
+
+	// Offset is the byte offset of the resource's document in the file
+	Offset int
+	// Line is the line of the file the resource's document starts on
+	Line int
+
+	// positions locates Errors in the file
+	positions *yamlPositions
+}
+
+// invalidResourceError is returned for documents which aren't well formed
+// Kubernetes resources
+type invalidResourceError struct {
+	reason string
+}
+
+func (e *invalidResourceError) Error() string {
+	return e.reason
+}
+
+// Validate splits a YAML file into its resources and validates each of them
+// against the schema for its kind. It behaves like kubeval.Validate, except
+// that problems loading a resource's schema are reported on its result
+// rather than preventing the rest of the file from being validated.
+func (v *Validator) Validate(config []byte, fileName string) []ValidationResult {
+	results := make([]ValidationResult, 0)
+
+	if len(config) == 0 {
+		results = append(results, ValidationResult{FileName: fileName})
+		return results
+	}
+
+	lineBreak := detectLineBreak(config)
+	separator := []byte(lineBreak + "---" + lineBreak)
+	bits := bytes.Split(config, separator)
+
+	// Track where each document starts so that errors can be located in the
+	// file rather than the document
+	offset, line := 0, 1
+	for _, element := range bits {
+		if len(element) > 0 {
+			results = append(results, v.validateResource(element, fileName, offset, line))
+		} else {
+			results = append(results, ValidationResult{FileName: fileName, Offset: offset, Line: line})
+		}
+		offset += len(element) + len(separator)
+		line += bytes.Count(element, []byte("\n")) + bytes.Count(separator, []byte("\n"))
+	}
+	return results
+}
+
+// validateResource validates a single Kubernetes resource against the schema
+// for its kind. offset and line locate the resource's document in the file.
+func (v *Validator) validateResource(data []byte, fileName string, offset int, line int) ValidationResult {
+	result := ValidationResult{FileName: fileName, Offset: offset, Line: line}
+
+	var spec interface{}
+	err := yaml.Unmarshal(data, &spec)
+	if err != nil {
+		result.Err = &invalidResourceError{reason: "Failed to decode YAML from " + fileName}
+		return result
+	}
+
+	body := convertToStringKeys(spec)
+	if body == nil {
+		return result
+	}
+	cast, _ := body.(map[string]interface{})
+	if len(cast) == 0 {
+		return result
+	}
+
+	kind, err := stringField(cast, "kind")
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.Kind = kind
+
+	apiVersion, err := stringField(cast, "apiVersion")
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	result.APIVersion = apiVersion
+
+	if !apiVersionPattern.MatchString(apiVersion) {
+		result.Err = &invalidResourceError{reason: fmt.Sprintf("%q isn't a valid apiVersion", apiVersion)}
+		return result
+	}
+	if !kindPattern.MatchString(kind) {
+		result.Err = &invalidResourceError{reason: fmt.Sprintf("%q isn't a valid kind", kind)}
+		return result
+	}
+
+	resourceSchema := v.CustomResources.schema(apiVersion, kind, v.Strict)
+	if resourceSchema == nil {
+		resourceSchema, err = v.Store.Schema(v.Location, schemaPath(v.Version, v.Strict, v.OpenShift, kind, apiVersion))
+		if err != nil {
+			result.Err = err
+			return result
+		}
+	}
+
+	results, err := resourceSchema.Validate(gojsonschema.NewGoLoader(body))
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if !results.Valid() {
+		result.Errors = results.Errors()
+		result.positions = newYAMLPositions(data, line)
+	}
+	return result
+}
+
+func stringField(body map[string]interface{}, field string) (string, error) {
+	value, ok := body[field]
+	if !ok {
+		return "", &invalidResourceError{reason: fmt.Sprintf("Missing a %s key", field)}
+	}
+	if value == nil {
+		return "", &invalidResourceError{reason: fmt.Sprintf("Missing a %s value", field)}
+	}
+	s, ok := value.(string)
+	if !ok || s == "" {
+		return "", &invalidResourceError{reason: fmt.Sprintf("Expected %s to be a non-empty string, got %v", field, value)}
+	}
+	return s, nil
+}
+
+// detectLineBreak returns the relevant platform specific line ending
+func detectLineBreak(haystack []byte) string {
+	windowsLineEnding := bytes.Contains(haystack, []byte("\r\n"))
+	if windowsLineEnding && runtime.GOOS == "windows" {
+		return "\r\n"
+	}
+	return "\n"
+}
+
+// convertToStringKeys recursively converts the map[interface{}]interface{}
+// values produced by yaml.Unmarshal to map[string]interface{} so that they
+// can be marshaled to JSON
+func convertToStringKeys(i interface{}) interface{} {
+	switch x := i.(type) {
+	case map[interface{}]interface{}:
+		m2 := map[string]interface{}{}
+		for k, v := range x {
+			m2[fmt.Sprintf("%v", k)] = convertToStringKeys(v)
+		}
+		return m2
+	case []interface{}:
+		for i, v := range x {
+			x[i] = convertToStringKeys(v)
+		}
+	}
+	return i
+}
@@ -0,0 +1,148 @@
+package validator
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func TestValidatorValidatesEachResourceInAFile(t *testing.T) {
+	validator := NewValidator(&KubeValidatorConfigSchema{
+		Location: fixtureSchemaLocation(),
+	}, &SchemaStore{AllowLocal: true})
+
+	results := validator.Validate([]byte("apiVersion: v1\nkind: ConfigMap\ndata:\n  a: b\n---\n\n---\napiVersion: v1\nkind: ConfigMap\nextra: true\n"), "configmaps.yaml")
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results))
+	}
+	if results[0].Kind != "ConfigMap" || results[0].Err != nil || len(results[0].Errors) != 0 {
+		t.Errorf("Expected a valid ConfigMap, got %+v", results[0])
+	}
+	if results[1].Kind != "" {
+		t.Errorf("Expected an empty result for an empty document, got %+v", results[1])
+	}
+	if len(results[2].Errors) != 1 || results[2].Errors[0].Type() != "additional_property_not_allowed" {
+		t.Errorf("Expected an additional property error, got %+v", results[2].Errors)
+	}
+}
+
+func TestValidatorRecordsWhereEachDocumentStarts(t *testing.T) {
+	validator := NewValidator(&KubeValidatorConfigSchema{
+		Location: fixtureSchemaLocation(),
+	}, &SchemaStore{AllowLocal: true})
+
+	config := "apiVersion: v1\nkind: ConfigMap\ndata:\n  a: b\n---\n\n---\napiVersion: v1\nkind: ConfigMap\nextra: true\n"
+	results := validator.Validate([]byte(config), "configmaps.yaml")
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results))
+	}
+	want := []struct{ offset, line int }{
+		{0, 1},
+		{strings.Index(config, "\n\n") + 1, 6},
+		{strings.LastIndex(config, "apiVersion"), 8},
+	}
+	for i, w := range want {
+		if results[i].Offset != w.offset || results[i].Line != w.line {
+			t.Errorf("Expected document %d to start at offset %d on line %d, got %d on line %d", i, w.offset, w.line, results[i].Offset, results[i].Line)
+		}
+	}
+
+	s, _ := results[2].positions.locate(results[2].Errors[0])
+	if want := (span{position{10, 1}, position{10, 11}}); s != want {
+		t.Errorf("Expected the additional property to be located at %v, got %v", want, s)
+	}
+}
+
+func TestValidatorUsesTheOpenShiftSchemaLayout(t *testing.T) {
+	var requested []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = append(requested, r.URL.Path)
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	for _, configType := range []string{"openshift", "kubernetes"} {
+		validator := NewValidator(&KubeValidatorConfigSchema{
+			Location:   server.URL,
+			Version:    "3.10",
+			ConfigType: configType,
+		}, &SchemaStore{AllowRemote: true})
+		if validator.OpenShift != (configType == "openshift") {
+			t.Errorf("%s: expected OpenShift to be %t", configType, configType == "openshift")
+		}
+		validator.Validate([]byte("apiVersion: route.openshift.io/v1\nkind: Route\n"), "route.yaml")
+	}
+
+	want := []string{"/v3.10-standalone-strict/route.json", "/v3.10-standalone-strict/route-route-v1.json"}
+	if strings.Join(requested, ",") != strings.Join(want, ",") {
+		t.Errorf("Expected requests for %v, got %v", want, requested)
+	}
+}
+
+func TestValidatorDistinguishesResourceAndSchemaErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "flaky") {
+			http.Error(w, "oops", http.StatusBadGateway)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	validator := NewValidator(&KubeValidatorConfigSchema{
+		Location: server.URL,
+	}, &SchemaStore{AllowRemote: true})
+
+	cases := []struct {
+		resource string
+		want     string
+	}{
+		{"apiVersion: v1\n", "*validator.invalidResourceError"},
+		{"apiVersion: v1\nkind: 5\n", "*validator.invalidResourceError"},
+		{"apiVersion: apps/v1/beta\nkind: Deployment\n", "*validator.invalidResourceError"},
+		{"apiVersion: v1\nkind: Missing\n", "*validator.missingSchemaError"},
+		{"apiVersion: v1\nkind: Flaky\n", "*validator.schemaLoadError"},
+	}
+	for _, c := range cases {
+		results := validator.Validate([]byte(c.resource), "resource.yaml")
+		if got := fmt.Sprintf("%T", results[0].Err); got != c.want {
+			t.Errorf("%q: expected %s, got %s (%v)", c.resource, c.want, got, results[0].Err)
+		}
+	}
+}
+
+func TestMissingSchemasLevels(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	DefaultSchemaStore.AllowedLocations = []string{server.URL}
+	defer func() { DefaultSchemaStore.AllowedLocations = nil }()
+
+	fileContents := []byte("apiVersion: example.com/v1\nkind: Unknown\n")
+	for _, level := range []string{"", "skip", "warning", "failure"} {
+		candidate := NewCandidate(nil, &File{Filename: "unknown.yaml"}, []*KubeValidatorConfigSchema{{
+			Location:       server.URL,
+			MissingSchemas: level,
+		}})
+		candidate.setBytes(&fileContents)
+		annotations := candidate.Validate()
+
+		switch level {
+		case "skip":
+			if len(annotations) != 0 {
+				t.Errorf("%s: expected no annotations, got %s", level, github.Stringify(annotations))
+			}
+		default:
+			want := level
+			if want == "" {
+				want = "failure"
+			}
+			if len(annotations) != 1 || annotations[0].GetAnnotationLevel() != want {
+				t.Errorf("%s: expected a single %s annotation, got %s", level, want, github.Stringify(annotations))
+			}
+		}
+	}
+}
@@ -0,0 +1,525 @@
+package validator
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/instrumenta/kubeval/kubeval"
+	"github.com/pkg/errors"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+const (
+	defaultSchemaStoreSize = 256
+	schemaReachableTimeout = 5 * time.Second
+	// SchemaReachableInterval is how often WatchReachable checks whether
+	// schemas are reachable
+	SchemaReachableInterval = 30 * time.Second
+)
+
+// DefaultSchemaStore is shared by all Candidates so that schemas are only
+// fetched and compiled once per process.
+var DefaultSchemaStore = &SchemaStore{}
+
+func init() {
+	// Without forcing these types the schemas fail to load
+	gojsonschema.FormatCheckers.Add("int64", kubeval.ValidFormat{})
+	gojsonschema.FormatCheckers.Add("byte", kubeval.ValidFormat{})
+	gojsonschema.FormatCheckers.Add("int32", kubeval.ValidFormat{})
+	gojsonschema.FormatCheckers.Add("int-or-string", kubeval.ValidFormat{})
+}
+
+// SchemaStore loads JSON schemas laid out like
+// https://github.com/instrumenta/kubernetes-json-schema from the network, a
+// local directory or a tarball, keeping the most recently used schemas in
+// memory.
+type SchemaStore struct {
+	// DefaultLocation is used for schemas which don't configure a location or
+	// fork. Defaults to kubeval.DefaultSchemaLocation.
+	DefaultLocation string
+
+	// CacheDir is where schemas fetched over the network are stored. Nothing
+	// is written to disk when it's empty.
+	CacheDir string
+
+	// AllowLocal permits file:// locations other than DefaultLocation. They
+	// read from the machine kubevalidator is running on, so should only be
+	// allowed when the configuration is trusted.
+	AllowLocal bool
+
+	// AllowedLocations lists the http(s) locations schemas may be fetched
+	// from in addition to DefaultLocation, kubeval.DefaultSchemaLocation and
+	// forks of kubernetes-json-schema. Locations beneath them are allowed
+	// too. Repositories can't be trusted to choose which hosts kubevalidator
+	// makes requests to, so any others are refused unless AllowRemote is set.
+	AllowedLocations []string
+
+	// AllowRemote permits any http(s) location, and should only be set when
+	// the configuration is trusted.
+	AllowRemote bool
+
+	// Size is the number of compiled schemas kept in memory. Defaults to 256.
+	Size int
+
+	// Client is used for remote fetches. Defaults to http.DefaultClient.
+	Client *http.Client
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+
+	// reachable is the result of the last check made for CachedReachable
+	reachableMu      sync.Mutex
+	reachable        error
+	reachableChecked bool
+}
+
+// missingSchemaError is returned when a location doesn't contain a schema,
+// usually because a resource's apiVersion or kind is incorrect
+type missingSchemaError struct {
+	schemaURL string
+	reason    string
+}
+
+func (e *missingSchemaError) Error() string {
+	return fmt.Sprintf("No schema found at %s: %s", e.schemaURL, e.reason)
+}
+
+// schemaLoadError is returned when a schema couldn't be loaded for reasons
+// that likely have nothing to do with the resource being validated, like a
+// network error
+type schemaLoadError struct {
+	schemaURL string
+	err       error
+}
+
+func (e *schemaLoadError) Error() string {
+	return fmt.Sprintf("Problem loading schema from %s: %s", e.schemaURL, e.err)
+}
+
+type schemaStoreEntry struct {
+	key    string
+	schema *gojsonschema.Schema
+}
+
+// schemaPath returns the path of the schema for a kind and apiVersion relative
+// to a schema location
+func schemaPath(version string, strict bool, openshift bool, kind string, apiVersion string) string {
+	// Most of the directories which store the schemas are prefixed with a v so
+	// as to match the tagging in the Kubernetes repository, apart from master.
+	normalisedVersion := version
+	if version == "" {
+		normalisedVersion = "master"
+	} else if version != "master" {
+		normalisedVersion = "v" + version
+	}
+
+	var strictSuffix string
+	if strict {
+		strictSuffix = "-strict"
+	}
+
+	var kindSuffix string
+	groupParts := strings.Split(apiVersion, "/")
+	versionParts := strings.Split(groupParts[0], ".")
+	if !openshift {
+		if len(groupParts) == 1 {
+			kindSuffix = "-" + strings.ToLower(versionParts[0])
+		} else {
+			kindSuffix = fmt.Sprintf("-%s-%s", strings.ToLower(versionParts[0]), strings.ToLower(groupParts[1]))
+		}
+	}
+
+	return fmt.Sprintf("%s-standalone%s/%s%s.json", normalisedVersion, strictSuffix, strings.ToLower(kind), kindSuffix)
+}
+
+// LocationFor returns the location schemas configured by schema are loaded
+// from, falling back to DefaultLocation when neither a location nor a fork
+// is configured
+func (s *SchemaStore) LocationFor(schema *KubeValidatorConfigSchema) string {
+	if schema.Location != "" || schema.SchemaFork != "" {
+		return schema.SchemaLocation()
+	}
+	if s.DefaultLocation != "" {
+		return s.DefaultLocation
+	}
+	return kubeval.DefaultSchemaLocation
+}
+
+// Schema returns the compiled schema found at schemaPath beneath location
+func (s *SchemaStore) Schema(location string, schemaPath string) (*gojsonschema.Schema, error) {
+	location = strings.TrimSuffix(location, "/")
+	key := fmt.Sprintf("%s/%s", location, schemaPath)
+
+	if schema := s.get(key); schema != nil {
+		return schema, nil
+	}
+
+	start := time.Now()
+	b, err := s.load(location, schemaPath)
+	kind := s.locationKind(location)
+	schemaFetchDuration.since(start, kind)
+	if err != nil {
+		if _, ok := err.(*missingSchemaError); ok {
+			schemaFetchFailures.inc(kind, "missing")
+		} else {
+			schemaFetchFailures.inc(kind, "error")
+		}
+		return nil, err
+	}
+
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewBytesLoader(b))
+	if err != nil {
+		schemaFetchFailures.inc(kind, "invalid")
+		return nil, &schemaLoadError{schemaURL: key, err: errors.Wrap(err, "Couldn't compile schema")}
+	}
+
+	s.add(key, schema)
+	return schema, nil
+}
+
+// locationKind describes location as default, custom or file for use as a
+// metric label, as repositories may configure any number of locations
+func (s *SchemaStore) locationKind(location string) string {
+	defaultLocation := s.DefaultLocation
+	if defaultLocation == "" {
+		defaultLocation = kubeval.DefaultSchemaLocation
+	}
+	switch {
+	case location == strings.TrimSuffix(defaultLocation, "/"):
+		return "default"
+	case strings.HasPrefix(location, "file:"):
+		return "file"
+	default:
+		return "custom"
+	}
+}
+
+func (s *SchemaStore) get(key string) *gojsonschema.Schema {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if element, ok := s.entries[key]; ok {
+		s.lru.MoveToFront(element)
+		return element.Value.(*schemaStoreEntry).schema
+	}
+	return nil
+}
+
+func (s *SchemaStore) add(key string, schema *gojsonschema.Schema) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.entries == nil {
+		s.entries = make(map[string]*list.Element)
+		s.lru = list.New()
+	}
+	if element, ok := s.entries[key]; ok {
+		s.lru.MoveToFront(element)
+		return
+	}
+	s.entries[key] = s.lru.PushFront(&schemaStoreEntry{key: key, schema: schema})
+
+	size := s.Size
+	if size <= 0 {
+		size = defaultSchemaStoreSize
+	}
+	for s.lru.Len() > size {
+		oldest := s.lru.Back()
+		s.lru.Remove(oldest)
+		delete(s.entries, oldest.Value.(*schemaStoreEntry).key)
+	}
+}
+
+// load reads the raw bytes of a schema from location
+func (s *SchemaStore) load(location string, schemaPath string) ([]byte, error) {
+	schemaURL := fmt.Sprintf("%s/%s", location, schemaPath)
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, &schemaLoadError{schemaURL: schemaURL, err: errors.Wrap(err, "Couldn't parse schema location")}
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		if !s.Allowed(location) {
+			return nil, &schemaLoadError{schemaURL: schemaURL, err: errors.New("Schemas can't be loaded from this location here")}
+		}
+		return s.loadRemote(schemaURL, u, schemaPath)
+	case "file":
+		if !s.Allowed(location) {
+			return nil, &schemaLoadError{schemaURL: schemaURL, err: errors.New("Schemas on the local filesystem aren't allowed here")}
+		}
+		if isTarball(u.Path) {
+			return loadFromTarball(schemaURL, filepath.FromSlash(u.Path), schemaPath)
+		}
+		filename, err := joinBeneath(filepath.FromSlash(u.Path), schemaPath)
+		if err != nil {
+			return nil, &schemaLoadError{schemaURL: schemaURL, err: err}
+		}
+		b, err := ioutil.ReadFile(filename)
+		if os.IsNotExist(err) {
+			return nil, &missingSchemaError{schemaURL: schemaURL, reason: "file does not exist"}
+		}
+		if err != nil {
+			return nil, &schemaLoadError{schemaURL: schemaURL, err: err}
+		}
+		return b, nil
+	default:
+		return nil, &schemaLoadError{schemaURL: schemaURL, err: fmt.Errorf("Unsupported scheme %q", u.Scheme)}
+	}
+}
+
+// Allowed returns whether schemas may be loaded from location
+func (s *SchemaStore) Allowed(location string) bool {
+	location = strings.TrimSuffix(location, "/")
+	u, err := url.Parse(location)
+	if err != nil {
+		return false
+	}
+	if location == strings.TrimSuffix(s.DefaultLocation, "/") {
+		return true
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		if s.AllowRemote || location == kubeval.DefaultSchemaLocation || schemaForkPattern.MatchString(location) {
+			return true
+		}
+		for _, allowed := range s.AllowedLocations {
+			allowed = strings.TrimSuffix(allowed, "/")
+			if location == allowed || strings.HasPrefix(location, allowed+"/") {
+				return true
+			}
+		}
+		return false
+	case "file":
+		return s.AllowLocal
+	default:
+		return false
+	}
+}
+
+// loadRemote fetches a schema over HTTP, consulting and populating the disk
+// cache if one is configured
+func (s *SchemaStore) loadRemote(schemaURL string, u *url.URL, schemaPath string) ([]byte, error) {
+	var cachePath string
+	if s.CacheDir != "" {
+		var err error
+		cachePath, err = joinBeneath(filepath.Join(s.CacheDir, u.Host, filepath.FromSlash(path.Clean("/"+u.Path))), schemaPath)
+		if err != nil {
+			return nil, &schemaLoadError{schemaURL: schemaURL, err: err}
+		}
+		if b, err := ioutil.ReadFile(cachePath); err == nil {
+			return b, nil
+		}
+	}
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	// Allowed locations mustn't be able to redirect elsewhere
+	checked := *client
+	checked.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if !s.Allowed(req.URL.String()) {
+			return fmt.Errorf("Refusing to follow a redirect to %s", req.URL.Host)
+		}
+		if client.CheckRedirect != nil {
+			return client.CheckRedirect(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("Stopped after 10 redirects")
+		}
+		return nil
+	}
+	resp, err := checked.Get(schemaURL)
+	if err != nil {
+		return nil, &schemaLoadError{schemaURL: schemaURL, err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, &missingSchemaError{schemaURL: schemaURL, reason: fmt.Sprintf("response status is %s", resp.Status)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, &schemaLoadError{schemaURL: schemaURL, err: fmt.Errorf("Could not read schema from HTTP, response status is %s", resp.Status)}
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &schemaLoadError{schemaURL: schemaURL, err: err}
+	}
+
+	if cachePath != "" {
+		// The cache is an optimization, so failing to write to it isn't fatal
+		writeFileAtomically(cachePath, b)
+	}
+	return b, nil
+}
+
+// Reachable returns an error if schemas can't be loaded from
+// DefaultLocation. Remote locations which don't respond are reachable as long
+// as something has been cached from them on disk.
+func (s *SchemaStore) Reachable() error {
+	location := s.DefaultLocation
+	if location == "" {
+		location = kubeval.DefaultSchemaLocation
+	}
+	u, err := url.Parse(location)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't parse schema location")
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		client := s.Client
+		if client == nil {
+			client = http.DefaultClient
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), schemaReachableTimeout)
+		defer cancel()
+		req, err := http.NewRequest(http.MethodHead, location, nil)
+		if err != nil {
+			return errors.Wrap(err, "Couldn't check schema location")
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < http.StatusInternalServerError {
+				return nil
+			}
+			err = fmt.Errorf("response status is %s", resp.Status)
+		}
+		if s.CacheDir != "" {
+			if files, _ := ioutil.ReadDir(filepath.Join(s.CacheDir, u.Host)); len(files) > 0 {
+				return nil
+			}
+		}
+		return errors.Wrap(err, fmt.Sprintf("Couldn't reach %s and nothing is cached from it", location))
+	case "file":
+		if _, err := os.Stat(filepath.FromSlash(u.Path)); err != nil {
+			return errors.Wrap(err, "Couldn't find schemas")
+		}
+		return nil
+	default:
+		return fmt.Errorf("Unsupported scheme %q", u.Scheme)
+	}
+}
+
+// WatchReachable checks whether schemas are reachable every interval until
+// ctx is done, caching the result for CachedReachable
+func (s *SchemaStore) WatchReachable(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.checkReachable()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// CachedReachable returns the result of the last check made by
+// WatchReachable, checking now if there hasn't been one yet, so that
+// readiness probes don't make requests to the schema location themselves
+func (s *SchemaStore) CachedReachable() error {
+	s.reachableMu.Lock()
+	err, checked := s.reachable, s.reachableChecked
+	s.reachableMu.Unlock()
+	if checked {
+		return err
+	}
+	return s.checkReachable()
+}
+
+func (s *SchemaStore) checkReachable() error {
+	err := s.Reachable()
+	s.reachableMu.Lock()
+	defer s.reachableMu.Unlock()
+	s.reachable = err
+	s.reachableChecked = true
+	return err
+}
+
+func isTarball(p string) bool {
+	return strings.HasSuffix(p, ".tar") || strings.HasSuffix(p, ".tar.gz") || strings.HasSuffix(p, ".tgz")
+}
+
+// loadFromTarball scans a tarball of kubernetes-json-schema for schemaPath.
+// Entries may be nested beneath any number of leading directories, as they
+// are in the archives GitHub generates.
+func loadFromTarball(schemaURL string, tarball string, schemaPath string) ([]byte, error) {
+	f, err := os.Open(tarball)
+	if err != nil {
+		return nil, &schemaLoadError{schemaURL: schemaURL, err: errors.Wrap(err, "Couldn't open schema bundle")}
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if !strings.HasSuffix(tarball, ".tar") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, &schemaLoadError{schemaURL: schemaURL, err: errors.Wrap(err, "Couldn't decompress schema bundle")}
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &schemaLoadError{schemaURL: schemaURL, err: errors.Wrap(err, "Couldn't read schema bundle")}
+		}
+		name := strings.TrimPrefix(header.Name, "./")
+		if name == schemaPath || strings.HasSuffix(name, "/"+schemaPath) {
+			return ioutil.ReadAll(tr)
+		}
+	}
+	return nil, &missingSchemaError{schemaURL: schemaURL, reason: "not found in schema bundle"}
+}
+
+// joinBeneath joins the slash-separated rel to dir, returning an error if the
+// result isn't beneath dir, as rel includes the kinds of the resources being
+// validated
+func joinBeneath(dir string, rel string) (string, error) {
+	joined := filepath.Join(dir, filepath.FromSlash(rel))
+	if r, err := filepath.Rel(dir, joined); err != nil || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("%s is outside of %s", rel, dir)
+	}
+	return joined, nil
+}
+
+func writeFileAtomically(filename string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".schema")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
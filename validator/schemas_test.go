@@ -0,0 +1,302 @@
+package validator
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+	"github.com/google/go-github/github"
+	"github.com/instrumenta/kubeval/kubeval"
+)
+
+func fixtureSchemaLocation() string {
+	dir, _ := filepath.Abs("../fixtures/schemas")
+	return fmt.Sprintf("file://%s", filepath.ToSlash(dir))
+}
+
+// useFixtureSchemas loads schemas which don't configure a location from
+// fixtures/schemas rather than the network until the returned func is called
+func useFixtureSchemas() func() {
+	defaultLocation := DefaultSchemaStore.DefaultLocation
+	DefaultSchemaStore.DefaultLocation = fixtureSchemaLocation()
+	return func() { DefaultSchemaStore.DefaultLocation = defaultLocation }
+}
+
+func TestSchemaPath(t *testing.T) {
+	cases := []struct {
+		version    string
+		strict     bool
+		openshift  bool
+		kind       string
+		apiVersion string
+		want       string
+	}{
+		{"", true, false, "Deployment", "apps/v1", "master-standalone-strict/deployment-apps-v1.json"},
+		{"1.13.0", false, false, "Service", "v1", "v1.13.0-standalone/service-v1.json"},
+		{"master", true, false, "Ingress", "extensions/v1beta1", "master-standalone-strict/ingress-extensions-v1beta1.json"},
+		{"3.10", true, true, "Route", "route.openshift.io/v1", "v3.10-standalone-strict/route.json"},
+	}
+	for _, c := range cases {
+		if got := schemaPath(c.version, c.strict, c.openshift, c.kind, c.apiVersion); got != c.want {
+			t.Errorf("schemaPath(%q, %v, %v, %q, %q) = %q, want %q", c.version, c.strict, c.openshift, c.kind, c.apiVersion, got, c.want)
+		}
+	}
+}
+
+func TestSchemaStoreRefusesLocalLocationsByDefault(t *testing.T) {
+	store := &SchemaStore{}
+	_, err := store.Schema(fixtureSchemaLocation(), "master-standalone-strict/configmap-v1.json")
+	if err == nil {
+		t.Error("Expected loading a file:// location to fail unless AllowLocal is set")
+	}
+}
+
+func TestSchemaStoreOnlyLoadsFromAllowedLocations(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/redirect/master-standalone-strict/configmap-v1.json" {
+			http.Redirect(w, r, "http://169.254.169.254/latest/meta-data", http.StatusFound)
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	defer server.Close()
+
+	store := &SchemaStore{AllowedLocations: []string{server.URL + "/allowed/"}}
+	cases := []struct {
+		location string
+		allowed  bool
+	}{
+		{kubeval.DefaultSchemaLocation, true},
+		{"https://raw.githubusercontent.com/garethr/kubernetes-json-schema/master", true},
+		{"https://raw.githubusercontent.com/garethr/other/master", false},
+		{server.URL + "/allowed", true},
+		{server.URL + "/allowed/nested/", true},
+		{server.URL + "/allowed-not", false},
+		{server.URL, false},
+		{"http://169.254.169.254/latest/meta-data", false},
+		{fixtureSchemaLocation(), false},
+	}
+	for _, c := range cases {
+		if got := store.Allowed(c.location); got != c.allowed {
+			t.Errorf("%s: expected allowed to be %t, got %t", c.location, c.allowed, got)
+		}
+	}
+
+	if _, err := store.Schema(server.URL+"/elsewhere", "master-standalone-strict/configmap-v1.json"); err == nil || requests != 0 {
+		t.Errorf("Expected a location which isn't allowed to be refused without a request, got %v after %d requests", err, requests)
+	}
+	store.AllowedLocations = append(store.AllowedLocations, server.URL+"/redirect")
+	if _, err := store.Schema(server.URL+"/redirect", "master-standalone-strict/configmap-v1.json"); err == nil || !strings.Contains(err.Error(), "Refusing to follow a redirect") {
+		t.Errorf("Expected a redirect to a location which isn't allowed to be refused, got %v", err)
+	}
+}
+
+func TestSchemaStoreLoadsFromDirectory(t *testing.T) {
+	store := &SchemaStore{AllowLocal: true}
+	schema, err := store.Schema(fixtureSchemaLocation(), "master-standalone-strict/configmap-v1.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, _ := store.Schema(fixtureSchemaLocation(), "master-standalone-strict/configmap-v1.json")
+	if schema != again {
+		t.Error("Expected the second load to be served from memory")
+	}
+
+	_, err = store.Schema(fixtureSchemaLocation(), "master-standalone-strict/missing-v1.json")
+	if err == nil {
+		t.Error("Expected an error loading a missing schema")
+	}
+}
+
+func TestSchemaStoreLoadsFromTarball(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubevalidator")
+	defer os.RemoveAll(dir)
+
+	tarball := filepath.Join(dir, "kubernetes-json-schema.tar.gz")
+	f, _ := os.Create(tarball)
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	b, _ := ioutil.ReadFile("../fixtures/schemas/master-standalone-strict/configmap-v1.json")
+	tw.WriteHeader(&tar.Header{
+		Name: "kubernetes-json-schema-master/master-standalone-strict/configmap-v1.json",
+		Mode: 0644,
+		Size: int64(len(b)),
+	})
+	tw.Write(b)
+	tw.Close()
+	gz.Close()
+	f.Close()
+
+	store := &SchemaStore{AllowLocal: true}
+	location := fmt.Sprintf("file://%s", filepath.ToSlash(tarball))
+	if _, err := store.Schema(location, "master-standalone-strict/configmap-v1.json"); err != nil {
+		t.Error(err)
+	}
+	if _, err := store.Schema(location, "master-standalone-strict/deployment-apps-v1.json"); err == nil {
+		t.Error("Expected an error loading a schema missing from the tarball")
+	}
+}
+
+func TestSchemaStoreCachesRemoteSchemasOnDisk(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubevalidator")
+	defer os.RemoveAll(dir)
+
+	requests := 0
+	b, _ := ioutil.ReadFile("../fixtures/schemas/master-standalone-strict/configmap-v1.json")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/schemas/master-standalone-strict/configmap-v1.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+	}))
+	defer server.Close()
+
+	location := server.URL + "/schemas"
+	if _, err := (&SchemaStore{CacheDir: dir, AllowedLocations: []string{server.URL}}).Schema(location, "master-standalone-strict/configmap-v1.json"); err != nil {
+		t.Fatal(err)
+	}
+	// A fresh store has an empty memory cache, so must read from disk
+	if _, err := (&SchemaStore{CacheDir: dir, AllowedLocations: []string{server.URL}}).Schema(location, "master-standalone-strict/configmap-v1.json"); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("Expected 1 request, got %d", requests)
+	}
+}
+
+func TestSchemaStoreStaysBeneathLocations(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubevalidator")
+	defer os.RemoveAll(dir)
+	b, _ := ioutil.ReadFile("../fixtures/schemas/master-standalone-strict/configmap-v1.json")
+	os.MkdirAll(filepath.Join(dir, "schemas"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "outside.json"), b, 0644)
+
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write(b)
+	}))
+	defer server.Close()
+
+	store := &SchemaStore{AllowLocal: true, CacheDir: filepath.Join(dir, "cache"), AllowedLocations: []string{server.URL}}
+	for _, location := range []string{fmt.Sprintf("file://%s", filepath.ToSlash(filepath.Join(dir, "schemas"))), server.URL + "/schemas"} {
+		if _, err := store.Schema(location, "../../../../outside.json"); err == nil || !strings.Contains(err.Error(), "is outside of") {
+			t.Errorf("Expected a schema outside of %s to be refused, got %v", location, err)
+		}
+	}
+	if requests != 0 {
+		t.Errorf("Expected no requests for a schema outside of the cache, got %d", requests)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "outside.json")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSchemaStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store := &SchemaStore{AllowLocal: true, Size: 1}
+	first, _ := store.Schema(fixtureSchemaLocation(), "master-standalone-strict/configmap-v1.json")
+	store.Schema(fixtureSchemaLocation(), "master-standalone-strict/deployment-apps-v1.json")
+	again, _ := store.Schema(fixtureSchemaLocation(), "master-standalone-strict/configmap-v1.json")
+	if first == again {
+		t.Error("Expected the first schema to have been evicted")
+	}
+}
+
+func TestAnnotationsWithLocalSchemaLocation(t *testing.T) {
+	DefaultSchemaStore.AllowLocal = true
+	defer func() { DefaultSchemaStore.AllowLocal = false }()
+
+	schemas := []*KubeValidatorConfigSchema{{Location: fixtureSchemaLocation()}}
+	candidate := NewCandidate(nil, &File{Filename: "deployment.yaml"}, schemas)
+	fileContents, _ := ioutil.ReadFile("../fixtures/invalid.yaml")
+	candidate.setBytes(&fileContents)
+	annotations := candidate.Validate()
+
+	var messages []string
+	for _, annotation := range annotations {
+		messages = append(messages, annotation.GetMessage())
+	}
+	want := []string{
+		"selector: selector is required",
+		"template: template is required",
+		"spec.replicas: Invalid type. Expected: integer, given: string",
+	}
+	if len(messages) != len(want) {
+		t.Fatalf("Expected %d annotations, got %+v", len(want), github.Stringify(annotations))
+	}
+	for i := range want {
+		if messages[i] != want[i] {
+			t.Errorf("Expected %q, got %q", want[i], messages[i])
+		}
+	}
+}
+
+func TestAnnotationsWithStrictModeOptions(t *testing.T) {
+	DefaultSchemaStore.AllowLocal = true
+	defer func() { DefaultSchemaStore.AllowLocal = false }()
+
+	fileContents := []byte("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: example\n  extra: true\nextra: true\n")
+	cases := []struct {
+		schema *KubeValidatorConfigSchema
+		want   []string
+	}{
+		{
+			schema: &KubeValidatorConfigSchema{},
+			want:   []string{"failure", "failure"},
+		},
+		{
+			schema: &KubeValidatorConfigSchema{Strict: github.Bool(false)},
+			want:   nil,
+		},
+		{
+			schema: &KubeValidatorConfigSchema{IgnoreAdditionalProperties: []string{"metadata"}},
+			want:   []string{"failure", "notice"},
+		},
+	}
+	for i, c := range cases {
+		c.schema.Location = fixtureSchemaLocation()
+		candidate := NewCandidate(nil, &File{Filename: "configmap.yaml"}, []*KubeValidatorConfigSchema{c.schema})
+		candidate.setBytes(&fileContents)
+		annotations := candidate.Validate()
+
+		var levels []string
+		for _, annotation := range annotations {
+			levels = append(levels, annotation.GetAnnotationLevel())
+		}
+		sort.Strings(levels)
+		if diff := deep.Equal(levels, c.want); diff != nil {
+			t.Errorf("case %d: %v %s", i, diff, github.Stringify(annotations))
+		}
+	}
+}
+
+func TestSchemaStoreLabelsMetricsByKindOfLocation(t *testing.T) {
+	store := &SchemaStore{DefaultLocation: fixtureSchemaLocation() + "/", AllowLocal: true}
+	cases := map[string]string{
+		fixtureSchemaLocation():                     "default",
+		fixtureSchemaLocation() + "/missing":        "file",
+		"https://schemas.example.com/kubernetes":    "custom",
+		"https://schemas.example.com/kubernetes/v2": "custom",
+	}
+	for location, want := range cases {
+		if got := store.locationKind(location); got != want {
+			t.Errorf("%s: expected %s, got %s", location, want, got)
+		}
+	}
+	if got := (&SchemaStore{}).locationKind(kubeval.DefaultSchemaLocation); got != "default" {
+		t.Errorf("Expected kubeval's location to be the default, got %s", got)
+	}
+}
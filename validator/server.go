@@ -4,79 +4,428 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/bradleyfalzon/ghinstallation"
 	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
 )
 
+const (
+	// maxProcessAttempts is how many times an event is processed before
+	// giving up on errors which may succeed when retried
+	maxProcessAttempts = 3
+)
+
+// processRetryDelay is multiplied by the number of attempts so far to give
+// the delay before an event is processed again
+var processRetryDelay = 10 * time.Second
+
+// defaultDrainTimeout leaves a little of Kubernetes' default 30 second
+// termination grace period to cancel check runs which couldn't be finished
+const defaultDrainTimeout = 20 * time.Second
+
+// shutdownReason is shown on check runs which were cancelled because
+// kubevalidator was shut down before it could finish them
+const shutdownReason = "kubevalidator was restarted before the check finished"
+
 // Server contains the logic to process webhooks, kinda like probot
 type Server struct {
-	Port            int
-	WebhookSecret   string
+	Port          int
+	WebhookSecret string
+	// PrivateKey is the App's PEM encoded private key. It's read from
+	// PrivateKeyFile when empty.
+	PrivateKey      []byte
 	PrivateKeyFile  string
 	AppID           int
 	GitHubAppClient *github.Client
-	tr              *http.RoundTripper
-	ctx             *context.Context
+	// BaseURL is the URL of the GitHub API, like
+	// https://github.example.com/api/v3/ for GitHub Enterprise Server.
+	// Defaults to https://api.github.com/.
+	BaseURL string
+	// UploadURL is the URL of the GitHub uploads API. Defaults to the
+	// uploads API beside BaseURL.
+	UploadURL string
+	// MetricsAddress is the address /metrics is served on. It's served
+	// alongside webhooks when empty.
+	MetricsAddress string
+	// Workers is the number of webhooks processed at once
+	Workers int
+	// QueueSize is the number of webhooks which may wait to be processed
+	QueueSize int
+	// Dedupe is used to skip repeated deliveries and check suites. Nothing
+	// is skipped when it's nil.
+	Dedupe DedupeStore
+	// Schemas is checked in the background for /readyz. Defaults to
+	// DefaultSchemaStore.
+	Schemas *SchemaStore
+	// Log is stamped with the details of each delivery and passed to the
+	// Context which processes it
+	Log *Logger
+	// DrainTimeout is how long queued and running webhooks are given to
+	// finish once Run's context is done. Defaults to 20 seconds.
+	DrainTimeout time.Duration
+	tr           *http.RoundTripper
+	baseURL      *url.URL
+	uploadURL    *url.URL
+	// ctx is passed to GitHub calls. It outlives Run's context so that
+	// webhooks can be drained, and is cancelled once DrainTimeout passes.
+	ctx      *context.Context
+	stopWork context.CancelFunc
+	queue    *Queue
+
+	mu sync.Mutex
+	// inFlight holds the Contexts which have been accepted but haven't
+	// finished processing, including those waiting to be retried
+	inFlight map[*Context]struct{}
+}
+
+// logger returns the Server's Logger, falling back to DefaultLogger
+func (s *Server) logger() *Logger {
+	if s.Log == nil {
+		return DefaultLogger
+	}
+	return s.Log
+}
+
+// schemas returns Schemas, falling back to DefaultSchemaStore
+func (s *Server) schemas() *SchemaStore {
+	if s.Schemas == nil {
+		return DefaultSchemaStore
+	}
+	return s.Schemas
 }
 
 // GenericEvent contains just enough inforamation about webhook to handle
 // authentication
 type GenericEvent struct {
-	// Repo         *github.Repository   `json:"repository,omitempty"`
+	Action *string            `json:"action,omitempty"`
+	Repo   *github.Repository `json:"repository,omitempty"`
 	// Org          *github.Organization `json:"organization,omitempty"`
 	// Sender       *github.User         `json:"sender,omitempty"`
 	Installation *github.Installation `json:"installation,omitempty"`
 }
 
-// Run starts a http server on the configured port
+// GetAction returns the action of the event, if any
+func (e *GenericEvent) GetAction() string {
+	if e.Action == nil {
+		return ""
+	}
+	return *e.Action
+}
+
+// Run starts a http server on the configured port. Once ctx is done the
+// server stops accepting webhooks and drains those already accepted before
+// returning.
 func (s *Server) Run(ctx context.Context) error {
-	s.tr = &http.DefaultTransport
+	tr := InstrumentTransport(http.DefaultTransport)
+	s.tr = &tr
+
+	if err := s.parseURLs(); err != nil {
+		return err
+	}
 
-	itr, err := ghinstallation.NewAppsTransportKeyFromFile(*s.tr, s.AppID, s.PrivateKeyFile)
+	itr, err := s.appsTransport(*s.tr)
 	if err != nil {
 		return err
 	}
 
-	s.ctx = &ctx
-	s.GitHubAppClient = github.NewClient(&http.Client{Transport: itr})
+	work, stopWork := context.WithCancel(context.Background())
+	defer stopWork()
+	s.ctx = &work
+	s.stopWork = stopWork
+	s.GitHubAppClient = s.newClient(itr)
+	go s.sweepStaleCheckRuns()
+	go s.schemas().WatchReachable(ctx, SchemaReachableInterval)
+
+	s.queue = NewQueue(s.QueueSize, s.Workers)
+	s.queue.Start()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/webhook", s.handle)
+	mux.HandleFunc("/livez", s.livez)
+	mux.HandleFunc("/readyz", s.readyz)
+	// Kept for probes configured before /livez and /readyz existed
+	mux.HandleFunc("/healthz", s.readyz)
+	mux.HandleFunc("/", s.redirect)
+	servers := []*http.Server{{
+		Addr:    fmt.Sprintf(":%d", s.Port),
+		Handler: mux,
+	}}
+	if s.MetricsAddress == "" {
+		mux.Handle("/metrics", DefaultMetrics)
+	} else {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", DefaultMetrics)
+		servers = append(servers, &http.Server{
+			Addr:    s.MetricsAddress,
+			Handler: metricsMux,
+		})
+	}
+
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		srv := srv
+		go func() {
+			errs <- srv.ListenAndServe()
+		}()
+	}
+	s.logger().Info("hi", "port", s.Port, "metrics_address", s.MetricsAddress)
+
+	select {
+	case err := <-errs:
+		s.queue.Drain(work)
+		return err
+	case <-ctx.Done():
+	}
+	return s.shutdown(servers...)
+}
+
+// parseURLs parses BaseURL and UploadURL, deriving the upload URL from the
+// API URL when it isn't set
+func (s *Server) parseURLs() error {
+	if s.BaseURL == "" {
+		return nil
+	}
+	baseURL, err := url.Parse(s.BaseURL)
+	if err != nil {
+		return errors.Wrap(err, "Couldn't parse GitHub API URL")
+	}
+	if !strings.HasSuffix(baseURL.Path, "/") {
+		baseURL.Path += "/"
+	}
+	s.baseURL = baseURL
+
+	uploadURL := *baseURL
+	if s.UploadURL != "" {
+		u, err := url.Parse(s.UploadURL)
+		if err != nil {
+			return errors.Wrap(err, "Couldn't parse GitHub upload URL")
+		}
+		uploadURL = *u
+	} else if strings.HasSuffix(uploadURL.Path, "/api/v3/") {
+		uploadURL.Path = strings.TrimSuffix(uploadURL.Path, "v3/") + "uploads/"
+	} else if uploadURL.Host == "api.github.com" {
+		uploadURL.Host = "uploads.github.com"
+	}
+	if !strings.HasSuffix(uploadURL.Path, "/") {
+		uploadURL.Path += "/"
+	}
+	s.uploadURL = &uploadURL
+	return nil
+}
+
+// privateKey returns PrivateKey, reading it from PrivateKeyFile if it's
+// empty
+func (s *Server) privateKey() ([]byte, error) {
+	if len(s.PrivateKey) > 0 {
+		return s.PrivateKey, nil
+	}
+	key, err := ioutil.ReadFile(s.PrivateKeyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't read private key")
+	}
+	return key, nil
+}
+
+// appsTransport returns a transport which authenticates as the App
+func (s *Server) appsTransport(tr http.RoundTripper) (*ghinstallation.AppsTransport, error) {
+	key, err := s.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	itr, err := ghinstallation.NewAppsTransport(tr, s.AppID, key)
+	if err != nil {
+		return nil, err
+	}
+	if s.baseURL != nil {
+		itr.BaseURL = strings.TrimSuffix(s.baseURL.String(), "/")
+	}
+	return itr, nil
+}
+
+// installationTransport returns a transport which authenticates as an
+// installation of the App
+func (s *Server) installationTransport(installationID int64) (*ghinstallation.Transport, error) {
+	key, err := s.privateKey()
+	if err != nil {
+		return nil, err
+	}
+	itr, err := ghinstallation.New(*s.tr, s.AppID, int(installationID), key)
+	if err != nil {
+		return nil, err
+	}
+	if s.baseURL != nil {
+		itr.BaseURL = strings.TrimSuffix(s.baseURL.String(), "/")
+	}
+	return itr, nil
+}
+
+// newClient returns a client for the configured GitHub API which sends
+// requests through tr
+func (s *Server) newClient(tr http.RoundTripper) *github.Client {
+	client := github.NewClient(&http.Client{Transport: tr})
+	if s.baseURL != nil {
+		client.BaseURL = s.baseURL
+		client.UploadURL = s.uploadURL
+	}
+	return client
+}
 
-	http.HandleFunc("/webhook", s.handle)
-	http.HandleFunc("/healthz", s.health)
-	http.HandleFunc("/", s.redirect)
-	log.Println("hi")
-	return http.ListenAndServe(fmt.Sprintf(":%d", s.Port), nil)
+// shutdown stops accepting webhooks and waits up to DrainTimeout for those
+// already accepted to be processed. Check runs for webhooks which couldn't be
+// processed in time are cancelled so that they can be re-run.
+func (s *Server) shutdown(servers ...*http.Server) error {
+	drainTimeout := s.DrainTimeout
+	if drainTimeout <= 0 {
+		drainTimeout = defaultDrainTimeout
+	}
+	s.logger().Info("Shutting down", "queued", s.queue.Depth(), "drain_timeout", drainTimeout)
+
+	deadline, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	var err error
+	for _, srv := range servers {
+		if shutdownErr := srv.Shutdown(deadline); shutdownErr != nil {
+			err = shutdownErr
+		}
+	}
+	s.drain(deadline)
+	return err
+}
+
+// drain waits for the queue to empty until ctx is done, then cancels the
+// check runs of every webhook which hasn't finished
+func (s *Server) drain(ctx context.Context) {
+	if !s.queue.Drain(ctx) {
+		s.logger().Warn("Timed out draining webhooks, cancelling those which haven't finished")
+		if s.stopWork != nil {
+			s.stopWork()
+		}
+		s.queue.Wait()
+	}
+
+	s.mu.Lock()
+	unfinished := make([]*Context, 0, len(s.inFlight))
+	for c := range s.inFlight {
+		unfinished = append(unfinished, c)
+	}
+	s.mu.Unlock()
+
+	for _, c := range unfinished {
+		cancelCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		c.Ctx = &cancelCtx
+		if err := c.Abandon(shutdownReason); err != nil {
+			c.logger().Error("Couldn't cancel check run", "err", err)
+		}
+		cancel()
+		s.finished(c)
+	}
+}
+
+// started records that c has been accepted
+func (s *Server) started(c *Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inFlight == nil {
+		s.inFlight = make(map[*Context]struct{})
+	}
+	s.inFlight[c] = struct{}{}
+}
+
+// finished records that c won't be processed again
+func (s *Server) finished(c *Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.inFlight, c)
+}
+
+// stopping returns whether the queue has stopped accepting jobs
+func (s *Server) stopping() bool {
+	return s.ctx != nil && (*s.ctx).Err() != nil
 }
 
 func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
 	payload, err := github.ValidatePayload(r, []byte(s.WebhookSecret))
 	if err != nil {
-		log.Println(err)
+		s.logger().Warn("Rejected webhook", "delivery", github.DeliveryID(r), "err", err)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
 	defer r.Body.Close()
 
-	event, err := github.ParseWebHook(github.WebHookType(r), payload)
+	var deliveryKey string
+	if deliveryID := github.DeliveryID(r); s.Dedupe != nil && deliveryID != "" {
+		key := fmt.Sprintf("delivery:%s", deliveryID)
+		claimed, err := s.Dedupe.Claim(key)
+		if err != nil {
+			s.logger().Error("Couldn't claim delivery", "delivery", deliveryID, "err", err)
+		} else if !claimed {
+			s.logger().Info("Skipping delivery, it was already received", "delivery", deliveryID)
+			fmt.Fprintf(w, "already received")
+			return
+		} else {
+			deliveryKey = key
+		}
+	}
+
+	status, err := s.accept(r, payload)
 	if err != nil {
-		log.Println(err)
+		s.logger().Warn("Couldn't accept webhook", "delivery", github.DeliveryID(r), "status", status, "err", err)
+		// Allow GitHub to redeliver webhooks which may succeed next time
+		if deliveryKey != "" && status >= http.StatusInternalServerError {
+			s.Dedupe.Release(deliveryKey)
+		}
+		http.Error(w, err.Error(), status)
 		return
 	}
+	w.WriteHeader(status)
+}
+
+// accept parses a webhook and queues it to be processed, returning the
+// status to respond with
+func (s *Server) accept(r *http.Request, payload []byte) (int, error) {
+	event, err := github.ParseWebHook(github.WebHookType(r), payload)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
 
 	ge := &GenericEvent{}
 	err = json.Unmarshal(payload, &ge)
 	if err != nil {
-		log.Println(err)
-		return
+		return http.StatusBadRequest, err
+	}
+	webhooksReceived.inc(github.WebHookType(r), ge.GetAction())
+
+	logger := s.logger().With(
+		"delivery", github.DeliveryID(r),
+		"event", github.WebHookType(r),
+		"installation", ge.Installation.GetID(),
+		"repo", ge.Repo.GetFullName(),
+		"head_sha", headSHA(event),
+	)
+
+	if _, ok := event.(*github.PingEvent); ok {
+		return http.StatusOK, nil
+	}
+	if !Supported(event) {
+		return http.StatusBadRequest, unsupportedEventError(event)
 	}
 
 	var installationTransport *ghinstallation.Transport
 	if ge.Installation != nil {
-		installationTransport, err = ghinstallation.NewKeyFromFile(*s.tr, s.AppID, int(ge.Installation.GetID()), s.PrivateKeyFile)
+		installationTransport, err = s.installationTransport(ge.Installation.GetID())
+		if err == nil {
+			_, err = installationTransport.Token()
+		}
 		if err != nil {
-			log.Println(err)
-			return
+			logger.Error("Couldn't authenticate as installation", "err", err)
+			return http.StatusInternalServerError, errors.New("Couldn't authenticate as installation")
 		}
 	}
 
@@ -84,18 +433,149 @@ func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
 		Event:     event,
 		Ctx:       s.ctx,
 		AppID:     &s.AppID,
-		Github:    github.NewClient(&http.Client{Transport: installationTransport}),
+		Github:    s.newClient(installationTransport),
 		AppGitHub: s.GitHubAppClient,
+		Dedupe:    s.Dedupe,
+		Log:       logger,
 	}
 
-	// TODO Return a 500 if we don't make it through the complete CheckRun cycle
-	c.Process()
-	return
+	// Process the event once GitHub has been told it was received, as GitHub
+	// gives up on deliveries which take longer than 10 seconds
+	s.started(c)
+	err = s.enqueue(c, ge.Repo.GetFullName(), 1)
+	if err != nil {
+		s.finished(c)
+		return http.StatusServiceUnavailable, err
+	}
+	logger.Debug("Queued webhook", "depth", s.queue.Depth())
+	return http.StatusAccepted, nil
 }
 
-func (s *Server) health(w http.ResponseWriter, r *http.Request) {
-	// TODO better health checks
-	fmt.Fprintf(w, "hi")
+// headSHA returns the commit an event refers to, if any
+func headSHA(event interface{}) string {
+	switch e := event.(type) {
+	case *github.CheckSuiteEvent:
+		return e.GetCheckSuite().GetHeadSHA()
+	case *github.CheckRunEvent:
+		return e.GetCheckRun().GetHeadSHA()
+	case *github.PullRequestEvent:
+		return e.GetPullRequest().GetHead().GetSHA()
+	}
+	return ""
+}
+
+// enqueue queues c to be processed, processing it again after a delay if it
+// fails in a way that may succeed when retried
+func (s *Server) enqueue(c *Context, repo string, attempt int) error {
+	return s.queue.Enqueue(&Job{
+		Repo: repo,
+		Run: func() {
+			_, err := c.Process()
+			if err == nil {
+				s.finished(c)
+				return
+			}
+			c.logger().Error("Couldn't process webhook", "attempt", attempt, "retryable", IsRetryable(err), "err", fmt.Sprintf("%+v", err))
+			if s.stopping() {
+				// Left in flight for drain to cancel
+				return
+			}
+			if IsRetryable(err) && attempt < maxProcessAttempts {
+				time.AfterFunc(time.Duration(attempt)*processRetryDelay, func() {
+					err := s.enqueue(c, repo, attempt+1)
+					if err == ErrQueueStopped {
+						// Left in flight for drain to cancel
+						return
+					}
+					if err != nil {
+						c.logger().Error("Couldn't queue retry", "attempt", attempt+1, "err", err)
+						c.Cancel("kubevalidator is too busy")
+						s.finished(c)
+					}
+				})
+				return
+			}
+			c.Cancel(fmt.Sprintf("processing failed after %d attempts", attempt))
+			s.finished(c)
+		},
+	})
+}
+
+// sweepStaleCheckRuns concludes abandoned check runs in the repositories
+// the app is installed on. Instances sharing Dedupe take turns, so only one
+// of them sweeps when several start at once.
+func (s *Server) sweepStaleCheckRuns() {
+	if s.Dedupe != nil {
+		claimed, err := s.Dedupe.Claim(fmt.Sprintf("sweep:%d", s.AppID))
+		if err != nil {
+			s.logger().Error("Couldn't claim sweep", "err", err)
+			return
+		}
+		if !claimed {
+			s.logger().Debug("Skipping sweep, another instance swept recently")
+			return
+		}
+	}
+
+	remaining := maxSweptRefs
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		installations, resp, err := s.GitHubAppClient.Apps.ListInstallations(*s.ctx, opt)
+		if err != nil {
+			s.logger().Error("Couldn't list installations", "err", err)
+			return
+		}
+		for _, installation := range installations {
+			if remaining = s.sweepInstallation(installation, remaining); remaining <= 0 {
+				s.logger().Warn("Stopped sweeping stale check runs", "refs", maxSweptRefs)
+				return
+			}
+		}
+		if resp.NextPage == 0 {
+			return
+		}
+		opt.Page = resp.NextPage
+	}
+}
+
+// sweepInstallation sweeps up to remaining refs in each of installation's
+// repositories, returning how many may still be swept
+func (s *Server) sweepInstallation(installation *github.Installation, remaining int) int {
+	installationTransport, err := s.installationTransport(installation.GetID())
+	logger := s.logger().With("installation", installation.GetID())
+	if err != nil {
+		logger.Error("Couldn't authenticate as installation", "err", err)
+		return remaining
+	}
+	c := &Context{
+		Ctx:       s.ctx,
+		AppID:     &s.AppID,
+		Github:    s.newClient(installationTransport),
+		AppGitHub: s.GitHubAppClient,
+		Log:       logger,
+	}
+
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		repos, resp, err := c.Github.Apps.ListRepos(*s.ctx, opt)
+		if err != nil {
+			logger.Error("Couldn't list repositories", "err", err)
+			return remaining
+		}
+		for _, repo := range repos {
+			swept, err := c.sweepStaleCheckRuns(repo, remaining)
+			if err != nil {
+				logger.Error("Couldn't sweep stale check runs", "repo", repo.GetFullName(), "err", err)
+			}
+			if remaining -= swept; remaining <= 0 {
+				return remaining
+			}
+		}
+		if resp.NextPage == 0 {
+			return remaining
+		}
+		opt.Page = resp.NextPage
+	}
 }
 
 func (s *Server) redirect(w http.ResponseWriter, r *http.Request) {
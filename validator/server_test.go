@@ -0,0 +1,318 @@
+package validator
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func signedWebhookRequest(secret string, event string, payload string) *http.Request {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(payload))
+	r := httptest.NewRequest("POST", "/webhook", bytes.NewBufferString(payload))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-GitHub-Event", event)
+	r.Header.Set("X-Hub-Signature", fmt.Sprintf("sha1=%s", hex.EncodeToString(mac.Sum(nil))))
+	return r
+}
+
+func TestWebhookResponses(t *testing.T) {
+	checkRunEvent := `{"action": "created", "check_run": {"id": 4}, "repository": {"full_name": "o/r"}}`
+	cases := []struct {
+		name    string
+		request *http.Request
+		want    int
+	}{
+		{"bad signature", signedWebhookRequest("wrong", "check_run", checkRunEvent), http.StatusUnauthorized},
+		{"unknown event", signedWebhookRequest("secret", "nope", checkRunEvent), http.StatusBadRequest},
+		{"unsupported event", signedWebhookRequest("secret", "push", `{}`), http.StatusBadRequest},
+		{"malformed payload", signedWebhookRequest("secret", "check_run", `{`), http.StatusBadRequest},
+		{"installation token failure", signedWebhookRequest("secret", "check_run", `{"installation": {"id": 1}}`), http.StatusInternalServerError},
+		{"ping", signedWebhookRequest("secret", "ping", `{"zen": "hi"}`), http.StatusOK},
+		{"supported event", signedWebhookRequest("secret", "check_run", checkRunEvent), http.StatusAccepted},
+	}
+	for _, c := range cases {
+		tr := http.DefaultTransport
+		s := &Server{
+			WebhookSecret:  "secret",
+			PrivateKeyFile: "/nonexistent/key.pem",
+			tr:             &tr,
+			queue:          NewQueue(1, 1),
+		}
+		w := httptest.NewRecorder()
+		s.handle(w, c.request)
+		if w.Code != c.want {
+			t.Errorf("%s: expected %d, got %d: %s", c.name, c.want, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestWebhooksAreAcceptedBeforeTheyreProcessed(t *testing.T) {
+	s := &Server{
+		WebhookSecret: "secret",
+		Schemas:       &SchemaStore{DefaultLocation: "file://" + os.TempDir()},
+		queue:         NewQueue(1, 1),
+	}
+	checkRunEvent := `{"action": "created", "check_run": {"id": 4}, "repository": {"full_name": "o/r"}}`
+
+	w := httptest.NewRecorder()
+	s.handle(w, signedWebhookRequest("secret", "check_run", checkRunEvent))
+	if w.Code != http.StatusAccepted {
+		t.Errorf("Expected %d, got %d", http.StatusAccepted, w.Code)
+	}
+	if depth := s.queue.Depth(); depth != 1 {
+		t.Errorf("Expected the webhook to be queued, got a depth of %d", depth)
+	}
+
+	w = httptest.NewRecorder()
+	s.handle(w, signedWebhookRequest("secret", "check_run", checkRunEvent))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected %d once the queue was full, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	s.readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+	var health struct {
+		Checks map[string]map[string]interface{} `json:"checks"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	if queue := health.Checks["queue"]; queue["status"] != "failed" || queue["depth"] != float64(1) || queue["capacity"] != float64(1) {
+		t.Errorf("Unexpected queue health %+v", queue)
+	}
+}
+
+func TestRetryableFailuresAreProcessedAgain(t *testing.T) {
+	defer func(delay time.Duration) { processRetryDelay = delay }(processRetryDelay)
+	processRetryDelay = time.Millisecond
+
+	client, mux, _, teardown := setup()
+	defer teardown()
+	var mu sync.Mutex
+	attempts := 0
+	mux.HandleFunc("/repos/o/r/check-suites/5/rerequest", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		attempts++
+		mu.Unlock()
+		http.Error(w, `{"message": "oops"}`, http.StatusBadGateway)
+	})
+
+	s := &Server{queue: NewQueue(1, 1)}
+	s.queue.Start()
+	ctx := context.Background()
+	c := &Context{
+		Ctx: &ctx,
+		Event: &github.CheckRunEvent{
+			Action:   github.String("rerequested"),
+			CheckRun: &github.CheckRun{CheckSuite: &github.CheckSuite{ID: github.Int64(5)}},
+			Repo: &github.Repository{
+				Name:  github.String("r"),
+				Owner: &github.User{Login: github.String("o")},
+			},
+		},
+		Github: client,
+	}
+	if err := s.enqueue(c, "o/r", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := attempts == maxProcessAttempts
+		mu.Unlock()
+		if done {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if attempts != maxProcessAttempts {
+		t.Errorf("Expected %d attempts, got %d", maxProcessAttempts, attempts)
+	}
+}
+
+func TestRedeliveredWebhooksAreSkipped(t *testing.T) {
+	s := &Server{
+		WebhookSecret: "secret",
+		queue:         NewQueue(1, 1),
+		Dedupe:        &MemoryDedupeStore{TTL: time.Hour},
+	}
+	checkRunEvent := `{"action": "created", "check_run": {"id": 4}, "repository": {"full_name": "o/r"}}`
+	deliver := func() int {
+		r := signedWebhookRequest("secret", "check_run", checkRunEvent)
+		r.Header.Set("X-GitHub-Delivery", "d")
+		w := httptest.NewRecorder()
+		s.handle(w, r)
+		return w.Code
+	}
+
+	if code := deliver(); code != http.StatusAccepted {
+		t.Errorf("Expected %d, got %d", http.StatusAccepted, code)
+	}
+	if code := deliver(); code != http.StatusOK {
+		t.Errorf("Expected a redelivery to be skipped with %d, got %d", http.StatusOK, code)
+	}
+	if depth := s.queue.Depth(); depth != 1 {
+		t.Errorf("Expected a single job to be queued, got %d", depth)
+	}
+}
+
+func TestWebhooksAreCountedByEventAndAction(t *testing.T) {
+	s := &Server{
+		WebhookSecret: "secret",
+		queue:         NewQueue(1, 1),
+	}
+	s.handle(httptest.NewRecorder(), signedWebhookRequest("secret", "check_run", `{"action": "rerequested", "check_run": {"id": 4}}`))
+
+	w := httptest.NewRecorder()
+	DefaultMetrics.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if want := `kubevalidator_webhooks_received_total{event="check_run",action="rerequested"}`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("Expected metrics to include %s", want)
+	}
+}
+
+func TestWebhookLogsIncludeDeliveryDetails(t *testing.T) {
+	var buf bytes.Buffer
+	s := &Server{
+		WebhookSecret: "secret",
+		queue:         NewQueue(1, 1),
+		Log:           NewLogger(&buf, LevelDebug, "logfmt"),
+	}
+	r := signedWebhookRequest("secret", "check_suite", `{"action": "requested", "check_suite": {"head_sha": "abc"}, "repository": {"full_name": "o/r"}}`)
+	r.Header.Set("X-GitHub-Delivery", "d")
+	s.handle(httptest.NewRecorder(), r)
+
+	for _, want := range []string{"delivery=d", "event=check_suite", "installation=0", "repo=o/r", "head_sha=abc"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected logs to include %s, got %s", want, buf.String())
+		}
+	}
+}
+
+func TestDrainCancelsCheckRunsWhichCouldntFinish(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	updates := recordCheckRunUpdates(t, mux)
+	mux.HandleFunc("/repos/o/r/check-runs", func(w http.ResponseWriter, r *http.Request) {
+		testMethod(t, r, "POST")
+		fmt.Fprint(w, `{"id": 4}`)
+	})
+	started := make(chan struct{})
+	mux.HandleFunc("/repos/o/r/contents/.github/kubevalidator.yaml", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	})
+
+	work, stopWork := context.WithCancel(context.Background())
+	defer stopWork()
+	s := &Server{ctx: &work, stopWork: stopWork, queue: NewQueue(10, 1)}
+	s.queue.Start()
+
+	// The first suite is running when the server shuts down and the second,
+	// a retry whose check run already exists, is waiting behind it
+	running := &Context{Ctx: &work, Github: client, Event: testCheckSuiteEvent()}
+	waiting := &Context{Ctx: &work, Github: client, Event: testCheckSuiteEvent(), CheckRunID: 4}
+	for _, c := range []*Context{running, waiting} {
+		s.started(c)
+		if err := s.enqueue(c, "o/r", 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-started
+
+	deadline, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	s.drain(deadline)
+
+	if len(*updates) != 2 {
+		t.Fatalf("Expected both check runs to be cancelled, got %d updates", len(*updates))
+	}
+	for _, update := range *updates {
+		if update.GetConclusion() != "cancelled" || !strings.Contains(update.GetOutput().GetSummary(), "Re-run it") {
+			t.Errorf("Unexpected update %+v", update)
+		}
+	}
+	if len(s.inFlight) != 0 {
+		t.Errorf("Expected nothing to be left in flight, got %d", len(s.inFlight))
+	}
+}
+
+func TestEnterpriseServerURLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kubevalidator-server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tr := http.DefaultTransport
+	s := &Server{
+		AppID:          1,
+		PrivateKeyFile: testPrivateKeyFile(t, dir),
+		BaseURL:        "https://ghe.example.com/api/v3",
+		tr:             &tr,
+	}
+	if err := s.parseURLs(); err != nil {
+		t.Fatal(err)
+	}
+
+	client := s.newClient(nil)
+	if got, want := client.BaseURL.String(), "https://ghe.example.com/api/v3/"; got != want {
+		t.Errorf("Expected API URL %s, got %s", want, got)
+	}
+	if got, want := client.UploadURL.String(), "https://ghe.example.com/api/uploads/"; got != want {
+		t.Errorf("Expected upload URL %s, got %s", want, got)
+	}
+
+	itr, err := s.installationTransport(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := itr.BaseURL, "https://ghe.example.com/api/v3"; got != want {
+		t.Errorf("Expected installation tokens to be requested from %s, got %s", want, got)
+	}
+	atr, err := s.appsTransport(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := atr.BaseURL, "https://ghe.example.com/api/v3"; got != want {
+		t.Errorf("Expected the App to authenticate with %s, got %s", want, got)
+	}
+}
+
+func TestOnlyOneInstanceSweeps(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	listed := 0
+	mux.HandleFunc("/app/installations", func(w http.ResponseWriter, r *http.Request) {
+		listed++
+		fmt.Fprint(w, `[]`)
+	})
+
+	ctx := context.Background()
+	dedupe := &MemoryDedupeStore{TTL: time.Minute}
+	for i := 0; i < 2; i++ {
+		s := &Server{AppID: 1, GitHubAppClient: client, Dedupe: dedupe, ctx: &ctx}
+		s.sweepStaleCheckRuns()
+	}
+	if listed != 1 {
+		t.Errorf("Expected installations to be listed by a single instance, got %d", listed)
+	}
+}
@@ -0,0 +1,79 @@
+package validator
+
+import "sort"
+
+// File describes a file in a repository which may be validated
+type File struct {
+	Filename string
+	BlobURL  string
+}
+
+// GetFilename returns the Filename field if it's non-nil, zero value
+// otherwise.
+func (f *File) GetFilename() string {
+	if f == nil {
+		return ""
+	}
+	return f.Filename
+}
+
+// GetBlobURL returns the BlobURL field if it's non-nil, zero value otherwise.
+func (f *File) GetBlobURL() string {
+	if f == nil {
+		return ""
+	}
+	return f.BlobURL
+}
+
+// Source provides access to the contents of a repository at a single ref so
+// that config matching, validation and annotation building don't depend on
+// where the files came from.
+type Source interface {
+	// ChangedFiles lists the files which were added or modified at the ref
+	ChangedFiles() ([]*File, error)
+
+	// Files lists every file in the repository at the ref
+	Files() ([]*File, error)
+
+	// ReadFile returns the contents of filename at the ref
+	ReadFile(filename string) ([]byte, error)
+
+	// BlobURL returns a URL at which a human can view filename at the ref, or
+	// an empty string if there isn't one
+	BlobURL(filename string) string
+}
+
+// ValidateSource validates the changed files in source, or every file if the
+// configuration found in its .github/kubevalidator.yaml sets scope: all,
+// returning the Candidates that were checked along with the Annotations that
+// would have been added to a check run.
+func ValidateSource(source Source) (Candidates, Annotations, error) {
+	var annotations Annotations
+
+	config, configAnnotation, err := loadConfig(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	if configAnnotation != nil {
+		annotations = append(annotations, configAnnotation)
+		return nil, annotations, nil
+	}
+
+	files, err := config.files(source)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	annotations = append(annotations, config.loadCRDs(source)...)
+
+	var candidates Candidates
+	candidates = config.matchingCandidates(source, files)
+	builtCandidates, builtAnnotations := config.builtCandidates(source, files)
+	candidates = append(candidates, builtCandidates...)
+	annotations = append(annotations, builtAnnotations...)
+	annotations = append(annotations, candidates.LoadBytes()...)
+	annotations = append(annotations, candidates.Validate()...)
+	sort.Sort(annotations)
+
+	return candidates, annotations, nil
+}
@@ -0,0 +1,64 @@
+package validator
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// DirectorySource reads files from a directory on disk, usually the working
+// tree of a local checkout. Every file in the directory is considered changed.
+type DirectorySource struct {
+	Dir string
+}
+
+// ChangedFiles lists every file beneath Dir
+func (s *DirectorySource) ChangedFiles() ([]*File, error) {
+	return s.Files()
+}
+
+// Files lists every file beneath Dir using slash separated paths relative to
+// Dir, mirroring the filenames GitHub reports for a PR.
+func (s *DirectorySource) Files() ([]*File, error) {
+	var files []*File
+	err := filepath.Walk(s.Dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".git" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(s.Dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, &File{
+			Filename: filepath.ToSlash(rel),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't list files")
+	}
+	return files, nil
+}
+
+// ReadFile reads filename relative to Dir
+func (s *DirectorySource) ReadFile(filename string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filepath.Join(s.Dir, filepath.FromSlash(filename)))
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Couldn't load %s", filename))
+	}
+	return b, nil
+}
+
+// BlobURL returns an empty string as local files can't be linked to
+func (s *DirectorySource) BlobURL(filename string) string {
+	return ""
+}
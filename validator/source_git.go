@@ -0,0 +1,90 @@
+package validator
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// GitSource reads files from the object database of a local git repository
+// without requiring them to be checked out, which makes it suitable for use
+// in hooks and CI systems other than GitHub.
+type GitSource struct {
+	// Dir is any directory inside the repository
+	Dir string
+	// Base is the commit changes are compared against. When empty, every file
+	// at Head is considered changed.
+	Base string
+	// Head is the commit files are read from. Defaults to HEAD.
+	Head string
+}
+
+func (s *GitSource) head() string {
+	if s.Head == "" {
+		return "HEAD"
+	}
+	return s.Head
+}
+
+// ChangedFiles lists the files added or modified between the merge base of
+// Base and Head and Head, matching the files GitHub reports for a PR.
+func (s *GitSource) ChangedFiles() ([]*File, error) {
+	if s.Base == "" {
+		return s.Files()
+	}
+	return s.listFiles("diff", "-z", "--name-only", "--no-renames", "--diff-filter=d", fmt.Sprintf("%s...%s", s.Base, s.head()))
+}
+
+// Files lists every file in Head's tree. Like the other methods, paths are
+// relative to the root of the repository rather than Dir.
+func (s *GitSource) Files() ([]*File, error) {
+	return s.listFiles("ls-tree", "-r", "-z", "--name-only", "--full-tree", s.head())
+}
+
+// listFiles runs a git command which prints NUL separated filenames
+func (s *GitSource) listFiles(args ...string) ([]*File, error) {
+	out, err := s.git(args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't list files")
+	}
+
+	var files []*File
+	for _, filename := range strings.Split(string(out), "\x00") {
+		if filename == "" {
+			continue
+		}
+		files = append(files, &File{
+			Filename: filename,
+		})
+	}
+	return files, nil
+}
+
+// ReadFile reads the blob for filename in Head's tree
+func (s *GitSource) ReadFile(filename string) ([]byte, error) {
+	b, err := s.git("cat-file", "blob", fmt.Sprintf("%s:%s", s.head(), filename))
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Couldn't load %s", filename))
+	}
+	return b, nil
+}
+
+// BlobURL returns an empty string as there's no canonical place to link to
+func (s *GitSource) BlobURL(filename string) string {
+	return ""
+}
+
+func (s *GitSource) git(args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = s.Dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, errors.Wrap(err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
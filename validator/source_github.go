@@ -0,0 +1,279 @@
+package validator
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/github"
+	"github.com/pkg/errors"
+)
+
+// maxPullRequestFiles is the most files the Pull Request files API will list
+const maxPullRequestFiles = 3000
+
+// GitHubSource reads files from a GitHub repository using the Contents API.
+// Trees and files are only fetched once, so a GitHubSource should only be
+// used to process a single event.
+type GitHubSource struct {
+	Client *github.Client
+	Ctx    context.Context
+	Owner  string
+	Repo   string
+	// Ref is the commit to read files from, usually the head SHA of a
+	// CheckSuite
+	Ref string
+	// HTMLURL is the repository's web URL, like https://github.com/o/r
+	HTMLURL string
+	// PullRequests are the numbers of the PRs whose files are considered
+	// changed
+	PullRequests []int
+
+	// Log is used to report how changed files were found
+	Log *Logger
+
+	// comparedTrees lists the PRs whose changed files were found by
+	// comparing trees because they changed too many files to list
+	comparedTrees []int
+
+	// mu guards the caches below, as files may be read by concurrent
+	// validations
+	mu sync.Mutex
+	// trees caches the entries of the trees which have been listed by ref
+	trees map[string][]github.TreeEntry
+	// truncated is set if GitHub didn't list every entry of a tree
+	truncated bool
+	// contents caches the files which have been read by filename
+	contents map[string][]byte
+}
+
+// ChangedFiles lists the files added or modified by the source's PRs. PRs
+// which change more files than the Pull Request files API will list are
+// compared using the Git Data API instead.
+func (s *GitHubSource) ChangedFiles() ([]*File, error) {
+	s.comparedTrees = nil
+	var prFiles []*File
+	for _, pr := range s.PullRequests {
+		files, listed, err := s.pullRequestFiles(pr)
+		if err != nil {
+			return nil, err
+		}
+		if listed >= maxPullRequestFiles {
+			compared, ok, err := s.compareTrees(pr)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				files = compared
+				s.comparedTrees = append(s.comparedTrees, pr)
+			}
+		}
+		prFiles = append(prFiles, files...)
+	}
+	return prFiles, nil
+}
+
+// pullRequestFiles pages through the files added or modified by a PR,
+// returning them along with the number of files listed including removals
+func (s *GitHubSource) pullRequestFiles(pr int) ([]*File, int, error) {
+	var prFiles []*File
+	listed := 0
+	opt := &github.ListOptions{PerPage: 100}
+	for {
+		files, resp, prListErr := s.Client.PullRequests.ListFiles(s.Ctx, s.Owner, s.Repo, pr, opt)
+		if prListErr != nil {
+			return nil, listed, errors.Wrap(prListErr, "Couldn't list files")
+		}
+		for _, file := range files {
+			switch status := file.GetStatus(); status {
+			// skip files that weren't added or changed
+			case "removed":
+				continue
+			default:
+				prFiles = append(prFiles, &File{
+					Filename: file.GetFilename(),
+					BlobURL:  file.GetBlobURL(),
+				})
+			}
+		}
+		listed += len(files)
+		if resp.NextPage == 0 || listed >= maxPullRequestFiles {
+			break
+		}
+		opt.Page = resp.NextPage
+	}
+	return prFiles, listed, nil
+}
+
+// compareTrees lists the files added or modified by a PR by comparing the
+// tree at Ref with the tree at the merge base of the PR. It returns false if
+// the PR didn't change more files than the Pull Request files API lists.
+func (s *GitHubSource) compareTrees(pr int) ([]*File, bool, error) {
+	pullRequest, _, err := s.Client.PullRequests.Get(s.Ctx, s.Owner, s.Repo, pr)
+	if err != nil {
+		return nil, false, errors.Wrap(err, fmt.Sprintf("Couldn't load pull request #%d", pr))
+	}
+	if pullRequest.GetChangedFiles() <= maxPullRequestFiles {
+		return nil, false, nil
+	}
+
+	base := pullRequest.GetBase().GetSHA()
+	comparison, _, err := s.Client.Repositories.CompareCommits(s.Ctx, s.Owner, s.Repo, base, s.Ref)
+	if err != nil {
+		return nil, false, errors.Wrap(err, fmt.Sprintf("Couldn't find the merge base of pull request #%d", pr))
+	}
+	if sha := comparison.GetMergeBaseCommit().GetSHA(); sha != "" {
+		base = sha
+	}
+	s.logger().Info("Pull request changes too many files to list, comparing trees", "pull_request", pr, "changed_files", pullRequest.GetChangedFiles(), "base", base)
+
+	baseBlobs, err := s.blobs(base)
+	if err != nil {
+		return nil, false, err
+	}
+	headEntries, err := s.tree(s.Ref)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var files []*File
+	for _, entry := range headEntries {
+		if entry.GetType() != "blob" || baseBlobs[entry.GetPath()] == entry.GetSHA() {
+			continue
+		}
+		files = append(files, &File{
+			Filename: entry.GetPath(),
+			BlobURL:  s.BlobURL(entry.GetPath()),
+		})
+	}
+	return files, true, nil
+}
+
+// logger returns the source's Logger, falling back to DefaultLogger
+func (s *GitHubSource) logger() *Logger {
+	if s.Log == nil {
+		return DefaultLogger
+	}
+	return s.Log
+}
+
+// ChangedFilesDescription describes how ChangedFiles found the files it
+// listed in Markdown
+func (s *GitHubSource) ChangedFilesDescription() string {
+	if len(s.comparedTrees) == 0 {
+		return "Changed files were listed using the Pull Request files API."
+	}
+	var prs []string
+	for _, pr := range s.comparedTrees {
+		prs = append(prs, fmt.Sprintf("#%d", pr))
+	}
+	return fmt.Sprintf("%s changed more than %d files, so changed files were found by comparing trees using the Git Data API.", strings.Join(prs, ", "), maxPullRequestFiles)
+}
+
+// tree lists every entry in the tree of ref
+func (s *GitHubSource) tree(ref string) ([]github.TreeEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entries, ok := s.trees[ref]; ok {
+		return entries, nil
+	}
+	tree, _, err := s.Client.Git.GetTree(s.Ctx, s.Owner, s.Repo, ref, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "Couldn't list files")
+	}
+	if tree.GetTruncated() {
+		s.logger().Warn("Tree was truncated, not all files will be listed", "ref", ref)
+		s.truncated = true
+	}
+	if s.trees == nil {
+		s.trees = make(map[string][]github.TreeEntry)
+	}
+	s.trees[ref] = tree.Entries
+	return tree.Entries, nil
+}
+
+// Truncated returns whether GitHub truncated any of the trees listed to find
+// files because they had too many entries, in which case some files weren't
+// considered
+func (s *GitHubSource) Truncated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.truncated
+}
+
+// blobs maps the paths of the blobs in the tree of ref to their SHAs
+func (s *GitHubSource) blobs(ref string) (map[string]string, error) {
+	entries, err := s.tree(ref)
+	if err != nil {
+		return nil, err
+	}
+	blobs := make(map[string]string)
+	for _, entry := range entries {
+		if entry.GetType() == "blob" {
+			blobs[entry.GetPath()] = entry.GetSHA()
+		}
+	}
+	return blobs, nil
+}
+
+// Files lists every file in the repository at Ref using the Git Trees API
+func (s *GitHubSource) Files() ([]*File, error) {
+	entries, err := s.tree(s.Ref)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []*File
+	for _, entry := range entries {
+		if entry.GetType() != "blob" {
+			continue
+		}
+		files = append(files, &File{
+			Filename: entry.GetPath(),
+			BlobURL:  s.BlobURL(entry.GetPath()),
+		})
+	}
+	return files, nil
+}
+
+// ReadFile loads the contents of filename at Ref using the Contents API. Only
+// files which are validated, or are needed to build what is, are read.
+func (s *GitHubSource) ReadFile(filename string) ([]byte, error) {
+	s.mu.Lock()
+	b, ok := s.contents[filename]
+	s.mu.Unlock()
+	if ok {
+		return b, nil
+	}
+	fileToValidate, _, _, err := s.Client.Repositories.GetContents(s.Ctx, s.Owner, s.Repo, filename, &github.RepositoryContentGetOptions{
+		Ref: s.Ref,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Couldn't load %s", filename))
+	}
+
+	contentToValidate, err := fileToValidate.GetContent()
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("Couldn't load contents of %s", filename))
+	}
+
+	b = []byte(contentToValidate)
+	s.mu.Lock()
+	if s.contents == nil {
+		s.contents = make(map[string][]byte)
+	}
+	s.contents[filename] = b
+	s.mu.Unlock()
+	return b, nil
+}
+
+// BlobURL links to filename at Ref on HTMLURL, or on github.com if it's
+// empty
+func (s *GitHubSource) BlobURL(filename string) string {
+	repoURL := strings.TrimSuffix(s.HTMLURL, "/")
+	if repoURL == "" {
+		repoURL = fmt.Sprintf("https://github.com/%s/%s", s.Owner, s.Repo)
+	}
+	return fmt.Sprintf("%s/blob/%s/%s", repoURL, s.Ref, filename)
+}
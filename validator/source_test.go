@@ -0,0 +1,347 @@
+package validator
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/go-test/deep"
+)
+
+func TestValidateDirectoryMatchesCandidates(t *testing.T) {
+	candidates, _, err := ValidateSource(&DirectorySource{Dir: ".."})
+	if err != nil {
+		t.Errorf("Validating the repository failed with %v", err)
+		return
+	}
+
+	matches, _ := filepath.Glob("../config/kubernetes/default/*/*.yaml")
+	if len(candidates) != len(matches) {
+		t.Errorf("Expected %d candidates, got %d", len(matches), len(candidates))
+	}
+}
+
+func TestValidateDirectoryWithoutConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubevalidator")
+	defer os.RemoveAll(dir)
+
+	_, _, err := ValidateSource(&DirectorySource{Dir: dir})
+	if err == nil {
+		t.Error("Expected an error when no configuration is present")
+	}
+}
+
+func TestValidateDirectoryWithInvalidConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "kubevalidator")
+	defer os.RemoveAll(dir)
+
+	fileContents, _ := ioutil.ReadFile("../fixtures/invalid/kubevalidator/schemaFork.yaml")
+	os.MkdirAll(filepath.Join(dir, ".github"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, ".github", "kubevalidator.yaml"), fileContents, 0644)
+
+	candidates, annotations, err := ValidateSource(&DirectorySource{Dir: dir})
+	if err != nil {
+		t.Errorf("Validating %s failed with %v", dir, err)
+		return
+	}
+	if len(candidates) != 0 {
+		t.Errorf("Expected no candidates, got %d", len(candidates))
+	}
+	if len(annotations) != 1 || annotations[0].GetPath() != configPath {
+		t.Errorf("Expected a single annotation on %s, got %+v", configPath, annotations)
+	}
+}
+
+func TestGitSourceReadsChangedFilesFromObjectDatabase(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir, _ := ioutil.TempDir("", "kubevalidator")
+	defer os.RemoveAll(dir)
+
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=t", "-c", "user.email=t@example.com"}, args...)...)
+		cmd.Dir = dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	ioutil.WriteFile(filepath.Join(dir, "unchanged.yaml"), []byte("a: b\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "removed.yaml"), []byte("c: d\n"), 0644)
+	os.MkdirAll(filepath.Join(dir, "config"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "config", "nested.yaml"), []byte("g: h\n"), 0644)
+	git("add", ".")
+	git("commit", "-q", "-m", "base")
+	git("tag", "base")
+	ioutil.WriteFile(filepath.Join(dir, "added.yaml"), []byte("e: f\n"), 0644)
+	os.Remove(filepath.Join(dir, "removed.yaml"))
+	git("add", "-A")
+	git("commit", "-q", "-m", "head")
+	// Changes to the working tree aren't visible to GitSource
+	ioutil.WriteFile(filepath.Join(dir, "added.yaml"), []byte("uncommitted: true\n"), 0644)
+
+	source := &GitSource{Dir: dir, Base: "base"}
+	files, err := source.ChangedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(files, []*File{{Filename: "added.yaml"}}); diff != nil {
+		t.Error(diff)
+	}
+
+	b, err := source.ReadFile("added.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "e: f\n" {
+		t.Errorf("Expected committed contents, got %q", b)
+	}
+
+	if _, err := source.ReadFile("removed.yaml"); err == nil {
+		t.Error("Expected an error reading a removed file")
+	}
+
+	// Paths are relative to the root of the repository wherever Dir is
+	source = &GitSource{Dir: filepath.Join(dir, "config")}
+	files, err = source.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := deep.Equal(files, []*File{{Filename: "added.yaml"}, {Filename: "config/nested.yaml"}, {Filename: "unchanged.yaml"}}); diff != nil {
+		t.Error(diff)
+	}
+	if b, err := source.ReadFile("config/nested.yaml"); err != nil || string(b) != "g: h\n" {
+		t.Errorf("Expected to read config/nested.yaml from a subdirectory, got %q and %v", b, err)
+	}
+}
+
+func TestGitHubSourceSkipsRemovedFiles(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	mux.HandleFunc("/repos/o/r/pulls/1/files", func(w http.ResponseWriter, r *http.Request) {
+		testMethod(t, r, "GET")
+		fmt.Fprintf(w, `[
+			{"filename": "added.yaml", "status": "added", "blob_url": "https://github.com/o/r/blob/s/added.yaml"},
+			{"filename": "removed.yaml", "status": "removed"}
+		]`)
+	})
+
+	source := &GitHubSource{
+		Client:       client,
+		Ctx:          context.Background(),
+		Owner:        "o",
+		Repo:         "r",
+		Ref:          "s",
+		PullRequests: []int{1},
+	}
+	files, err := source.ChangedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*File{{Filename: "added.yaml", BlobURL: "https://github.com/o/r/blob/s/added.yaml"}}
+	if diff := deep.Equal(files, want); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestGitHubSourceListsBlobsInTree(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	mux.HandleFunc("/repos/o/r/git/trees/s", func(w http.ResponseWriter, r *http.Request) {
+		testMethod(t, r, "GET")
+		testFormValues(t, r, values{"recursive": "1"})
+		fmt.Fprintf(w, `{
+			"sha": "s",
+			"tree": [
+				{"path": "crds", "type": "tree"},
+				{"path": "crds/crontab.yaml", "type": "blob"}
+			],
+			"truncated": false
+		}`)
+	})
+
+	source := &GitHubSource{
+		Client: client,
+		Ctx:    context.Background(),
+		Owner:  "o",
+		Repo:   "r",
+		Ref:    "s",
+	}
+	files, err := source.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*File{{Filename: "crds/crontab.yaml", BlobURL: "https://github.com/o/r/blob/s/crds/crontab.yaml"}}
+	if diff := deep.Equal(files, want); diff != nil {
+		t.Error(diff)
+	}
+}
+
+func TestGitHubSourceCachesTreesAndFiles(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	var trees, contents int
+	mux.HandleFunc("/repos/o/r/git/trees/s", func(w http.ResponseWriter, r *http.Request) {
+		trees++
+		fmt.Fprintf(w, `{
+			"sha": "s",
+			"tree": [
+				{"path": "deployment.yaml", "type": "blob"}
+			],
+			"truncated": true
+		}`)
+	})
+	mux.HandleFunc("/repos/o/r/contents/deployment.yaml", func(w http.ResponseWriter, r *http.Request) {
+		contents++
+		testFormValues(t, r, values{"ref": "s"})
+		fmt.Fprintf(w, `{"type": "file", "encoding": "base64", "content": "a2luZDogRGVwbG95bWVudAo="}`)
+	})
+
+	source := &GitHubSource{
+		Client: client,
+		Ctx:    context.Background(),
+		Owner:  "o",
+		Repo:   "r",
+		Ref:    "s",
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := source.Files(); err != nil {
+			t.Fatal(err)
+		}
+		b, err := source.ReadFile("deployment.yaml")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != "kind: Deployment\n" {
+			t.Errorf("Expected the file's contents, got %q", b)
+		}
+	}
+	if trees != 1 || contents != 1 {
+		t.Errorf("Expected the tree and file to be fetched once, got %d and %d requests", trees, contents)
+	}
+	if !source.Truncated() {
+		t.Error("Expected the source to report that the tree was truncated")
+	}
+}
+
+func TestGitHubSourcePagesThroughPullRequestFiles(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	mux.HandleFunc("/repos/o/r/pulls/1/files", func(w http.ResponseWriter, r *http.Request) {
+		testMethod(t, r, "GET")
+		switch r.FormValue("page") {
+		case "":
+			testFormValues(t, r, values{"per_page": "100"})
+			w.Header().Set("Link", `<https://api.github.com/repos/o/r/pulls/1/files?page=2>; rel="next"`)
+			fmt.Fprintf(w, `[{"filename": "a.yaml", "status": "added"}]`)
+		case "2":
+			fmt.Fprintf(w, `[{"filename": "b.yaml", "status": "modified"}]`)
+		default:
+			t.Errorf("Unexpected page %s", r.FormValue("page"))
+		}
+	})
+
+	source := &GitHubSource{
+		Client:       client,
+		Ctx:          context.Background(),
+		Owner:        "o",
+		Repo:         "r",
+		Ref:          "s",
+		PullRequests: []int{1},
+	}
+	files, err := source.ChangedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*File{{Filename: "a.yaml"}, {Filename: "b.yaml"}}
+	if diff := deep.Equal(files, want); diff != nil {
+		t.Error(diff)
+	}
+	if description := source.ChangedFilesDescription(); !strings.Contains(description, "Pull Request files API") {
+		t.Errorf("Unexpected description %q", description)
+	}
+}
+
+func TestGitHubSourceComparesTreesOfLargePullRequests(t *testing.T) {
+	client, mux, _, teardown := setup()
+	defer teardown()
+	mux.HandleFunc("/repos/o/r/pulls/1/files", func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.FormValue("page"))
+		if page == 0 {
+			page = 1
+		}
+		if page < maxPullRequestFiles/100 {
+			w.Header().Set("Link", fmt.Sprintf(`<https://api.github.com/repos/o/r/pulls/1/files?page=%d>; rel="next"`, page+1))
+		}
+		var files []string
+		for i := 0; i < 100; i++ {
+			files = append(files, fmt.Sprintf(`{"filename": "%d-%d.yaml", "status": "added"}`, page, i))
+		}
+		fmt.Fprintf(w, "[%s]", strings.Join(files, ","))
+	})
+	mux.HandleFunc("/repos/o/r/pulls/1", func(w http.ResponseWriter, r *http.Request) {
+		testMethod(t, r, "GET")
+		fmt.Fprintf(w, `{"number": 1, "changed_files": 3001, "base": {"sha": "b"}}`)
+	})
+	mux.HandleFunc("/repos/o/r/compare/b...s", func(w http.ResponseWriter, r *http.Request) {
+		testMethod(t, r, "GET")
+		fmt.Fprintf(w, `{"merge_base_commit": {"sha": "m"}}`)
+	})
+	mux.HandleFunc("/repos/o/r/git/trees/m", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"tree": [
+			{"path": "same.yaml", "type": "blob", "sha": "1"},
+			{"path": "modified.yaml", "type": "blob", "sha": "2"},
+			{"path": "removed.yaml", "type": "blob", "sha": "3"}
+		]}`)
+	})
+	mux.HandleFunc("/repos/o/r/git/trees/s", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"tree": [
+			{"path": "dir", "type": "tree", "sha": "4"},
+			{"path": "dir/added.yaml", "type": "blob", "sha": "5"},
+			{"path": "modified.yaml", "type": "blob", "sha": "6"},
+			{"path": "same.yaml", "type": "blob", "sha": "1"}
+		]}`)
+	})
+
+	source := &GitHubSource{
+		Client:       client,
+		Ctx:          context.Background(),
+		Owner:        "o",
+		Repo:         "r",
+		Ref:          "s",
+		PullRequests: []int{1},
+	}
+	files, err := source.ChangedFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*File{
+		{Filename: "dir/added.yaml", BlobURL: "https://github.com/o/r/blob/s/dir/added.yaml"},
+		{Filename: "modified.yaml", BlobURL: "https://github.com/o/r/blob/s/modified.yaml"},
+	}
+	if diff := deep.Equal(files, want); diff != nil {
+		t.Error(diff)
+	}
+	if description := source.ChangedFilesDescription(); !strings.Contains(description, "#1 changed more than 3000 files") {
+		t.Errorf("Unexpected description %q", description)
+	}
+}
+
+func TestGitHubSourceBlobURLs(t *testing.T) {
+	source := &GitHubSource{Owner: "o", Repo: "r", Ref: "s"}
+	if got, want := source.BlobURL("a.yaml"), "https://github.com/o/r/blob/s/a.yaml"; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	source.HTMLURL = "https://ghe.example.com/o/r"
+	if got, want := source.BlobURL("a.yaml"), "https://ghe.example.com/o/r/blob/s/a.yaml"; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}